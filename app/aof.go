@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/appendonly"
+	"github.com/codecrafters-io/redis-starter-go/internal/rdb"
+)
+
+const (
+	aofFsyncAlways   = "always"
+	aofFsyncEverySec = "everysec"
+	aofFsyncNo       = "no"
+	// aofRewriteRetryDelay is how long automatic rewrites wait after a
+	// failed one
+	aofRewriteRetryDelay = time.Minute
+)
+
+var errAOFRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+// AppendOnlyFile logs the writes which changed the keyspace as RESP
+// commands, replaying them restores the dataset. The log is split in a base
+// file with a snapshot, written by rewrites, and incr files with the writes
+// since, the manifest lists them.
+type AppendOnlyFile struct {
+	paths       appendonly.Paths
+	fsync       string
+	rdbPreamble bool
+	values      *Keyspace
+
+	mu       sync.Mutex
+	manifest *appendonly.Manifest
+	// file is the last incr file, writes are appended to it
+	file *os.File
+	// size is the length of the incr file up to the last complete command,
+	// a failed write is cut back to it
+	size int64
+	// currentSize is the size of all the files, baseSize was it right after
+	// the last rewrite
+	currentSize int64
+	baseSize    int64
+	// unsynced is set by writes waiting for the next fsync of everysec
+	unsynced            bool
+	lastWriteErr        error
+	rewriteInProgress   bool
+	rewriteStart        time.Time
+	lastRewriteTry      time.Time
+	lastRewriteOK       bool
+	lastRewriteDuration time.Duration
+	closed              chan struct{}
+}
+
+// OpenAppendOnlyFile opens the last incr file for appending, creating the
+// directory and the manifest when needed. A single file AOF of older
+// versions becomes the base. It starts the fsync loop of everysec.
+func OpenAppendOnlyFile(paths appendonly.Paths, fsync string, rdbPreamble bool, values *Keyspace) (*AppendOnlyFile, error) {
+	if fsync != aofFsyncAlways && fsync != aofFsyncEverySec && fsync != aofFsyncNo {
+		return nil, fmt.Errorf("invalid appendfsync %q", fsync)
+	}
+	if err := os.MkdirAll(paths.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	manifest, err := appendonly.ReadManifest(paths.Manifest())
+	if errors.Is(err, os.ErrNotExist) {
+		manifest = &appendonly.Manifest{}
+		if _, err := os.Stat(paths.Legacy); err == nil {
+			if err := os.Rename(paths.Legacy, paths.File(paths.Name)); err != nil {
+				return nil, fmt.Errorf("moving AOF to %s: %w", paths.Dir, err)
+			}
+			manifest.Base = &appendonly.FileInfo{Name: paths.Name, Seq: 1, Type: appendonly.TypeBase}
+			manifest.BaseSeq = 1
+			slog.Info("AOF upgraded to the multi part layout", "dir", paths.Dir)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	aof := &AppendOnlyFile{
+		paths:         paths,
+		fsync:         fsync,
+		rdbPreamble:   rdbPreamble,
+		values:        values,
+		manifest:      manifest,
+		lastRewriteOK: true,
+		// -1 until the first rewrite finishes
+		lastRewriteDuration: -1,
+		closed:              make(chan struct{}),
+	}
+	if len(manifest.Incrs) == 0 {
+		err = aof.openNewIncr()
+	} else {
+		aof.file, err = os.OpenFile(paths.File(manifest.Incrs[len(manifest.Incrs)-1].Name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err == nil {
+			err = appendonly.WriteManifest(paths, manifest)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range manifest.Files() {
+		if stat, err := os.Stat(paths.File(info.Name)); err == nil {
+			aof.currentSize += stat.Size()
+		}
+	}
+	if stat, err := aof.file.Stat(); err == nil {
+		aof.size = stat.Size()
+	}
+	aof.baseSize = aof.currentSize
+	if fsync == aofFsyncEverySec {
+		go aof.fsyncLoop()
+	}
+	return aof, nil
+}
+
+// openNewIncr switches writes to a new incr file and saves the manifest
+// listing it, mu must be held.
+func (aof *AppendOnlyFile) openNewIncr() error {
+	seq := aof.manifest.IncrSeq + 1
+	info := appendonly.FileInfo{Name: aof.paths.IncrName(seq), Seq: seq, Type: appendonly.TypeIncr}
+	file, err := os.OpenFile(aof.paths.File(info.Name), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("creating AOF incr file: %w", err)
+	}
+	manifest := *aof.manifest
+	manifest.Incrs = append(slices.Clone(manifest.Incrs), info)
+	manifest.IncrSeq = seq
+	if err := appendonly.WriteManifest(aof.paths, &manifest); err != nil {
+		file.Close()
+		os.Remove(aof.paths.File(info.Name))
+		return err
+	}
+	if aof.file != nil {
+		if err := aof.file.Sync(); err != nil {
+			slog.Warn("Error syncing the AOF file", "err", err)
+		}
+		aof.file.Close()
+	}
+	aof.manifest = &manifest
+	aof.file = file
+	aof.size = 0
+	aof.unsynced = false
+	return nil
+}
+
+// Feed appends a command. With appendfsync always the command is on disk
+// when Feed returns, and the server exits when it can't be written.
+func (aof *AppendOnlyFile) Feed(args []string) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	n, err := aof.file.WriteString(respCommand(args[0], aofArgs(args[1:])...))
+	if err == nil && aof.fsync == aofFsyncAlways {
+		err = aof.file.Sync()
+	}
+	if err != nil && aof.fsync == aofFsyncAlways {
+		slog.Error("Can't recover from AOF write error when the AOF fsync policy is 'always'. Exiting...", "err", err)
+		os.Exit(1)
+	}
+	if err != nil {
+		slog.Warn("Error writing to the AOF file", "err", err)
+		if n > 0 {
+			// drop the partial command, so the file stays loadable
+			aof.file.Truncate(aof.size)
+		}
+		aof.lastWriteErr = err
+		return
+	}
+	aof.size += int64(n)
+	aof.currentSize += int64(n)
+	aof.unsynced = true
+	aof.lastWriteErr = nil
+}
+
+// Rewrite starts writing a new base file with a snapshot of the keyspace.
+// Writes go to a new incr file meanwhile, so the new base and the files
+// after it have every write. The older files are deleted when the base is
+// ready.
+func (aof *AppendOnlyFile) Rewrite() error {
+	// the snapshot and the switch of incr files are atomic for writes
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if aof.rewriteInProgress {
+		return errAOFRewriteInProgress
+	}
+	aof.lastRewriteTry = time.Now()
+	// the incr file of a failed rewrite can follow the new base while
+	// nothing was written to it, failing rewrites don't pile up incr files
+	if aof.lastRewriteOK || aof.size > 0 {
+		if err := aof.openNewIncr(); err != nil {
+			aof.lastRewriteOK = false
+			return err
+		}
+	}
+	data := aof.values.Snapshot()
+	aof.rewriteInProgress = true
+	aof.rewriteStart = aof.lastRewriteTry
+	incr := aof.manifest.Incrs[len(aof.manifest.Incrs)-1]
+	go aof.finishRewrite(data, incr)
+	return nil
+}
+
+// finishRewrite writes the base and makes it and incr the only files of the
+// manifest.
+func (aof *AppendOnlyFile) finishRewrite(data map[string]ValueWithExpiration, incr appendonly.FileInfo) {
+	tempPath, err := aof.writeBase(data)
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	aof.rewriteInProgress = false
+	aof.lastRewriteDuration = time.Since(aof.rewriteStart)
+	aof.lastRewriteOK = false
+	if err != nil {
+		slog.Warn("Background AOF rewrite failed", "err", err)
+		return
+	}
+	seq := aof.manifest.BaseSeq + 1
+	base := appendonly.FileInfo{Name: aof.paths.BaseName(seq, aof.rdbPreamble), Seq: seq, Type: appendonly.TypeBase}
+	if err := os.Rename(tempPath, aof.paths.File(base.Name)); err != nil {
+		os.Remove(tempPath)
+		slog.Warn("Background AOF rewrite failed", "err", err)
+		return
+	}
+	old := aof.manifest.Files()
+	manifest := *aof.manifest
+	manifest.Base = &base
+	manifest.BaseSeq = seq
+	manifest.Incrs = []appendonly.FileInfo{incr}
+	if err := appendonly.WriteManifest(aof.paths, &manifest); err != nil {
+		os.Remove(aof.paths.File(base.Name))
+		slog.Warn("Background AOF rewrite failed", "err", err)
+		return
+	}
+	aof.manifest = &manifest
+	for _, info := range old {
+		if info.Name != incr.Name {
+			os.Remove(aof.paths.File(info.Name))
+		}
+	}
+	aof.currentSize = aof.size
+	if stat, err := os.Stat(aof.paths.File(base.Name)); err == nil {
+		aof.currentSize += stat.Size()
+	}
+	aof.baseSize = aof.currentSize
+	aof.lastRewriteOK = true
+	slog.Info("Background AOF rewrite finished successfully", "base", base.Name)
+}
+
+// writeBase writes the snapshot to a temporary file, as RDB with the RDB
+// preamble and as commands otherwise.
+func (aof *AppendOnlyFile) writeBase(data map[string]ValueWithExpiration) (string, error) {
+	file, err := os.CreateTemp(aof.paths.Dir, fmt.Sprintf("temp-rewriteaof-bg-%d-*.aof", os.Getpid()))
+	if err != nil {
+		return "", fmt.Errorf("creating temp AOF file: %w", err)
+	}
+	defer file.Close()
+	if aof.rdbPreamble {
+		err = rdb.Write(file, data, rdbAuxFields(true)...)
+	} else {
+		err = writeAOFCommands(file, data)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// writeAOFCommands writes the commands which recreate the dataset, only
+// strings have commands to create them.
+func writeAOFCommands(w io.Writer, data map[string]ValueWithExpiration) error {
+	bw := bufio.NewWriter(w)
+	for key, value := range data {
+		if value.Object != nil {
+			return fmt.Errorf("can't rewrite %s %q as commands, use aof-use-rdb-preamble", value.Object.Type, key)
+		}
+		args := []string{key, value.Value}
+		if !value.Expire.IsZero() {
+			args = append(args, "PXAT", strconv.FormatInt(value.Expire.UnixMilli(), 10))
+		}
+		if _, err := bw.WriteString(respCommand("SET", args...)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// RewriteNeeded tells if the AOF grew by percentage since the last rewrite
+// and is at least minSize, zero percentage disables automatic rewrites. A
+// failed rewrite is retried only after a delay.
+func (aof *AppendOnlyFile) RewriteNeeded(percentage int, minSize int64, now time.Time) bool {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if percentage <= 0 || aof.rewriteInProgress || aof.currentSize < minSize {
+		return false
+	}
+	if !aof.lastRewriteOK && now.Sub(aof.lastRewriteTry) < aofRewriteRetryDelay {
+		return false
+	}
+	base := max(aof.baseSize, 1)
+	return (aof.currentSize-base)*100/base >= int64(percentage)
+}
+
+// aofArgs makes relative expirations absolute, a replayed command must not
+// extend the TTL of a key.
+func aofArgs(args []string) []string {
+	if len(args) == 4 && strings.EqualFold(args[2], "px") {
+		if ms, err := strconv.ParseInt(args[3], 10, 64); err == nil {
+			expire := time.Now().Add(time.Duration(ms) * time.Millisecond).UnixMilli()
+			return []string{args[0], args[1], "PXAT", strconv.FormatInt(expire, 10)}
+		}
+	}
+	return args
+}
+
+func (aof *AppendOnlyFile) fsyncLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-aof.closed:
+			return
+		}
+		aof.mu.Lock()
+		if aof.unsynced {
+			if err := aof.file.Sync(); err != nil {
+				slog.Warn("Error syncing the AOF file", "err", err)
+			}
+			aof.unsynced = false
+		}
+		aof.mu.Unlock()
+	}
+}
+
+// Close syncs and closes the file.
+func (aof *AppendOnlyFile) Close() error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	close(aof.closed)
+	if err := aof.file.Sync(); err != nil {
+		aof.file.Close()
+		return err
+	}
+	return aof.file.Close()
+}
+
+// infoFields returns the AOF fields of INFO persistence, the sizes only
+// when the AOF is on.
+func (aof *AppendOnlyFile) infoFields() string {
+	if aof == nil {
+		return `aof_rewrite_in_progress:0
+aof_last_rewrite_time_sec:-1
+aof_current_rewrite_time_sec:-1
+aof_last_bgrewrite_status:ok
+aof_last_write_status:ok
+`
+	}
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	inProgress, current := 0, int64(-1)
+	if aof.rewriteInProgress {
+		inProgress, current = 1, int64(time.Since(aof.rewriteStart).Seconds())
+	}
+	lastDuration := int64(-1)
+	if aof.lastRewriteDuration >= 0 {
+		lastDuration = int64(aof.lastRewriteDuration.Seconds())
+	}
+	status := func(ok bool) string {
+		if ok {
+			return "ok"
+		}
+		return "err"
+	}
+	return fmt.Sprintf(`aof_rewrite_in_progress:%d
+aof_last_rewrite_time_sec:%d
+aof_current_rewrite_time_sec:%d
+aof_last_bgrewrite_status:%s
+aof_last_write_status:%s
+aof_current_size:%d
+aof_base_size:%d
+`, inProgress,
+		lastDuration,
+		current,
+		status(aof.lastRewriteOK),
+		status(aof.lastWriteErr == nil),
+		aof.currentSize,
+		aof.baseSize,
+	)
+}
+
+// loadAppendOnlyFiles replays the files listed by the manifest, or the
+// single file AOF of older versions when there is no manifest.
+func loadAppendOnlyFiles(paths appendonly.Paths, commands map[string]CommandEntry, values *Keyspace, truncatedOK bool) error {
+	start := time.Now()
+	var files []string
+	manifest, err := appendonly.ReadManifest(paths.Manifest())
+	switch {
+	case err == nil:
+		for _, info := range manifest.Files() {
+			files = append(files, paths.File(info.Name))
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	default:
+		if _, err := os.Stat(paths.Legacy); err == nil {
+			files = append(files, paths.Legacy)
+		}
+	}
+	if len(files) == 0 {
+		slog.Info("No AOF file, starting empty", "dir", paths.Dir)
+		return nil
+	}
+	loaded := 0
+	for i, path := range files {
+		// only the last file can be cut by a crash
+		n, err := loadAOFFile(path, commands, values, truncatedOK && i == len(files)-1)
+		if err != nil {
+			return err
+		}
+		loaded += n
+	}
+	slog.Info("DB loaded from append only file", "files", len(files), "commands", loaded, "seconds", time.Since(start).Seconds())
+	return nil
+}
+
+// loadAOFFile replays the commands of an AOF file, which can start with an
+// RDB snapshot. A command cut at the end of the file is dropped, and the file
+// truncated, when truncatedOK is set, it's an error otherwise.
+func loadAOFFile(path string, commands map[string]CommandEntry, values *Keyspace, truncatedOK bool) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := appendonly.NewReader(file)
+	if reader.HasPreamble() {
+		data, err := rdb.Read(reader)
+		if err != nil {
+			return 0, fmt.Errorf("loading RDB preamble of %s: %w", path, err)
+		}
+		values.Replace(data)
+	}
+	fake := NewFakeRedisConnect()
+	loaded := 0
+	for {
+		parsedCmd, err := reader.ReadCommand()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, appendonly.ErrTruncated) {
+			if !truncatedOK {
+				return 0, fmt.Errorf("unexpected end of file reading the append only file %s, use aof-load-truncated", path)
+			}
+			slog.Warn("AOF loaded anyway because aof-load-truncated is enabled, truncating the last command", "path", path, "offset", reader.Offset())
+			if err := os.Truncate(path, reader.Offset()); err != nil {
+				return 0, fmt.Errorf("truncating AOF: %w", err)
+			}
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("reading the append only file %s: %w", path, err)
+		}
+		entry, ok := commands[strings.ToLower(parsedCmd[0])]
+		if !ok {
+			return 0, fmt.Errorf("unknown command '%s' reading the append only file %s at offset %d", parsedCmd[0], path, reader.Offset())
+		}
+		// as for the stream of a master, errors of commands are ignored
+		entry.Call(fake, MasterToReplica, parsedCmd[1:]...)
+		loaded++
+	}
+	return loaded, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/appendonly"
+)
+
+func TestLoadTruncatedAppendOnlyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	complete := respCommand("SET", "a", "1") + respCommand("SET", "b", "2", "PXAT", "32503680000000")
+	if err := os.WriteFile(path, []byte(complete+"*3\r\n$3\r\nSET\r\n$1\r\nc"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ks := NewKeyspace()
+	commands := map[string]CommandEntry{"set": {CommandSet{values: ks}, FlagWrite}}
+	if _, err := loadAOFFile(path, commands, ks, false); err == nil {
+		t.Errorf("expected error for truncated AOF without aof-load-truncated")
+	}
+
+	ks.Replace(map[string]ValueWithExpiration{})
+	if _, err := loadAOFFile(path, commands, ks, true); err != nil {
+		t.Fatal(err)
+	}
+	if keys := ks.Keys("*"); len(keys) != 2 {
+		t.Errorf("expected keys a and b, but got %v", keys)
+	}
+	if data, _ := os.ReadFile(path); string(data) != complete {
+		t.Errorf("expected the AOF truncated to %q, but got %q", complete, data)
+	}
+}
+
+func TestLoadAOFWithRDBPreamble(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof.1.base.rdb")
+	var buf bytes.Buffer
+	if err := writeRDB(&buf, map[string]ValueWithExpiration{"a": {Value: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString(respCommand("SET", "b", "2"))
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ks := NewKeyspace()
+	commands := map[string]CommandEntry{"set": {CommandSet{values: ks}, FlagWrite}}
+	if n, err := loadAOFFile(path, commands, ks, false); err != nil || n != 1 {
+		t.Fatalf("expected 1 command after the preamble, but got %d, %v", n, err)
+	}
+	if keys := ks.Keys("*"); len(keys) != 2 {
+		t.Errorf("expected keys a and b, but got %v", keys)
+	}
+}
+
+// waitForRewrite returns when the rewrite in progress is done.
+func waitForRewrite(aof *AppendOnlyFile) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		aof.mu.Lock()
+		done := !aof.rewriteInProgress
+		aof.mu.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRewriteAppendOnlyFile(t *testing.T) {
+	for _, rdbPreamble := range []bool{false, true} {
+		paths := appendonly.NewPaths(t.TempDir(), "appendonlydir", "appendonly.aof")
+		ks := NewKeyspace()
+		aof, err := OpenAppendOnlyFile(paths, aofFsyncNo, rdbPreamble, ks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer aof.Close()
+		set := func(key, value string) {
+			ks.Store(key, ValueWithExpiration{Value: value})
+			aof.Feed([]string{"SET", key, value})
+		}
+
+		set("a", "1")
+		// the second rewrite replaces the base of the first one
+		for seq := 1; seq <= 2; seq++ {
+			set("b", strconv.Itoa(seq))
+			if err := aof.Rewrite(); err != nil {
+				t.Fatal(err)
+			}
+			// writes during the rewrite go to the new incr file
+			set("c", strconv.Itoa(seq))
+			waitForRewrite(aof)
+
+			manifest, err := appendonly.ReadManifest(paths.Manifest())
+			if err != nil {
+				t.Fatal(err)
+			}
+			base := paths.BaseName(seq, rdbPreamble)
+			incr := paths.IncrName(seq + 1)
+			if manifest.Base == nil || manifest.Base.Name != base || len(manifest.Incrs) != 1 || manifest.Incrs[0].Name != incr {
+				t.Fatalf("expected base %s and incr %s, but got %s", base, incr, manifest)
+			}
+			entries, err := os.ReadDir(paths.Dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			expected := []string{base, incr, filepath.Base(paths.Manifest())}
+			slices.Sort(expected)
+			if !slices.Equal(names, expected) {
+				t.Errorf("expected only %v left, but got %v", expected, names)
+			}
+		}
+
+		loaded := NewKeyspace()
+		commands := map[string]CommandEntry{"set": {CommandSet{values: loaded}, FlagWrite}}
+		if err := loadAppendOnlyFiles(paths, commands, loaded, false); err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{"a": "1", "b": "2", "c": "2"}
+		for key, value := range expected {
+			if got, ok := loaded.Load(key); !ok || got.Value != value {
+				t.Errorf("expected %s=%s reloaded with preamble %v, but got %v", key, value, rdbPreamble, got)
+			}
+		}
+		if keys := loaded.Keys("*"); len(keys) != len(expected) {
+			t.Errorf("expected %v reloaded, but got %v", expected, keys)
+		}
+	}
+}
+
+func TestFailedRewriteRetry(t *testing.T) {
+	paths := appendonly.NewPaths(t.TempDir(), "appendonlydir", "appendonly.aof")
+	ks := NewKeyspace()
+	aof, err := OpenAppendOnlyFile(paths, aofFsyncNo, false, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+	ks.Store("a", ValueWithExpiration{Value: "1"})
+	aof.Feed([]string{"SET", "a", "1"})
+
+	// the base can't be renamed over a directory
+	blocked := paths.File(paths.BaseName(1, false))
+	if err := os.MkdirAll(filepath.Join(blocked, "inside"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := aof.Rewrite(); err != nil {
+			t.Fatal(err)
+		}
+		waitForRewrite(aof)
+	}
+	manifest, err := appendonly.ReadManifest(paths.Manifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Base != nil || len(manifest.Incrs) != 2 {
+		t.Errorf("expected one incr file added by the failed rewrites, but got %s", manifest)
+	}
+	now := time.Now()
+	if aof.RewriteNeeded(1, 0, now) {
+		t.Errorf("expected no automatic rewrite right after a failed one")
+	}
+	if !aof.RewriteNeeded(1, 0, now.Add(2*aofRewriteRetryDelay)) {
+		t.Errorf("expected an automatic rewrite after the retry delay")
+	}
+
+	if err := os.RemoveAll(blocked); err != nil {
+		t.Fatal(err)
+	}
+	if err := aof.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	waitForRewrite(aof)
+	manifest, err = appendonly.ReadManifest(paths.Manifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	incr := paths.IncrName(2)
+	if manifest.Base == nil || len(manifest.Incrs) != 1 || manifest.Incrs[0].Name != incr {
+		t.Errorf("expected the base and %s after the retry, but got %s", incr, manifest)
+	}
+}
@@ -1,31 +1,250 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// ReplicationState is the state of the link with the master.
+type ReplicationState int
+
+const (
+	// ReplStateConnect waits to connect to the master
+	ReplStateConnect ReplicationState = iota
+	// ReplStateConnecting is connecting and doing the handshake
+	ReplStateConnecting
+	// ReplStateTransfer receives the snapshot
+	ReplStateTransfer
+	// ReplStateConnected applies the stream
+	ReplStateConnected
+)
+
+func (state ReplicationState) String() string {
+	return [...]string{"connect", "connecting", "sync", "connected"}[state]
+}
+
+const (
+	replicationRetryMin = 100 * time.Millisecond
+	replicationRetryMax = 10 * time.Second
+	replicationDialTime = 5 * time.Second
+	// replicationAckPeriod is how often the replica reports its offset, the
+	// master measures the lag of replicas by these ACKs
+	replicationAckPeriod = time.Second
+)
+
+// RedisClient keeps a connection to another server: the link of a replica
+// with its master, or a link of a sentinel.
 type RedisClient struct {
-	conn *RedisConnect
+	address string
+	myPort  int
+	// replicas get the stream of the master as is, the dataset and the
+	// backlog are reset on full resync
+	replicas *ReplicasManager
+	// sentinel is set for the links of a sentinel, they send commands and
+	// pass the replies to callbacks instead of replicating
+	sentinel *sentinelLink
+
+	// mu guards the fields below, they are read by INFO
+	mu    sync.Mutex
+	conn  *RedisConnect
+	state ReplicationState
+	// masterReplId and offset are kept between connections to continue
+	// the stream with PSYNC
+	masterReplId  string
+	offset        int
+	linkDownSince time.Time
+	stopped       bool
+	// failover gets the result of the first PSYNC, which asks the master to
+	// become our replica
+	failover chan error
+
+	// stop is closed by Stop, done is closed when Run returns
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewRedisClient(address string, myPort int, replicas *ReplicasManager) *RedisClient {
+	return &RedisClient{
+		address:       address,
+		myPort:        myPort,
+		replicas:      replicas,
+		state:         ReplStateConnect,
+		linkDownSince: time.Now(),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// SetCachedMaster sets the stream to continue on the first connection, a
+// master becoming a replica offers its own history.
+func (client *RedisClient) SetCachedMaster(replId string, offset int) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.masterReplId, client.offset = replId, offset
+}
+
+// Stop disconnects from the master and waits for Run to return.
+func (client *RedisClient) Stop() {
+	client.mu.Lock()
+	client.stopped = true
+	close(client.stop)
+	conn := client.conn
+	client.mu.Unlock()
+	if conn != nil {
+		conn.Kill()
+	}
+	<-client.done
+}
+
+// Run keeps the replica attached to the master: it connects, syncs and
+// applies the stream, and starts over with growing delays when any step
+// fails or the connection is lost. Links of sentinels read replies instead,
+// commands is nil for them.
+func (client *RedisClient) Run(commands map[string]CommandEntry) {
+	defer close(client.done)
+	logger := slog.Default().With("worker", "replica-listener")
+	retryMax := replicationRetryMax
+	if client.sentinel != nil {
+		logger = slog.Default().With("worker", "sentinel-link")
+		retryMax = sentinelLinkRetryMax
+	}
+	retry := replicationRetryMin
+	for {
+		err := client.connect()
+		client.reportFailover(err)
+		if err != nil {
+			if client.sentinel == nil {
+				logger.Warn("replication with master failed", "address", client.address, "err", err, "retry", retry)
+			} else {
+				// instances being down is what sentinels are for
+				logger.Debug("sentinel link failed", "address", client.address, "err", err, "retry", retry)
+			}
+			select {
+			case <-client.stop:
+				return
+			case <-time.After(retry):
+			}
+			retry = min(retry*2, retryMax)
+			continue
+		}
+		retry = replicationRetryMin
+		logger.Info("connected to redis server", "address", client.address)
+
+		if client.sentinel != nil {
+			client.readReplies(client.conn)
+		} else {
+			stopAcks := make(chan struct{})
+			go client.sendAcks(client.conn, stopAcks)
+			readFromConnection(logger, commands, client.conn, MasterToReplica)
+			close(stopAcks)
+		}
+		client.disconnect()
+		select {
+		case <-client.stop:
+			logger.Info("disconnected", "address", client.address)
+			return
+		default:
+		}
+		logger.Warn("connection lost", "address", client.address)
+	}
+}
+
+// sendAcks sends REPLCONF ACK with the processed offset to the master
+// until stop is closed.
+func (client *RedisClient) sendAcks(conn *RedisConnect, stop chan struct{}) {
+	ticker := time.NewTicker(replicationAckPeriod)
+	defer ticker.Stop()
+	for {
+		conn.infoMu.Lock()
+		offset := conn.PrevReadBytes
+		conn.infoMu.Unlock()
+		if err := conn.Send(respCommand("REPLCONF", "ACK", strconv.Itoa(offset))); err != nil {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reportFailover sends the result of PSYNC FAILOVER once.
+func (client *RedisClient) reportFailover(err error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.failover != nil {
+		client.failover <- err
+		client.failover = nil
+	}
+}
+
+func (client *RedisClient) setState(state ReplicationState) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.state = state
 }
 
-func NewRedisClient(address string, myPort int) (*RedisClient, error) {
-	conn, err := net.Dial("tcp", address)
+func (client *RedisClient) connect() error {
+	client.setState(ReplStateConnecting)
+	dialTime := replicationDialTime
+	if client.sentinel != nil {
+		dialTime = sentinelDialTime
+	}
+	conn, err := net.DialTimeout("tcp", client.address, dialTime)
 	if err != nil {
-		return nil, fmt.Errorf("new redis client connect to %s: %w", address, err)
+		client.setState(ReplStateConnect)
+		return fmt.Errorf("new redis client connect to %s: %w", client.address, err)
+	}
+	var redisConn *RedisConnect
+	if client.sentinel != nil {
+		redisConn = NewLinkRedisConnect(conn)
+	} else {
+		redisConn = NewMasterRedisConnect(conn, func(data []byte) { client.replicas.feed(data) })
+	}
+	client.mu.Lock()
+	client.conn = redisConn
+	stopped := client.stopped
+	client.mu.Unlock()
+	if stopped {
+		client.disconnect()
+		return fmt.Errorf("replication to %s is stopped", client.address)
+	}
+
+	if client.sentinel != nil {
+		// the replies of the setup commands are read once connected
+		client.sentinel.setup(client)
+	} else if err = client.doHandShake(); err != nil {
+		client.disconnect()
+		return fmt.Errorf("redis handshake to %s failed: %w", client.address, err)
+	}
+	client.setState(ReplStateConnected)
+	return nil
+}
+
+// disconnect closes the connection and remembers the processed offset.
+func (client *RedisClient) disconnect() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.state == ReplStateConnected {
+		client.offset = client.conn.PrevReadBytes
 	}
-	client := RedisClient{conn: NewRedisConnect(conn)}
-	if err = client.doHandShake(myPort); err != nil {
-		// error handling?
-		conn.Close()
-		return nil, fmt.Errorf("redis handshake to %s failed: %w", address, err)
+	if client.sentinel != nil {
+		// the commands sent on the connection won't get replies
+		client.sentinel.pending = nil
 	}
-	return &client, nil
+	client.conn.Close()
+	client.state = ReplStateConnect
+	client.linkDownSince = time.Now()
 }
 
-func (client *RedisClient) doHandShake(myPort int) error {
+func (client *RedisClient) doHandShake() error {
 	err := client.conn.SendCommand("PING")
 	if err != nil {
 		return fmt.Errorf("ping command failed: %w", err)
@@ -36,7 +255,7 @@ func (client *RedisClient) doHandShake(myPort int) error {
 		return fmt.Errorf("ping command result=%s, err: %w", result, err)
 	}
 
-	err = client.conn.SendCommand("REPLCONF", "listening-port", strconv.Itoa(myPort))
+	err = client.conn.SendCommand("REPLCONF", "listening-port", strconv.Itoa(client.myPort))
 	if err != nil {
 		return fmt.Errorf("replconf listening-port command failed: %w", err)
 	}
@@ -45,7 +264,7 @@ func (client *RedisClient) doHandShake(myPort int) error {
 		return fmt.Errorf("replconf listening-port command result=%s, err: %w", result, err)
 	}
 
-	err = client.conn.SendCommand("REPLCONF", "capa", "psync2")
+	err = client.conn.SendCommand("REPLCONF", "capa", "eof", "capa", "psync2")
 	if err != nil {
 		return fmt.Errorf("replconf capa command failed: %w", err)
 	}
@@ -54,25 +273,130 @@ func (client *RedisClient) doHandShake(myPort int) error {
 		return fmt.Errorf("replconf capa command result=%s, err: %w", result, err)
 	}
 
-	err = client.conn.SendCommand("PSYNC", "?", "-1")
-	_, err = client.conn.ReadLine()
-	// TODO: not ignore psync answer
+	return client.psync()
+}
+
+// psync continues the stream from the cached offset when possible and loads
+// the snapshot otherwise.
+func (client *RedisClient) psync() error {
+	client.mu.Lock()
+	replId, offset, failover := client.masterReplId, client.offset, client.failover != nil
+	client.mu.Unlock()
+
+	args := []string{"?", "-1"}
+	if replId != "" {
+		args = []string{replId, strconv.Itoa(offset + 1)}
+	}
+	if failover {
+		args = append(args, "FAILOVER")
+	}
+	err := client.conn.SendCommand("PSYNC", args...)
 	if err != nil {
 		return fmt.Errorf("psync command failed: %w", err)
 	}
-	slog.Debug("PSYNC", "result", result)
-	err = client.conn.ReadRDBSnapshot()
+	result, err := client.conn.ReadLine()
 	if err != nil {
-		return fmt.Errorf("reading rdb snapshot failed: %w", err)
+		return fmt.Errorf("psync command failed: %w", err)
+	}
+	slog.Debug("PSYNC", "result", result)
+
+	fields := strings.Fields(result)
+	switch {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		replId = fields[1]
+		offset, err = strconv.Atoi(fields[2])
+		if err != nil {
+			return fmt.Errorf("psync command result=%s, err: %w", result, err)
+		}
+		client.setState(ReplStateTransfer)
+		data, err := client.conn.ReadRDBSnapshot()
+		if err != nil {
+			return fmt.Errorf("reading rdb snapshot failed: %w", err)
+		}
+		// the stream is applied after the snapshot is loaded, because it's
+		// read only when the handshake is done
+		client.replicas.Reset(int64(offset), data)
+		// the AOF starts over from the new dataset
+		if err := persistence.RewriteAOF(); err != nil && !errors.Is(err, errAOFDisabled) {
+			slog.Warn("Failed to rewrite AOF after full resynchronization", "err", err)
+		}
+		slog.Info("full resynchronization with master", "replid", replId, "offset", offset, "keys", len(data))
+	case len(fields) >= 1 && fields[0] == "+CONTINUE":
+		// the master sends its new replid after a failover, sub-replicas
+		// reconnect to learn it
+		if len(fields) == 2 && fields[1] != replId {
+			replId = fields[1]
+			client.replicas.DropReplicas()
+		}
+		slog.Info("partial resynchronization with master", "replid", replId, "offset", offset)
+	default:
+		return fmt.Errorf("psync command result=%s", result)
 	}
-	client.conn.ReadBytes = 0
 
+	// from now on read bytes are the replication offset acknowledged to
+	// the master
+	client.conn.ReadBytes = offset
+	client.conn.RememberPreviousBytes()
+	client.mu.Lock()
+	client.masterReplId, client.offset = replId, offset
+	client.mu.Unlock()
+	redisInfo.SetMasterReplId(replId)
 	return nil
 }
 
-func (client *RedisClient) Listen(commands map[string]Command) {
-	logger := slog.Default().With("worker", "replica-listener")
-	for {
-		readFromConnection(logger, commands, client.conn, MasterToReplica)
+// IsLinkUp reports if the replica is in sync and gets the stream.
+func (client *RedisClient) IsLinkUp() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.state == ReplStateConnected
+}
+
+// Offset returns the offset of the stream processed by the replica.
+func (client *RedisClient) Offset() int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.state != ReplStateConnected {
+		return client.offset
+	}
+	client.conn.infoMu.Lock()
+	defer client.conn.infoMu.Unlock()
+	return client.conn.PrevReadBytes
+}
+
+// infoFields returns the replica part of INFO replication.
+func (client *RedisClient) infoFields() string {
+	host, port, _ := net.SplitHostPort(client.address)
+	offset := client.Offset()
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	linkStatus, lastIO, syncInProgress := "down", -1, 0
+	if client.state == ReplStateConnected {
+		linkStatus = "up"
+	}
+	if client.state == ReplStateConnected || client.state == ReplStateTransfer {
+		client.conn.infoMu.Lock()
+		lastIO = int(time.Since(client.conn.lastInteraction).Seconds())
+		client.conn.infoMu.Unlock()
+	}
+	if client.state == ReplStateTransfer {
+		syncInProgress = 1
+	}
+	readOnly := 0
+	if replicaReadOnly.Get() {
+		readOnly = 1
+	}
+	res := fmt.Sprintf(
+		`master_host:%s
+master_port:%s
+master_link_status:%s
+master_last_io_seconds_ago:%d
+master_sync_in_progress:%d
+slave_repl_offset:%d
+slave_read_only:%d
+`, host, port, linkStatus, lastIO, syncInProgress, offset, readOnly)
+	if client.state != ReplStateConnected {
+		res += fmt.Sprintf("master_link_down_since_seconds:%d\n", int(time.Since(client.linkDownSince).Seconds()))
 	}
+	return res
 }
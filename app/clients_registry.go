@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientsRegistry keeps all live connections for the CLIENT command.
+type ClientsRegistry struct {
+	mu      sync.RWMutex
+	clients map[int64]*RedisConnect
+	pause   clientsPause
+}
+
+func NewClientsRegistry() *ClientsRegistry {
+	return &ClientsRegistry{
+		clients: make(map[int64]*RedisConnect),
+	}
+}
+
+func (cr *ClientsRegistry) Register(conn *RedisConnect) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.clients[conn.ID] = conn
+}
+
+func (cr *ClientsRegistry) Unregister(conn *RedisConnect) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	delete(cr.clients, conn.ID)
+}
+
+// List returns the registered connections ordered by id.
+func (cr *ClientsRegistry) List() []*RedisConnect {
+	cr.mu.RLock()
+	res := make([]*RedisConnect, 0, len(cr.clients))
+	for _, conn := range cr.clients {
+		res = append(res, conn)
+	}
+	cr.mu.RUnlock()
+	slices.SortFunc(res, func(a, b *RedisConnect) int {
+		return int(a.ID - b.ID)
+	})
+	return res
+}
+
+// Pause suspends commands of normal clients, or only their writes, until the
+// timeout passes or Unpause is called. Overlapping pauses keep the latest end
+// and the strictest mode.
+func (cr *ClientsRegistry) Pause(timeout time.Duration, all bool) {
+	cr.pause.mu.Lock()
+	defer cr.pause.mu.Unlock()
+	now := time.Now()
+	end := now.Add(timeout)
+	if now.After(cr.pause.end) {
+		cr.pause.all = all
+	} else {
+		cr.pause.all = cr.pause.all || all
+	}
+	if end.After(cr.pause.end) {
+		cr.pause.end = end
+	}
+	if cr.pause.unpaused == nil {
+		cr.pause.unpaused = make(chan struct{})
+	}
+}
+
+func (cr *ClientsRegistry) Unpause() {
+	cr.pause.mu.Lock()
+	defer cr.pause.mu.Unlock()
+	cr.pause.end = time.Time{}
+	if cr.pause.unpaused != nil {
+		close(cr.pause.unpaused)
+		cr.pause.unpaused = nil
+	}
+}
+
+// WaitUnpaused blocks while a command of the given kind is paused.
+func (cr *ClientsRegistry) WaitUnpaused(isWrite bool) {
+	for {
+		cr.pause.mu.Lock()
+		remaining := time.Until(cr.pause.end)
+		if remaining <= 0 || (!cr.pause.all && !isWrite) {
+			cr.pause.mu.Unlock()
+			return
+		}
+		unpaused := cr.pause.unpaused
+		cr.pause.mu.Unlock()
+
+		timer := time.NewTimer(remaining)
+		select {
+		case <-unpaused:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// WritesPaused tells if writes are paused now.
+func (cr *ClientsRegistry) WritesPaused() bool {
+	cr.pause.mu.Lock()
+	defer cr.pause.mu.Unlock()
+	return time.Now().Before(cr.pause.end)
+}
+
+type clientsPause struct {
+	mu  sync.Mutex
+	end time.Time
+	// all pauses every command instead of only writes
+	all bool
+	// unpaused is closed by CLIENT UNPAUSE to wake up paused clients
+	unpaused chan struct{}
+}
+
+// clientTypeFlags lists the values of CLIENT LIST TYPE and CLIENT KILL TYPE.
+var clientTypeFlags = map[string]func(*RedisConnect) bool{
+	"normal": func(conn *RedisConnect) bool {
+		return !conn.IsMaster && conn.Class() == ClientClassNormal
+	},
+	"master": func(conn *RedisConnect) bool {
+		return conn.IsMaster
+	},
+	"replica": func(conn *RedisConnect) bool {
+		return conn.Class() == ClientClassReplica
+	},
+	"slave": func(conn *RedisConnect) bool {
+		return conn.Class() == ClientClassReplica
+	},
+	"pubsub": func(conn *RedisConnect) bool {
+		return conn.Class() == ClientClassPubSub
+	},
+}
+
+// Info returns the connection description used by CLIENT LIST and CLIENT INFO.
+func (rc *RedisConnect) Info() string {
+	rc.infoMu.Lock()
+	defer rc.infoMu.Unlock()
+
+	now := time.Now()
+	flags := ""
+	if rc.IsMaster {
+		flags += "M"
+	}
+	switch rc.Class() {
+	case ClientClassReplica:
+		flags += "S"
+	case ClientClassPubSub:
+		flags += "P"
+	}
+	if rc.isBlocked {
+		flags += "b"
+	}
+	if rc.noEvict {
+		flags += "e"
+	}
+	if rc.noTouch {
+		flags += "T"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	obuf := rc.OutputBufferSize()
+	return fmt.Sprintf(
+		"id=%d addr=%s laddr=%s fd=%d name=%s age=%d idle=%d flags=%s db=0 sub=%d psub=0 ssub=0 multi=-1 "+
+			"qbuf=%d qbuf-free=%d argv-mem=0 multi-mem=0 obl=0 oll=0 omem=%d tot-mem=%d events=r cmd=%s user=%s redir=-1 resp=%d",
+		rc.ID,
+		rc.Conn.RemoteAddr(),
+		rc.Conn.LocalAddr(),
+		rc.fd,
+		rc.Name,
+		int(now.Sub(rc.createdAt).Seconds()),
+		int(now.Sub(rc.lastInteraction).Seconds()),
+		flags,
+		rc.subscriptions.Load(),
+		rc.queryBufSize,
+		rc.reader.Size()-rc.queryBufSize,
+		obuf,
+		rc.reader.Size()+obuf,
+		rc.lastCmd,
+		rc.User,
+		rc.Protocol,
+	)
+}
+
+// commandFullName returns the name reported in "cmd=", including the
+// subcommand for container commands like "client|list".
+func commandFullName(parsedCmd []string) string {
+	name := strings.ToLower(parsedCmd[0])
+	if containerCommands[name] && len(parsedCmd) > 1 {
+		return name + "|" + strings.ToLower(parsedCmd[1])
+	}
+	return name
+}
+
+var containerCommands = map[string]bool{
+	"client": true,
+}
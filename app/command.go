@@ -1,11 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -23,6 +23,36 @@ type Command interface {
 	Call(*RedisConnect, CommandSourceType, ...string) error
 }
 
+// CommandFlags tell the dispatcher how to treat a command.
+type CommandFlags uint
+
+const (
+	// FlagWrite commands may change the dataset, they are propagated and
+	// delayed by CLIENT PAUSE WRITE
+	FlagWrite CommandFlags = 1 << iota
+	// FlagReadonly commands only read the dataset
+	FlagReadonly
+	// FlagAdmin commands manage the server
+	FlagAdmin
+	// FlagFast commands run in constant or log time
+	FlagFast
+	// FlagStale commands are allowed while a replica has no link with its
+	// master
+	FlagStale
+)
+
+// CommandEntry is a command in the command table.
+type CommandEntry struct {
+	Command
+	Flags CommandFlags
+}
+
+// sendError replies with the error and returns it for logging.
+func sendError(conn *RedisConnect, msg string) error {
+	conn.Send(respError(msg))
+	return errors.New(msg)
+}
+
 type CommandPing struct {
 }
 
@@ -30,6 +60,16 @@ func (cmdPing CommandPing) Call(conn *RedisConnect, commandSource CommandSourceT
 	if commandSource == MasterToReplica {
 		return nil
 	}
+	if len(args) > 1 {
+		return sendError(conn, "ERR wrong number of arguments for 'ping' command")
+	}
+	// subscribed RESP2 clients can't tell a reply from a message otherwise
+	if conn.Protocol != RESP3 && conn.subscriptions.Load() > 0 {
+		return conn.Send(respArray(respBulkString("pong"), respBulkString(append(args, "")[0])))
+	}
+	if len(args) == 1 {
+		return conn.Send(respBulkString(args[0]))
+	}
 	return conn.Send(respString("PONG"))
 }
 
@@ -49,66 +89,58 @@ type CommandInfo struct {
 }
 
 func (cmdInfo CommandInfo) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
-	if len(args) != 1 {
-		conn.Send(respError("ERR 'info' command accepts 1 param"))
-		return fmt.Errorf("ERR 'info' command accepts 1 param")
+	if len(args) == 0 {
+		return conn.Send(respVerbatim(conn.Protocol, "txt", cmdInfo.redisInfo.String()))
 	}
-	return conn.Send(respBulkString(cmdInfo.redisInfo.String()))
+	sections := make([]string, 0, len(args))
+	for _, arg := range args {
+		if section := cmdInfo.redisInfo.Section(arg); section != "" {
+			sections = append(sections, section)
+		}
+	}
+	return conn.Send(respVerbatim(conn.Protocol, "txt", strings.Join(sections, "\n")))
 }
 
 type CommandSet struct {
-	replicasManager *ReplicasManager
-	values          *sync.Map
+	values *Keyspace
 }
 
 func (cmdSet CommandSet) Call(conn *RedisConnect, commandSource CommandSourceType, args ...string) error {
-	if commandSource == UserToReplica {
-		conn.Send(respError("READONLY You can't write against a read only replica."))
-		return fmt.Errorf("READONLY You can't write against a read only replica.")
-	}
-	usageError := fmt.Errorf("ERR 'set' usage: set <key> <value> [PX <time_ms>]")
+	usage := "ERR 'set' usage: set <key> <value> [PX <time_ms>|PXAT <unix_time_ms>]"
 	if len(args) != 2 && len(args) != 4 {
-		conn.Send(respError("ERR 'set' usage: set <key> <value> [PX <time_ms>]"))
-		return usageError
+		return sendError(conn, usage)
 	}
 	if len(args) == 2 {
-		cmdSet.values.Store(args[0], args[1])
-		if cmdSet.replicasManager != nil {
-			go cmdSet.replicasManager.LogCommand("set", args...)
-		}
+		cmdSet.values.Store(args[0], ValueWithExpiration{Value: args[1]})
+		conn.dirty++
 		if commandSource != MasterToReplica {
 			return conn.Send(respString("OK"))
 		}
 		return nil
 	}
-	if strings.ToLower(args[2]) != "px" {
-		conn.Send(respError("ERR 'set' usage: set <key> <value> [PX <time_ms>]"))
-		return usageError
+	option := strings.ToLower(args[2])
+	ms, err := strconv.ParseInt(args[3], 10, 64)
+	if option != "px" && option != "pxat" || err != nil || ms < 0 {
+		return sendError(conn, usage)
 	}
-	ms, err := strconv.Atoi(args[3])
-	if err != nil || ms < 0 {
-		conn.Send(respError("ERR 'set' usage: set <key> <value> [PX <time_ms>]"))
-		return usageError
+	// PXAT is absolute, the AOF has it so replaying doesn't extend the TTL
+	expire := time.Now().Add(time.Duration(ms) * time.Millisecond)
+	if option == "pxat" {
+		expire = time.UnixMilli(ms)
 	}
-	cmdSet.values.Store(args[0], ValueWithExpiration{
-		Value:  args[1],
-		Expire: time.Now().Add(time.Duration(ms) * time.Millisecond),
-	})
-	if cmdSet.replicasManager != nil {
-		go cmdSet.replicasManager.LogCommand("set", args...)
-		if commandSource != MasterToReplica {
-			return conn.Send(respString("OK"))
-		}
-		return nil
+	cmdSet.values.Store(args[0], ValueWithExpiration{Value: args[1], Expire: expire})
+	conn.dirty++
+	if commandSource != MasterToReplica {
+		return conn.Send(respString("OK"))
 	}
-	return conn.Send(respString("OK"))
+	return nil
 }
 
 type CommandGet struct {
-	values *sync.Map
+	values *Keyspace
 }
 
-func (cmdGet CommandGet) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+func (cmdGet CommandGet) Call(conn *RedisConnect, commandSource CommandSourceType, args ...string) error {
 	usageError := fmt.Errorf("ERR 'get' command accepts 1 param")
 
 	if len(args) != 1 {
@@ -119,49 +151,144 @@ func (cmdGet CommandGet) Call(conn *RedisConnect, _ CommandSourceType, args ...s
 	key := args[0]
 	value, ok := cmdGet.values.Load(key)
 	if !ok {
-		return conn.Send(respBulkString())
+		return conn.Send(respNull(conn.Protocol))
+	}
+	if value.IsExpired(time.Now()) {
+		// replicas wait for the DEL of their master
+		if commandSource == UserToMaster {
+			expireKey(cmdGet.values, key, value)
+		}
+		return conn.Send(respNull(conn.Protocol))
+	}
+	if value.Object != nil {
+		return sendError(conn, wrongTypeError)
+	}
+	return conn.Send(respBulkString(value.Value))
+}
+
+type CommandDel struct {
+	values *Keyspace
+}
+
+func (cmdDel CommandDel) Call(conn *RedisConnect, commandSource CommandSourceType, args ...string) error {
+	if len(args) == 0 {
+		return sendError(conn, "ERR wrong number of arguments for 'del' command")
 	}
-	switch r := value.(type) {
-	case ValueWithExpiration:
-		if time.Now().Before(r.Expire) {
-			return conn.Send(respBulkString(r.Value))
+	count := 0
+	for _, key := range args {
+		// expired keys are gone already for the client, but removing them
+		// is a change all the same
+		deleted, expired := cmdDel.values.Delete(key)
+		if deleted {
+			conn.dirty++
 		}
-		cmdGet.values.CompareAndDelete(key, value)
-		return conn.Send(respBulkString())
-	case string:
-		return conn.Send(respBulkString(r))
-	default:
-		return fmt.Errorf("something strange saved in map key=%s", key)
+		if deleted && !expired {
+			count++
+		}
+	}
+	if commandSource == MasterToReplica {
+		return nil
+	}
+	return conn.Send(respInt(count))
+}
+
+const wrongTypeError = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+type CommandKeys struct {
+	values *Keyspace
+}
+
+func (cmdKeys CommandKeys) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+	if len(args) != 1 {
+		return sendError(conn, "ERR wrong number of arguments for 'keys' command")
+	}
+	keys := cmdKeys.values.Keys(args[0])
+	items := make([]string, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, respBulkString(key))
 	}
+	return conn.Send(respArray(items...))
+}
+
+type CommandType struct {
+	values *Keyspace
+}
+
+func (cmdType CommandType) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+	if len(args) != 1 {
+		return sendError(conn, "ERR wrong number of arguments for 'type' command")
+	}
+	value, ok := cmdType.values.Load(args[0])
+	switch {
+	case !ok || value.IsExpired(time.Now()):
+		return conn.Send(respString("none"))
+	case value.Object != nil:
+		return conn.Send(respString(value.Object.Type.String()))
+	}
+	return conn.Send(respString("string"))
 }
 
 type CommandReplConf struct{}
 
 func (cmdReplConf CommandReplConf) Call(conn *RedisConnect, commandSource CommandSourceType, args ...string) error {
 	slog.Debug("REPLCONF", "args", args, "commandSource", commandSource)
+	if len(args) == 0 || len(args)%2 != 0 {
+		return sendError(conn, "ERR syntax error")
+	}
 	if commandSource == MasterToReplica {
 		if strings.ToLower(args[0]) == "getack" {
 			return conn.Send(respCommand("REPLCONF", "ACK", strconv.Itoa(conn.PrevReadBytes)))
 		}
 	}
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToLower(args[i]) {
+		case "listening-port":
+			port, err := strconv.ParseUint(args[i+1], 10, 16)
+			if err != nil {
+				return sendError(conn, "ERR value is not an integer or out of range")
+			}
+			conn.infoMu.Lock()
+			conn.listeningPort = int(port)
+			conn.infoMu.Unlock()
+		case "capa":
+			// the replica can load a snapshot of unknown size
+			if strings.ToLower(args[i+1]) == "eof" {
+				conn.capaEOF = true
+			}
+		}
+	}
 	return conn.Send(respString("OK"))
 }
 
 type CommandPsync struct {
 	replicasManager *ReplicasManager
+	roles           *RoleManager
 }
 
 func (cmdPsync CommandPsync) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
-	err := conn.Send(respString(fmt.Sprintf("FULLRESYNC %s 0", redisInfo.GetMasterReplId())))
-	if err != nil {
-		return fmt.Errorf("can't return FULLRESYNC answer: %w", err)
+	if len(args) != 2 && len(args) != 3 {
+		return sendError(conn, "ERR wrong number of arguments for 'psync' command")
 	}
-	err = conn.Send(string(getRDBSnapshot()))
-	if err != nil {
-		return fmt.Errorf("can't send RDB snapshot: %w", err)
+	if len(args) == 3 {
+		if !strings.EqualFold(args[2], "failover") {
+			return sendError(conn, "ERR syntax error")
+		}
+		if err := cmdPsync.roles.PromoteForFailover(args[0]); err != nil {
+			return sendError(conn, err.Error())
+		}
 	}
-	cmdPsync.replicasManager.RegisterReplica(conn)
-	return nil
+	if master := redisInfo.GetMaster(); master != nil && !master.IsLinkUp() {
+		return sendError(conn, "NOMASTERLINK Can't SYNC while not connected with my master")
+	}
+	replId, replId2, secondOffset := redisInfo.GetReplIds()
+	offset, err := strconv.ParseInt(args[1], 10, 64)
+	if err == nil && (args[0] == replId || args[0] == replId2 && offset <= secondOffset) {
+		ok, err := cmdPsync.replicasManager.PartialResync(conn, replId, offset)
+		if ok || err != nil {
+			return err
+		}
+	}
+	return cmdPsync.replicasManager.FullResync(conn, replId)
 }
 
 type CommandWait struct {
@@ -169,5 +296,123 @@ type CommandWait struct {
 }
 
 func (cmdWait CommandWait) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
-	return conn.Send(respInt(cmdWait.replicasManager.GetReplicasCount()))
+	if len(args) != 2 {
+		return sendError(conn, "ERR wrong number of arguments for 'wait' command")
+	}
+	if redisInfo.GetRole() == "slave" {
+		return sendError(conn, "ERR WAIT cannot be used with replica instances.")
+	}
+	numReplicas, err := strconv.Atoi(args[0])
+	if err != nil {
+		return sendError(conn, "ERR value is not an integer or out of range")
+	}
+	timeout, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return sendError(conn, "ERR timeout is not an integer or out of range")
+	}
+	if timeout < 0 {
+		return sendError(conn, "ERR timeout is negative")
+	}
+
+	conn.infoMu.Lock()
+	conn.isBlocked = true
+	conn.infoMu.Unlock()
+	acked := cmdWait.replicasManager.WaitForAcks(
+		conn.writeOffset,
+		numReplicas,
+		time.Duration(timeout)*time.Millisecond,
+	)
+	conn.infoMu.Lock()
+	conn.isBlocked = false
+	conn.infoMu.Unlock()
+	return conn.Send(respInt(acked))
+}
+
+// checkUserPassword validates credentials. There is no ACL, so the only user
+// is "default" and it accepts any password, like Redis without requirepass.
+func checkUserPassword(username, password string) bool {
+	return username == "default"
+}
+
+// validClientName reports if name consists of printable characters without
+// spaces, as required for CLIENT SETNAME and HELLO SETNAME.
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+type CommandHello struct {
+	redisInfo *RedisInfo
+}
+
+func (cmdHello CommandHello) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+	protocol := conn.Protocol
+	if len(args) > 0 {
+		ver, err := strconv.Atoi(args[0])
+		if err != nil {
+			conn.Send(respError("ERR Protocol version is not an integer or out of range"))
+			return fmt.Errorf("ERR Protocol version is not an integer or out of range")
+		}
+		if ver != RESP2 && ver != RESP3 {
+			conn.Send(respError("NOPROTO unsupported protocol version"))
+			return fmt.Errorf("NOPROTO unsupported protocol version")
+		}
+		protocol = ver
+	}
+
+	var user, password, name string
+	setName := false
+	for i := 1; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i]); {
+		case opt == "auth" && i+2 < len(args):
+			user, password = args[i+1], args[i+2]
+			i += 2
+		case opt == "setname" && i+1 < len(args):
+			name, setName = args[i+1], true
+			i++
+		default:
+			errMsg := fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i])
+			conn.Send(respError(errMsg))
+			return errors.New(errMsg)
+		}
+	}
+
+	if user != "" && !checkUserPassword(user, password) {
+		conn.Send(respError("WRONGPASS invalid username-password pair or user is disabled."))
+		return fmt.Errorf("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	if setName && !validClientName(name) {
+		conn.Send(respError("ERR Client names cannot contain spaces, newlines or special characters."))
+		return fmt.Errorf("ERR Client names cannot contain spaces, newlines or special characters.")
+	}
+	conn.infoMu.Lock()
+	if user != "" {
+		conn.User = user
+	}
+	if setName {
+		conn.Name = name
+	}
+	conn.Protocol = protocol
+	conn.infoMu.Unlock()
+
+	role, mode := cmdHello.redisInfo.GetRole(), "standalone"
+	if role == "slave" {
+		role = "replica"
+	}
+	if sentinelMode.Get() {
+		mode = "sentinel"
+	}
+	return conn.Send(respMap(conn.Protocol,
+		respBulkString("server"), respBulkString("redis"),
+		respBulkString("version"), respBulkString(redisVersion),
+		respBulkString("proto"), respInt(conn.Protocol),
+		respBulkString("id"), respInt(int(conn.ID)),
+		respBulkString("mode"), respBulkString(mode),
+		respBulkString("role"), respBulkString(role),
+		respBulkString("modules"), respArray(),
+	))
 }
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CommandClient struct {
+	clients *ClientsRegistry
+}
+
+func (cmdClient CommandClient) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+	if len(args) == 0 {
+		return sendError(conn, "ERR wrong number of arguments for 'client' command")
+	}
+	sub := strings.ToLower(args[0])
+	wrongArgs := fmt.Sprintf("ERR wrong number of arguments for 'client|%s' command", sub)
+	switch sub {
+	case "id":
+		if len(args) != 1 {
+			return sendError(conn, wrongArgs)
+		}
+		return conn.Send(respInt(int(conn.ID)))
+	case "setname":
+		if len(args) != 2 {
+			return sendError(conn, wrongArgs)
+		}
+		if !validClientName(args[1]) {
+			return sendError(conn, "ERR Client names cannot contain spaces, newlines or special characters.")
+		}
+		conn.SetName(args[1])
+		return conn.Send(respString("OK"))
+	case "getname":
+		if len(args) != 1 {
+			return sendError(conn, wrongArgs)
+		}
+		if conn.Name == "" {
+			return conn.Send(respNull(conn.Protocol))
+		}
+		return conn.Send(respBulkString(conn.Name))
+	case "info":
+		if len(args) != 1 {
+			return sendError(conn, wrongArgs)
+		}
+		return conn.Send(respVerbatim(conn.Protocol, "txt", conn.Info()+"\n"))
+	case "list":
+		return cmdClient.list(conn, args[1:])
+	case "kill":
+		if len(args) < 2 {
+			return sendError(conn, wrongArgs)
+		}
+		return cmdClient.kill(conn, args[1:])
+	case "pause":
+		if len(args) != 2 && len(args) != 3 {
+			return sendError(conn, wrongArgs)
+		}
+		return cmdClient.pause(conn, args[1:])
+	case "unpause":
+		if len(args) != 1 {
+			return sendError(conn, wrongArgs)
+		}
+		cmdClient.clients.Unpause()
+		return conn.Send(respString("OK"))
+	case "no-evict", "no-touch":
+		if len(args) != 2 {
+			return sendError(conn, wrongArgs)
+		}
+		switch strings.ToLower(args[1]) {
+		case "on", "off":
+			on := strings.ToLower(args[1]) == "on"
+			conn.infoMu.Lock()
+			if sub == "no-evict" {
+				conn.noEvict = on
+			} else {
+				conn.noTouch = on
+			}
+			conn.infoMu.Unlock()
+			return conn.Send(respString("OK"))
+		}
+		return sendError(conn, "ERR syntax error")
+	case "reply":
+		if len(args) != 2 {
+			return sendError(conn, wrongArgs)
+		}
+		switch strings.ToLower(args[1]) {
+		case "on":
+			conn.setReplyMode(replyOn)
+			return conn.Send(respString("OK"))
+		case "off":
+			conn.setReplyMode(replyOff)
+			return nil
+		case "skip":
+			if conn.replyMode != replyOff {
+				conn.setReplyMode(replySkipNext)
+			}
+			return nil
+		}
+		return sendError(conn, "ERR syntax error")
+	case "help":
+		lines := []string{
+			"CLIENT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"GETNAME", "    Return the name of the current connection.",
+			"ID", "    Return the ID of the current connection.",
+			"INFO", "    Return information about the current client connection.",
+			"KILL <ip:port>", "    Kill connection made from <ip:port>.",
+			"KILL <option> <value> [<option> <value> [...]]",
+			"    Kill connections. Options are: ID, TYPE, USER, ADDR, LADDR, SKIPME, MAXAGE.",
+			"LIST [options ...]", "    Return information about client connections. Options: TYPE, ID.",
+			"NO-EVICT (ON|OFF)", "    Protect current client connection from eviction.",
+			"NO-TOUCH (ON|OFF)", "    Will not touch LRU/LFU stats when this mode is on.",
+			"PAUSE <timeout> [WRITE|ALL]", "    Suspend all, or just write, clients for <timeout> milliseconds.",
+			"REPLY (ON|OFF|SKIP)", "    Control the replies sent to the current connection.",
+			"SETNAME <name>", "    Assign the name <name> to the current connection.",
+			"UNPAUSE", "    Stop the current client pause, resuming traffic.",
+			"HELP", "    Print this help.",
+		}
+		replies := make([]string, 0, len(lines))
+		for _, line := range lines {
+			replies = append(replies, respString(line))
+		}
+		return conn.Send(respArray(replies...))
+	}
+	return sendError(conn, fmt.Sprintf("ERR unknown subcommand '%s'. Try CLIENT HELP.", args[0]))
+}
+
+func (cmdClient CommandClient) list(conn *RedisConnect, args []string) error {
+	filter := func(*RedisConnect) bool { return true }
+	switch {
+	case len(args) == 0:
+	case len(args) == 2 && strings.ToLower(args[0]) == "type":
+		isType, ok := clientTypeFlags[strings.ToLower(args[1])]
+		if !ok {
+			return sendError(conn, fmt.Sprintf("ERR Unknown client type '%s'", args[1]))
+		}
+		filter = isType
+	case len(args) >= 2 && strings.ToLower(args[0]) == "id":
+		ids := make(map[int64]bool, len(args)-1)
+		for _, arg := range args[1:] {
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil || id <= 0 {
+				return sendError(conn, "ERR Invalid client ID")
+			}
+			ids[id] = true
+		}
+		filter = func(client *RedisConnect) bool { return ids[client.ID] }
+	default:
+		return sendError(conn, "ERR syntax error")
+	}
+
+	res := strings.Builder{}
+	for _, client := range cmdClient.clients.List() {
+		if filter(client) {
+			res.WriteString(client.Info())
+			res.WriteString("\n")
+		}
+	}
+	return conn.Send(respVerbatim(conn.Protocol, "txt", res.String()))
+}
+
+func (cmdClient CommandClient) kill(conn *RedisConnect, args []string) error {
+	// old form: CLIENT KILL <ip:port>
+	if len(args) == 1 {
+		for _, client := range cmdClient.clients.List() {
+			if client.Conn.RemoteAddr().String() == args[0] {
+				cmdClient.killClient(conn, client)
+				return conn.Send(respString("OK"))
+			}
+		}
+		return sendError(conn, "ERR No such client")
+	}
+	if len(args)%2 != 0 {
+		return sendError(conn, "ERR syntax error")
+	}
+
+	skipMe := true
+	filters := make([]func(*RedisConnect) bool, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1]
+		switch strings.ToLower(args[i]) {
+		case "id":
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || id <= 0 {
+				return sendError(conn, "ERR client-id should be greater than 0")
+			}
+			filters = append(filters, func(client *RedisConnect) bool { return client.ID == id })
+		case "type":
+			isType, ok := clientTypeFlags[strings.ToLower(value)]
+			if !ok {
+				return sendError(conn, fmt.Sprintf("ERR Unknown client type '%s'", value))
+			}
+			filters = append(filters, isType)
+		case "user":
+			filters = append(filters, func(client *RedisConnect) bool {
+				client.infoMu.Lock()
+				defer client.infoMu.Unlock()
+				return client.User == value
+			})
+		case "addr":
+			filters = append(filters, func(client *RedisConnect) bool {
+				return client.Conn.RemoteAddr().String() == value
+			})
+		case "laddr":
+			filters = append(filters, func(client *RedisConnect) bool {
+				return client.Conn.LocalAddr().String() == value
+			})
+		case "skipme":
+			switch strings.ToLower(value) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				return sendError(conn, "ERR syntax error")
+			}
+		case "maxage":
+			maxAge, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return sendError(conn, "ERR syntax error")
+			}
+			filters = append(filters, func(client *RedisConnect) bool {
+				return time.Since(client.createdAt) >= time.Duration(maxAge)*time.Second
+			})
+		default:
+			return sendError(conn, "ERR syntax error")
+		}
+	}
+
+	killed := 0
+	for _, client := range cmdClient.clients.List() {
+		if skipMe && client == conn {
+			continue
+		}
+		matched := true
+		for _, filter := range filters {
+			if !filter(client) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			cmdClient.killClient(conn, client)
+			killed++
+		}
+	}
+	return conn.Send(respInt(killed))
+}
+
+// killClient closes the client, the current connection is closed only after
+// it gets the reply.
+func (cmdClient CommandClient) killClient(conn *RedisConnect, client *RedisConnect) {
+	if client == conn {
+		conn.closeAfterReply = true
+		return
+	}
+	client.Kill()
+}
+
+func (cmdClient CommandClient) pause(conn *RedisConnect, args []string) error {
+	timeout, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return sendError(conn, "ERR timeout is not an integer or out of range")
+	}
+	if timeout < 0 {
+		return sendError(conn, "ERR timeout is negative")
+	}
+	all := true
+	if len(args) == 2 {
+		switch strings.ToLower(args[1]) {
+		case "all":
+		case "write":
+			all = false
+		default:
+			return sendError(conn, "ERR syntax error")
+		}
+	}
+	cmdClient.clients.Pause(time.Duration(timeout)*time.Millisecond, all)
+	return conn.Send(respString("OK"))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readReply reads expected from peer and fails the test on anything else.
+func readReply(t *testing.T, peer net.Conn, expected string) {
+	t.Helper()
+	got := make([]byte, len(expected))
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(peer, got); err != nil || string(got) != expected {
+		t.Errorf("expected %q, but got %q, %v", expected, got, err)
+	}
+}
+
+// killed tells if the connection was closed by CLIENT KILL.
+func killed(conn *RedisConnect) bool {
+	conn.output.mu.Lock()
+	defer conn.output.mu.Unlock()
+	return conn.output.dropped || conn.closeAfterReply
+}
+
+func TestClientKill(t *testing.T) {
+	tests := []struct {
+		name string
+		// args builds the arguments of CLIENT KILL from the clients by name
+		args     func(clients map[string]*RedisConnect) []string
+		expected string
+		killed   []string
+	}{
+		{"old form", func(c map[string]*RedisConnect) []string { return []string{c["a"].Conn.RemoteAddr().String()} },
+			respString("OK"), []string{"a"}},
+		{"old form unknown", func(map[string]*RedisConnect) []string { return []string{"127.0.0.1:1"} },
+			respError("ERR No such client"), nil},
+		{"id", func(c map[string]*RedisConnect) []string { return []string{"ID", strconv.FormatInt(c["a"].ID, 10)} },
+			respInt(1), []string{"a"}},
+		{"addr", func(c map[string]*RedisConnect) []string { return []string{"ADDR", c["b"].Conn.RemoteAddr().String()} },
+			respInt(1), []string{"b"}},
+		{"laddr", func(c map[string]*RedisConnect) []string {
+			return []string{"laddr", c["replica"].Conn.LocalAddr().String()}
+		},
+			respInt(1), []string{"replica"}},
+		{"type replica", func(map[string]*RedisConnect) []string { return []string{"TYPE", "replica"} },
+			respInt(1), []string{"replica"}},
+		{"type master", func(map[string]*RedisConnect) []string { return []string{"TYPE", "master"} },
+			respInt(1), []string{"master"}},
+		{"type normal skips me", func(map[string]*RedisConnect) []string { return []string{"TYPE", "normal"} },
+			respInt(2), []string{"a", "b"}},
+		{"skipme no", func(map[string]*RedisConnect) []string { return []string{"TYPE", "normal", "SKIPME", "no"} },
+			respInt(3), []string{"a", "b", "me"}},
+		{"user", func(map[string]*RedisConnect) []string { return []string{"USER", "other"} },
+			respInt(1), []string{"b"}},
+		{"filters combined", func(c map[string]*RedisConnect) []string {
+			return []string{"USER", "other", "ID", strconv.FormatInt(c["a"].ID, 10)}
+		}, respInt(0), nil},
+		{"bad id", func(map[string]*RedisConnect) []string { return []string{"ID", "0"} },
+			respError("ERR client-id should be greater than 0"), nil},
+		{"bad type", func(map[string]*RedisConnect) []string { return []string{"TYPE", "bogus"} },
+			respError("ERR Unknown client type 'bogus'"), nil},
+		{"bad skipme", func(map[string]*RedisConnect) []string { return []string{"SKIPME", "maybe"} },
+			respError("ERR syntax error"), nil},
+		{"odd arguments", func(map[string]*RedisConnect) []string { return []string{"ID", "1", "TYPE"} },
+			respError("ERR syntax error"), nil},
+	}
+	for _, test := range tests {
+		registry := NewClientsRegistry()
+		clients := map[string]*RedisConnect{}
+		var mePeer net.Conn
+		for _, name := range []string{"me", "a", "b", "replica", "master"} {
+			conn, peer := connectedPair(t)
+			if name == "me" {
+				mePeer = peer
+			}
+			clients[name] = conn
+			registry.Register(conn)
+		}
+		clients["b"].User = "other"
+		clients["replica"].IsReplica = true
+		clients["master"].IsMaster = true
+
+		args := append([]string{"KILL"}, test.args(clients)...)
+		(CommandClient{clients: registry}).Call(clients["me"], UserToMaster, args...)
+		readReply(t, mePeer, test.expected)
+		var got []string
+		for name, conn := range clients {
+			if killed(conn) {
+				got = append(got, name)
+			}
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, test.killed) {
+			t.Errorf("%s: expected %v killed, but got %v", test.name, test.killed, got)
+		}
+	}
+}
+
+func TestClientPauseWrite(t *testing.T) {
+	ks := NewKeyspace()
+	useTestReplication(t, ks)
+	t.Cleanup(clientsRegistry.Unpause)
+	commands := map[string]CommandEntry{
+		"set":    {CommandSet{values: ks}, FlagWrite},
+		"get":    {CommandGet{values: ks}, FlagReadonly | FlagFast},
+		"client": {CommandClient{clients: clientsRegistry}, 0},
+	}
+	run := func(args ...string) error {
+		return execute(slog.Default(), commands, NewFakeRedisConnect(), UserToMaster, args)
+	}
+	for _, args := range [][]string{{"CLIENT", "PAUSE", "-1"}, {"CLIENT", "PAUSE", "x"}, {"CLIENT", "PAUSE", "10", "maybe"}} {
+		if err := run(args...); err == nil {
+			t.Errorf("expected %q refused", args)
+		}
+	}
+
+	if err := run("CLIENT", "PAUSE", "10000", "WRITE"); err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan struct{})
+	go func() {
+		run("SET", "k", "v")
+		close(written)
+	}()
+	read := make(chan struct{})
+	go func() {
+		run("GET", "k")
+		close(read)
+	}()
+	select {
+	case <-read:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected reads to go on during CLIENT PAUSE WRITE")
+	}
+	select {
+	case <-written:
+		t.Fatalf("expected the write held during CLIENT PAUSE WRITE")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, ok := ks.Load("k"); ok {
+		t.Errorf("expected k not written yet")
+	}
+
+	if err := run("CLIENT", "UNPAUSE"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the write done after CLIENT UNPAUSE")
+	}
+	if _, ok := ks.Load("k"); !ok {
+		t.Errorf("expected k written")
+	}
+}
+
+func TestClientReply(t *testing.T) {
+	conn, peer := connectedPair(t)
+	commands := map[string]CommandEntry{
+		"ping":   {CommandPing{}, FlagFast},
+		"client": {CommandClient{clients: clientsRegistry}, 0},
+	}
+	for _, args := range [][]string{
+		{"PING"},
+		{"CLIENT", "REPLY", "OFF"},
+		{"PING"},
+		{"CLIENT", "REPLY", "SKIP"},
+		{"CLIENT", "REPLY", "ON"},
+		{"CLIENT", "REPLY", "SKIP"},
+		{"PING"},
+		{"PING"},
+		{"CLIENT", "REPLY", "MAYBE"},
+	} {
+		execute(slog.Default(), commands, conn, UserToMaster, args)
+		conn.commandDone()
+	}
+	readReply(t, peer, respString("PONG")+respString("OK")+respString("PONG")+respError("ERR syntax error"))
+	peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := peer.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected no other reply, but got %d bytes, %v", n, err)
+	}
+}
+
+func TestClientFlagsArguments(t *testing.T) {
+	conn, peer := connectedPair(t)
+	for _, test := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"NO-EVICT", "on"}, respString("OK")},
+		{[]string{"NO-TOUCH", "ON"}, respString("OK")},
+		{[]string{"NO-EVICT", "maybe"}, respError("ERR syntax error")},
+		{[]string{"NO-TOUCH"}, respError("ERR wrong number of arguments for 'client|no-touch' command")},
+		{[]string{"NO-EVICT", "on", "off"}, respError("ERR wrong number of arguments for 'client|no-evict' command")},
+	} {
+		(CommandClient{clients: clientsRegistry}).Call(conn, UserToMaster, test.args...)
+		readReply(t, peer, test.expected)
+	}
+	if info := conn.Info(); !strings.Contains(info, " flags=eT ") {
+		t.Errorf("expected flags e and T, but got %q", info)
+	}
+	(CommandClient{clients: clientsRegistry}).Call(conn, UserToMaster, "NO-EVICT", "off")
+	readReply(t, peer, respString("OK"))
+	if info := conn.Info(); !strings.Contains(info, " flags=T ") {
+		t.Errorf("expected flag T only, but got %q", info)
+	}
+}
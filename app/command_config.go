@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// CommandConfig reads and changes the parameters of the config registry.
+type CommandConfig struct {
+	config    *Config
+	redisInfo *RedisInfo
+}
+
+func (cmdConfig CommandConfig) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+	if len(args) == 0 {
+		return sendError(conn, "ERR wrong number of arguments for 'config' command")
+	}
+	sub := strings.ToLower(args[0])
+	wrongArgs := fmt.Sprintf("ERR wrong number of arguments for 'config|%s' command", sub)
+	switch sub {
+	case "get":
+		if len(args) < 2 {
+			return sendError(conn, wrongArgs)
+		}
+		var items []string
+		for _, param := range cmdConfig.config.Get(args[1:]...) {
+			items = append(items, respBulkString(param[0]), respBulkString(param[1]))
+		}
+		return conn.Send(respMap(conn.Protocol, items...))
+	case "set":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return sendError(conn, wrongArgs)
+		}
+		if err := cmdConfig.config.Set(args[1:]...); err != nil {
+			return sendError(conn, err.Error())
+		}
+		return conn.Send(respString("OK"))
+	case "resetstat":
+		if len(args) != 1 {
+			return sendError(conn, wrongArgs)
+		}
+		cmdConfig.redisInfo.ResetStats()
+		return conn.Send(respString("OK"))
+	case "rewrite":
+		if len(args) != 1 {
+			return sendError(conn, wrongArgs)
+		}
+		if err := cmdConfig.config.Rewrite(); err != nil {
+			if errors.Is(err, errNoConfigFile) {
+				return sendError(conn, err.Error())
+			}
+			slog.Warn("CONFIG REWRITE failed", "err", err)
+			return sendError(conn, "ERR Rewriting config file: "+err.Error())
+		}
+		slog.Info("CONFIG REWRITE executed with success.")
+		return conn.Send(respString("OK"))
+	case "help":
+		lines := []string{
+			"CONFIG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"GET <pattern>", "    Return parameters matching the glob-like <pattern> and their values.",
+			"SET <directive> <value> [<directive> <value> ...]", "    Set the configuration <directive> to <value>.",
+			"RESETSTAT", "    Reset statistics reported by the INFO command.",
+			"REWRITE", "    Rewrite the configuration file.",
+			"HELP", "    Print this help.",
+		}
+		replies := make([]string, 0, len(lines))
+		for _, line := range lines {
+			replies = append(replies, respString(line))
+		}
+		return conn.Send(respArray(replies...))
+	}
+	return sendError(conn, fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", args[0]))
+}
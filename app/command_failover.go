@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// failoverPollPeriod is how often FAILOVER checks the offset of replicas
+	failoverPollPeriod = 100 * time.Millisecond
+	// failoverPausePeriod is renewed while FAILOVER waits, so writes don't
+	// stay paused if something goes wrong
+	failoverPausePeriod = time.Second
+)
+
+// Failover runs FAILOVER: writes are paused until a replica has the whole
+// stream, then the master asks it to take over with PSYNC FAILOVER and
+// becomes its replica.
+type Failover struct {
+	mu sync.Mutex
+	// abort is closed by FAILOVER ABORT, it is nil when no failover runs
+	abort           chan struct{}
+	roles           *RoleManager
+	replicasManager *ReplicasManager
+}
+
+func NewFailover(roles *RoleManager, replicasManager *ReplicasManager) *Failover {
+	return &Failover{roles: roles, replicasManager: replicasManager}
+}
+
+// Start checks the request and starts the failover in background.
+func (f *Failover) Start(target string, timeout time.Duration, force bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if redisInfo.GetRole() == "slave" {
+		return errors.New("ERR FAILOVER is not valid when server is a replica.")
+	}
+	if f.replicasManager.GetReplicasCount() == 0 {
+		return errors.New("ERR FAILOVER requires connected replicas.")
+	}
+	if f.abort != nil {
+		return errors.New("ERR FAILOVER already in progress.")
+	}
+	if target != "" {
+		found, online := f.replicasManager.FindReplica(target)
+		if !found {
+			return errors.New("ERR FAILOVER target HOST and PORT is not a replica.")
+		}
+		if !online {
+			return errors.New("ERR FAILOVER target replica is not online.")
+		}
+	}
+	f.abort = make(chan struct{})
+	redisInfo.SetFailoverState("waiting-for-sync")
+	go f.run(target, timeout, force, f.abort)
+	return nil
+}
+
+func (f *Failover) Abort() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.abort == nil {
+		return errors.New("ERR FAILOVER is not in progress.")
+	}
+	close(f.abort)
+	f.abort = nil
+	return nil
+}
+
+func (f *Failover) run(target string, timeout time.Duration, force bool, abort chan struct{}) {
+	defer func() {
+		f.mu.Lock()
+		if f.abort == abort {
+			f.abort = nil
+		}
+		f.mu.Unlock()
+		redisInfo.SetFailoverState("no-failover")
+		clientsRegistry.Unpause()
+	}()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(failoverPollPeriod)
+	defer ticker.Stop()
+	result := make(chan error, 1)
+	for {
+		clientsRegistry.Pause(failoverPausePeriod, false)
+		forced := false
+		select {
+		case <-ticker.C:
+		case <-abort:
+			slog.Info("FAILOVER aborted")
+			return
+		case <-deadline:
+			if !force {
+				slog.Warn("FAILOVER timeout, replicas didn't catch up")
+				return
+			}
+			slog.Warn("FAILOVER timeout, forcing failover", "target", target)
+			forced = true
+		}
+		// writes which passed the pause before it started are done once
+		// writeMu is taken, so nothing is written after the check
+		writeMu.Lock()
+		address, caughtUp := f.replicasManager.CaughtUpReplica(target)
+		if forced {
+			address, caughtUp = target, true
+		}
+		if !caughtUp {
+			writeMu.Unlock()
+			continue
+		}
+		redisInfo.SetFailoverState("failover-in-progress")
+		handedOver := f.roles.HandOver(address, result)
+		writeMu.Unlock()
+		if !handedOver {
+			slog.Warn("FAILOVER aborted, the server isn't a master anymore")
+			return
+		}
+		target = address
+		break
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			slog.Warn("FAILOVER failed, switching back to master", "target", target, "err", err)
+			f.roles.Promote()
+			return
+		}
+		slog.Info("FAILOVER succeeded", "master", target)
+	case <-abort:
+		slog.Info("FAILOVER aborted")
+		f.roles.Promote()
+	}
+}
+
+type CommandFailover struct {
+	failover *Failover
+}
+
+func (cmdFailover CommandFailover) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+	var (
+		target  string
+		timeout time.Duration
+		force   bool
+		abort   bool
+	)
+	for i := 0; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i]); {
+		case opt == "to" && i+2 < len(args) && target == "":
+			if _, err := strconv.ParseUint(args[i+2], 10, 16); err != nil {
+				return sendError(conn, "ERR value is not an integer or out of range")
+			}
+			target = net.JoinHostPort(args[i+1], args[i+2])
+			i += 2
+		case opt == "timeout" && i+1 < len(args) && timeout == 0:
+			ms, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return sendError(conn, "ERR value is not an integer or out of range")
+			}
+			if ms <= 0 {
+				return sendError(conn, "ERR FAILOVER timeout must be greater than 0")
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+			i++
+		case opt == "force" && !force:
+			force = true
+		case opt == "abort" && !abort:
+			abort = true
+		default:
+			return sendError(conn, "ERR syntax error")
+		}
+	}
+
+	if abort {
+		if target != "" || timeout != 0 || force {
+			return sendError(conn, "ERR FAILOVER with ABORT can't accept other options")
+		}
+		if err := cmdFailover.failover.Abort(); err != nil {
+			return sendError(conn, err.Error())
+		}
+		return conn.Send(respString("OK"))
+	}
+	if force && (target == "" || timeout == 0) {
+		return sendError(conn, "ERR FAILOVER with force option requires both a timeout and target HOST and IP.")
+	}
+	if err := cmdFailover.failover.Start(target, timeout, force); err != nil {
+		return sendError(conn, err.Error())
+	}
+	return conn.Send(respString("OK"))
+}
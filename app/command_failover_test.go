@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestFailover returns a failover of a master with one replica, the
+// replica announces port as the one it listens on.
+func newTestFailover(t *testing.T, port int) (*Failover, *replica) {
+	ks := NewKeyspace()
+	useTestReplication(t, ks)
+	redisInfo = NewRedisInfo("master", replicasManager, nil, persistence)
+	t.Cleanup(func() {
+		if master := redisInfo.GetMaster(); master != nil {
+			master.Stop()
+		}
+		replicasManager.DropReplicas()
+		clientsRegistry.Unpause()
+		replicaOf.Set("")
+		redisInfo = RedisInfo{}
+	})
+	conn, _ := connectedPair(t)
+	conn.listeningPort = port
+	if ok, err := replicasManager.PartialResync(conn, "id", 1); !ok || err != nil {
+		t.Fatalf("expected the replica registered, but got %v, %v", ok, err)
+	}
+	replicasManager.LogCommand("SET", "k", "v")
+	commands := map[string]CommandEntry{"set": {CommandSet{values: ks}, FlagWrite}}
+	failover := NewFailover(NewRoleManager(replicasManager, commands, 0), replicasManager)
+	replicasManager.replicasConnMutex.RLock()
+	defer replicasManager.replicasConnMutex.RUnlock()
+	return failover, replicasManager.replicas[0]
+}
+
+// waitFor returns when done returns true, it returns false on timeout.
+func waitFor(done func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if done() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// waitFailover waits for the failover to finish, writes are unpaused last.
+func waitFailover() bool {
+	return waitFor(func() bool {
+		return failoverState() == "no-failover" && !clientsRegistry.WritesPaused()
+	})
+}
+
+func failoverState() string {
+	redisInfo.replication.mu.RLock()
+	defer redisInfo.replication.mu.RUnlock()
+	return redisInfo.replication.failoverState
+}
+
+func TestFailoverArguments(t *testing.T) {
+	failover, _ := newTestFailover(t, 1)
+	conn, peer := connectedPair(t)
+	for _, test := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"ABORT"}, "-ERR FAILOVER is not in progress."},
+		{[]string{"ABORT", "FORCE"}, "-ERR FAILOVER with ABORT can't accept other options"},
+		{[]string{"TO", "127.0.0.1", "1", "FORCE"}, "-ERR FAILOVER with force option requires both a timeout and target HOST and IP."},
+		{[]string{"TIMEOUT", "0"}, "-ERR FAILOVER timeout must be greater than 0"},
+		{[]string{"TO", "127.0.0.1", "2"}, "-ERR FAILOVER target HOST and PORT is not a replica."},
+		{[]string{"TIMEOUT"}, "-ERR syntax error"},
+	} {
+		// the error is sent to the client too
+		(CommandFailover{failover}).Call(conn, UserToMaster, test.args...)
+		got := make([]byte, len(test.expected)+2)
+		peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(peer, got); err != nil || string(got) != test.expected+"\r\n" {
+			t.Errorf("%q: expected %q, but got %q, %v", test.args, test.expected, got, err)
+		}
+	}
+}
+
+func TestFailoverAbort(t *testing.T) {
+	failover, _ := newTestFailover(t, 1)
+	if err := failover.Start("", 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(clientsRegistry.WritesPaused) || failoverState() != "waiting-for-sync" {
+		t.Errorf("expected writes paused while waiting for the replica")
+	}
+	if err := failover.Start("", 0, false); err == nil {
+		t.Errorf("expected a second FAILOVER refused")
+	}
+	if err := failover.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFailover() {
+		t.Fatalf("expected writes unpaused after ABORT")
+	}
+	if redisInfo.GetRole() != "master" || failoverState() != "no-failover" {
+		t.Errorf("expected a master without failover, but got %s, %s", redisInfo.GetRole(), failoverState())
+	}
+}
+
+func TestFailoverTimeout(t *testing.T) {
+	failover, _ := newTestFailover(t, 1)
+	start := time.Now()
+	if err := failover.Start("", 200*time.Millisecond, false); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFailover() {
+		t.Fatalf("expected the failover to give up")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected the failover to wait for the timeout, but it stopped after %v", elapsed)
+	}
+	if redisInfo.GetRole() != "master" || failoverState() != "no-failover" {
+		t.Errorf("expected a master without failover, but got %s, %s", redisInfo.GetRole(), failoverState())
+	}
+}
+
+func TestFailoverToCaughtUpReplica(t *testing.T) {
+	newMaster := newFakeInstance(t, "")
+	port, _ := strconv.Atoi(portOf(newMaster.Address()))
+	failover, r := newTestFailover(t, port)
+	replicasManager.replicasConnMutex.Lock()
+	r.ackOffset = replicasManager.Offset()
+	replicasManager.replicasConnMutex.Unlock()
+
+	if err := failover.Start(newMaster.Address(), time.Second, false); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFailover() {
+		t.Fatalf("expected the failover done")
+	}
+	master := redisInfo.GetMaster()
+	if redisInfo.GetRole() != "slave" || master == nil || master.address != newMaster.Address() {
+		t.Fatalf("expected a replica of %s, but got %s", newMaster.Address(), redisInfo.GetRole())
+	}
+	newMaster.mu.Lock()
+	psync := newMaster.psync
+	newMaster.mu.Unlock()
+	if len(psync) != 3 || psync[2] != "FAILOVER" {
+		t.Errorf("expected PSYNC FAILOVER, but got %q", psync)
+	}
+	if replicaOf.Get() != "127.0.0.1 "+strconv.Itoa(port) {
+		t.Errorf("expected replicaof set to the new master, but got %q", replicaOf.Get())
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+type CommandReplicaOf struct {
+	roles *RoleManager
+}
+
+func (cmdReplicaOf CommandReplicaOf) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+	if len(args) != 2 {
+		return sendError(conn, "ERR wrong number of arguments for 'replicaof' command")
+	}
+	if strings.EqualFold(args[0], "no") && strings.EqualFold(args[1], "one") {
+		cmdReplicaOf.roles.Promote()
+		return conn.Send(respString("OK"))
+	}
+
+	if _, err := strconv.ParseUint(args[1], 10, 16); err != nil {
+		return sendError(conn, "ERR Invalid master port")
+	}
+	if !cmdReplicaOf.roles.ReplicateFrom(net.JoinHostPort(args[0], args[1])) {
+		return conn.Send(respString("OK Already connected to specified master"))
+	}
+	return conn.Send(respString("OK"))
+}
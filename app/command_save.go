@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+type CommandSave struct {
+	persistence *Persistence
+}
+
+func (cmdSave CommandSave) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+	if len(args) != 0 {
+		return sendError(conn, "ERR wrong number of arguments for 'save' command")
+	}
+	err := cmdSave.persistence.Save()
+	if errors.Is(err, errBgsaveInProgress) {
+		return sendError(conn, err.Error())
+	}
+	if err != nil {
+		return sendError(conn, "ERR "+err.Error())
+	}
+	return conn.Send(respString("OK"))
+}
+
+type CommandBgsave struct {
+	persistence *Persistence
+}
+
+func (cmdBgsave CommandBgsave) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+	schedule := false
+	switch {
+	case len(args) == 1 && strings.EqualFold(args[0], "schedule"):
+		schedule = true
+	case len(args) != 0:
+		return sendError(conn, "ERR syntax error")
+	}
+	if schedule {
+		scheduled, err := cmdBgsave.persistence.ScheduleBgsave()
+		if err != nil {
+			return sendError(conn, err.Error())
+		}
+		if scheduled {
+			return conn.Send(respString("Background saving scheduled"))
+		}
+		return conn.Send(respString("Background saving started"))
+	}
+	if err := cmdBgsave.persistence.Bgsave(); err != nil {
+		return sendError(conn, err.Error()+". Use BGSAVE SCHEDULE in order to schedule a BGSAVE whenever possible.")
+	}
+	return conn.Send(respString("Background saving started"))
+}
+
+type CommandLastSave struct {
+	persistence *Persistence
+}
+
+func (cmdLastSave CommandLastSave) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+	if len(args) != 0 {
+		return sendError(conn, "ERR wrong number of arguments for 'lastsave' command")
+	}
+	return conn.Send(respInt(int(cmdLastSave.persistence.LastSave().Unix())))
+}
+
+type CommandBgRewriteAOF struct {
+	persistence *Persistence
+}
+
+func (cmdRewrite CommandBgRewriteAOF) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+	if len(args) != 0 {
+		return sendError(conn, "ERR wrong number of arguments for 'bgrewriteaof' command")
+	}
+	err := cmdRewrite.persistence.RewriteAOF()
+	if errors.Is(err, errAOFRewriteInProgress) || errors.Is(err, errAOFDisabled) {
+		return sendError(conn, err.Error())
+	}
+	if err != nil {
+		return sendError(conn, "ERR "+err.Error())
+	}
+	return conn.Send(respString("Background append only file rewriting started"))
+}
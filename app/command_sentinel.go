@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CommandSentinel struct {
+	sentinel *Sentinel
+}
+
+func (cmdSentinel CommandSentinel) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+	if len(args) == 0 {
+		return sendError(conn, "ERR wrong number of arguments for 'sentinel' command")
+	}
+	s := cmdSentinel.sentinel
+	subcommand, args := strings.ToLower(args[0]), args[1:]
+	if subcommand == "masters" || subcommand == "myid" {
+		if len(args) != 0 {
+			return sendError(conn, fmt.Sprintf("ERR wrong number of arguments for 'sentinel|%s' command", subcommand))
+		}
+		if subcommand == "myid" {
+			return conn.Send(respBulkString(s.runID))
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		names := make([]string, 0, len(s.masters))
+		for name := range s.masters {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		items := make([]string, 0, len(names))
+		for _, name := range names {
+			items = append(items, s.describe(conn.Protocol, s.masters[name], s.masters[name].instance))
+		}
+		return conn.Send(respArray(items...))
+	}
+	if subcommand == "is-master-down-by-addr" {
+		return cmdSentinel.isMasterDownByAddr(conn, args...)
+	}
+
+	if len(args) != 1 {
+		return sendError(conn, fmt.Sprintf("ERR wrong number of arguments for 'sentinel|%s' command", subcommand))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	master := s.masters[args[0]]
+	if master == nil {
+		if subcommand == "get-master-addr-by-name" {
+			return conn.Send(respNull(conn.Protocol))
+		}
+		return sendError(conn, "ERR No such master with that name")
+	}
+	switch subcommand {
+	case "get-master-addr-by-name":
+		address := master.currentAddress()
+		return conn.Send(respArray(respBulkString(hostOf(address)), respBulkString(portOf(address))))
+	case "master":
+		return conn.Send(s.describe(conn.Protocol, master, master.instance))
+	case "replicas", "slaves":
+		return conn.Send(respArray(s.describeAll(conn.Protocol, master, master.replicas)...))
+	case "sentinels":
+		return conn.Send(respArray(s.describeAll(conn.Protocol, master, master.sentinels)...))
+	case "failover":
+		if master.failoverState != failoverNone {
+			return sendError(conn, "INPROG Failover already in progress")
+		}
+		if s.selectReplica(master, time.Now()) == nil {
+			return sendError(conn, "NOGOODSLAVE No suitable replica to promote")
+		}
+		s.startFailover(master, true, time.Now())
+		return conn.Send(respString("OK"))
+	case "ckquorum":
+		usable := 1
+		for _, peer := range master.sentinels {
+			if peer.sdownSince.IsZero() {
+				usable++
+			}
+		}
+		voters := len(master.sentinels) + 1
+		if usable < master.quorum {
+			return sendError(conn, fmt.Sprintf("NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the specified quorum for this master", usable))
+		}
+		if usable < voters/2+1 {
+			return sendError(conn, fmt.Sprintf("NOQUORUM %d usable Sentinels. Not enough available Sentinels to reach the majority and authorize a failover", usable))
+		}
+		return conn.Send(respString(fmt.Sprintf("OK %d usable Sentinels. Quorum and failover authorization can be reached", usable)))
+	}
+	return sendError(conn, fmt.Sprintf("ERR unknown subcommand '%s'. Try SENTINEL HELP.", subcommand))
+}
+
+// isMasterDownByAddr serves SENTINEL is-master-down-by-addr <ip> <port>
+// <current-epoch> <runid>, other sentinels ask it for the state of the
+// master and for votes.
+func (cmdSentinel CommandSentinel) isMasterDownByAddr(conn *RedisConnect, args ...string) error {
+	if len(args) != 4 {
+		return sendError(conn, "ERR wrong number of arguments for 'sentinel|is-master-down-by-addr' command")
+	}
+	if _, err := strconv.ParseUint(args[1], 10, 16); err != nil {
+		return sendError(conn, "ERR value is not an integer or out of range")
+	}
+	epoch, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return sendError(conn, "ERR value is not an integer or out of range")
+	}
+	down, leader, leaderEpoch := cmdSentinel.sentinel.IsMasterDownByAddr(net.JoinHostPort(args[0], args[1]), epoch, args[3])
+	downState := 0
+	if down {
+		downState = 1
+	}
+	return conn.Send(respArray(respInt(downState), respBulkString(leader), respInt(int(leaderEpoch))))
+}
+
+func (s *Sentinel) describeAll(protocol int, master *sentinelMaster, instances map[string]*sentinelInstance) []string {
+	keys := make([]string, 0, len(instances))
+	for key := range instances {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	res := make([]string, 0, len(keys))
+	for _, key := range keys {
+		res = append(res, s.describe(protocol, master, instances[key]))
+	}
+	return res
+}
+
+// describe returns the fields of an instance for SENTINEL MASTER, REPLICAS
+// and SENTINELS.
+func (s *Sentinel) describe(protocol int, master *sentinelMaster, inst *sentinelInstance) string {
+	now := time.Now()
+	flags := []string{inst.kind.String()}
+	if !inst.sdownSince.IsZero() {
+		flags = append(flags, "s_down")
+	}
+	if inst.kind == sentinelKindMaster && !master.odownSince.IsZero() {
+		flags = append(flags, "o_down")
+	}
+	if !inst.link.IsLinkUp() {
+		flags = append(flags, "disconnected")
+	}
+	if inst.kind == sentinelKindMaster && master.failoverState != failoverNone {
+		flags = append(flags, "failover_in_progress")
+	}
+	if inst == master.promoted {
+		flags = append(flags, "promoted")
+	}
+	if inst.reconfDone {
+		flags = append(flags, "reconf_done")
+	} else if inst.reconfSent {
+		flags = append(flags, "reconf_sent")
+	}
+	millisSince := func(t time.Time) string {
+		if t.IsZero() {
+			return "0"
+		}
+		return strconv.FormatInt(now.Sub(t).Milliseconds(), 10)
+	}
+	pingSent := "0"
+	if !inst.pingPendingSince.IsZero() {
+		pingSent = millisSince(inst.pingPendingSince)
+	}
+	fields := []string{
+		"name", inst.name(master),
+		"ip", inst.host(),
+		"port", inst.port(),
+		"runid", inst.runID,
+		"flags", strings.Join(flags, ","),
+		"last-ping-sent", pingSent,
+		"last-ok-ping-reply", millisSince(inst.lastAvailable),
+		"down-after-milliseconds", strconv.FormatInt(master.downAfter.Milliseconds(), 10),
+	}
+	switch inst.kind {
+	case sentinelKindMaster:
+		fields = append(fields,
+			"role-reported", inst.role,
+			"config-epoch", strconv.FormatInt(master.configEpoch, 10),
+			"num-slaves", strconv.Itoa(len(master.replicas)),
+			"num-other-sentinels", strconv.Itoa(len(master.sentinels)),
+			"quorum", strconv.Itoa(master.quorum),
+			"failover-timeout", strconv.FormatInt(master.failoverTimeout.Milliseconds(), 10),
+			"failover-state", master.failoverState.String(),
+		)
+	case sentinelKindReplica:
+		linkStatus := "err"
+		if inst.masterLinkUp {
+			linkStatus = "ok"
+		}
+		fields = append(fields,
+			"info-refresh", millisSince(inst.lastInfo),
+			"role-reported", inst.role,
+			"master-link-status", linkStatus,
+			"master-host", hostOf(inst.masterAddress),
+			"master-port", portOf(inst.masterAddress),
+			"slave-repl-offset", strconv.FormatInt(inst.replOffset, 10),
+		)
+	case sentinelKindSentinel:
+		fields = append(fields,
+			"last-hello-message", millisSince(inst.lastHello),
+			"voted-leader", inst.leader,
+			"voted-leader-epoch", strconv.FormatInt(inst.leaderEpoch, 10),
+		)
+	}
+	items := make([]string, 0, len(fields))
+	for _, field := range fields {
+		items = append(items, respBulkString(field))
+	}
+	return respMap(protocol, items...)
+}
+
+// CommandSentinelInfo is INFO of a sentinel, it reports the monitored
+// masters instead of the dataset and replication.
+type CommandSentinelInfo struct {
+	sentinel *Sentinel
+}
+
+func (cmdInfo CommandSentinelInfo) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+	for _, arg := range args {
+		switch strings.ToLower(arg) {
+		case "all", "everything", "default", "sentinel":
+		default:
+			return conn.Send(respVerbatim(conn.Protocol, "txt", ""))
+		}
+	}
+	return conn.Send(respVerbatim(conn.Protocol, "txt", cmdInfo.sentinel.String()))
+}
+
+func (s *Sentinel) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.masters))
+	for name := range s.masters {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	res := strings.Builder{}
+	fmt.Fprintf(&res, `# Sentinel
+sentinel_masters:%d
+sentinel_tilt:0
+sentinel_running_scripts:0
+sentinel_scripts_queue_length:0
+sentinel_simulate_failure_flags:0
+`, len(names))
+	for i, name := range names {
+		master := s.masters[name]
+		status := "ok"
+		if !master.odownSince.IsZero() {
+			status = "odown"
+		} else if !master.instance.sdownSince.IsZero() {
+			status = "sdown"
+		}
+		fmt.Fprintf(&res, "master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d\n",
+			i, name, status, master.instance.address, len(master.replicas), len(master.sentinels)+1)
+	}
+	return res.String()
+}
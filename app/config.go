@@ -0,0 +1,494 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// configGeneratedComment precedes the parameters CONFIG REWRITE appends to
+// the config file.
+const configGeneratedComment = "# Generated by CONFIG REWRITE"
+
+var errNoConfigFile = errors.New("ERR The server is running without a config file")
+
+type configFlags int
+
+const (
+	// configMutable parameters can be changed by CONFIG SET, the others
+	// only by flags and the config file
+	configMutable configFlags = 1 << iota
+	// configNoRewrite parameters are never written by CONFIG REWRITE
+	configNoRewrite
+	// configMultiLine parameters add the lines of the config file together,
+	// like the save lines of redis.conf, an empty line clears them
+	configMultiLine
+)
+
+// configValue is a parameter of type T. Set replaces the value as a whole,
+// so Get can be called while CONFIG SET changes it.
+type configValue[T any] struct {
+	value atomic.Pointer[T]
+	// parse gets the current value for types which merge updates
+	parse  func(old T, s string) (T, error)
+	format func(T) string
+	// isBool lets boolean flags be given without a value
+	isBool bool
+}
+
+func (v *configValue[T]) Get() T {
+	return *v.value.Load()
+}
+
+func (v *configValue[T]) String() string {
+	// the flag package calls String on zero values for the usage
+	if v == nil || v.value.Load() == nil {
+		return ""
+	}
+	return v.format(v.Get())
+}
+
+func (v *configValue[T]) Set(s string) error {
+	parsed, err := v.parse(v.Get(), s)
+	if err != nil {
+		return err
+	}
+	v.value.Store(&parsed)
+	return nil
+}
+
+func (v *configValue[T]) IsBoolFlag() bool {
+	return v.isBool
+}
+
+type configParam struct {
+	name  string
+	value flag.Value
+	flags configFlags
+	// defaultValue is the value before the config file and the flags
+	defaultValue string
+}
+
+// line returns the line of the config file setting the parameter.
+func (param *configParam) line() string {
+	return param.name + " " + quoteConfigArg(param.value.String())
+}
+
+// Config is the registry of the parameters of the server. Every parameter
+// is a flag too, the config file is read first so flags override it.
+type Config struct {
+	flags  *flag.FlagSet
+	params map[string]*configParam
+	// set are the parameters given by the config file or the flags
+	set map[string]bool
+	// mu serializes CONFIG SET and CONFIG REWRITE
+	mu sync.Mutex
+	// file is empty when the server runs without a config file
+	file string
+}
+
+func NewConfig(flags *flag.FlagSet) *Config {
+	return &Config{
+		flags:  flags,
+		params: make(map[string]*configParam),
+		set:    make(map[string]bool),
+	}
+}
+
+func (c *Config) register(name string, value flag.Value, flags configFlags, usage string) {
+	if _, ok := c.params[name]; ok {
+		panic(fmt.Sprintf("config parameter %s registered twice", name))
+	}
+	c.params[name] = &configParam{name: name, value: value, flags: flags, defaultValue: value.String()}
+	c.flags.Var(value, name, usage)
+}
+
+// configVar registers a parameter of a custom type.
+func configVar[T any](c *Config, name string, value T, parse func(T, string) (T, error), format func(T) string, flags configFlags, usage string) *configValue[T] {
+	v := &configValue[T]{parse: parse, format: format}
+	v.value.Store(&value)
+	c.register(name, v, flags, usage)
+	return v
+}
+
+// Int registers an integer parameter between lo and hi.
+func (c *Config) Int(name string, value, lo, hi int, flags configFlags, usage string) *configValue[int] {
+	parse := func(_ int, s string) (int, error) {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < lo || n > hi {
+			return 0, fmt.Errorf("argument must be between %d and %d inclusive", lo, hi)
+		}
+		return n, nil
+	}
+	return configVar(c, name, value, parse, strconv.Itoa, flags, usage)
+}
+
+// Memory registers a size between lo and hi bytes, values can have a unit.
+func (c *Config) Memory(name string, value, lo, hi int64, flags configFlags, usage string) *configValue[int64] {
+	parse := func(_ int64, s string) (int64, error) {
+		n, err := parseMemory(s)
+		if err != nil {
+			return 0, errors.New("argument must be a memory value")
+		}
+		if n < lo || n > hi {
+			return 0, fmt.Errorf("argument must be between %d and %d inclusive", lo, hi)
+		}
+		return n, nil
+	}
+	format := func(n int64) string { return strconv.FormatInt(n, 10) }
+	return configVar(c, name, value, parse, format, flags, usage)
+}
+
+// Bool registers a yes or no parameter, the flag can be given without a
+// value.
+func (c *Config) Bool(name string, value bool, flags configFlags, usage string) *configValue[bool] {
+	parse := func(_ bool, s string) (bool, error) {
+		switch strings.ToLower(s) {
+		case "yes", "true", "1":
+			return true, nil
+		case "no", "false", "0":
+			return false, nil
+		}
+		return false, errors.New("argument must be 'yes' or 'no'")
+	}
+	format := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	v := configVar(c, name, value, parse, format, flags, usage)
+	v.isBool = true
+	return v
+}
+
+func (c *Config) String(name string, value string, flags configFlags, usage string) *configValue[string] {
+	parse := func(_ string, s string) (string, error) { return s, nil }
+	format := func(s string) string { return s }
+	return configVar(c, name, value, parse, format, flags, usage)
+}
+
+// Enum registers a parameter which is one of choices, case insensitive.
+func (c *Config) Enum(name string, value string, choices []string, flags configFlags, usage string) *configValue[string] {
+	parse := func(_ string, s string) (string, error) {
+		if lwr := strings.ToLower(s); slices.Contains(choices, lwr) {
+			return lwr, nil
+		}
+		return "", fmt.Errorf("argument(s) must be one of the following: %s", strings.Join(choices, ", "))
+	}
+	format := func(s string) string { return s }
+	return configVar(c, name, value, parse, format, flags, usage)
+}
+
+// Load reads the config file, given as the first argument like redis-server
+// does, and then the flags.
+func (c *Config) Load(args []string) error {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		c.file, args = args[0], args[1:]
+		if err := c.loadFile(); err != nil {
+			return err
+		}
+	}
+	if err := c.flags.Parse(args); err != nil {
+		return err
+	}
+	c.flags.Visit(func(f *flag.Flag) { c.set[f.Name] = true })
+	return nil
+}
+
+// loadFile sets the parameters of the lines "<name> <arg> ...", the args are
+// joined with spaces. A parameter given twice keeps the last value, unless
+// it is configMultiLine or its type merges updates.
+func (c *Config) loadFile() error {
+	content, err := os.ReadFile(c.file)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	for i, line := range strings.Split(string(content), "\n") {
+		args, err := splitConfigArgs(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", c.file, i+1, err)
+		}
+		if len(args) == 0 || strings.HasPrefix(args[0], "#") {
+			continue
+		}
+		param, ok := c.params[strings.ToLower(args[0])]
+		if !ok {
+			return fmt.Errorf("%s:%d: unknown parameter %q", c.file, i+1, args[0])
+		}
+		value := strings.Join(args[1:], " ")
+		if param.flags&configMultiLine != 0 && c.set[param.name] && value != "" {
+			value = param.value.String() + " " + value
+		}
+		if err := param.value.Set(value); err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", c.file, i+1, param.name, err)
+		}
+		c.set[param.name] = true
+	}
+	return nil
+}
+
+// IsSet tells if the parameter was given by the config file or a flag.
+func (c *Config) IsSet(name string) bool {
+	return c.set[name]
+}
+
+// Get returns the names and values of the parameters matching one of the
+// patterns, sorted by name.
+func (c *Config) Get(patterns ...string) [][2]string {
+	var res [][2]string
+	for _, name := range c.names() {
+		for _, pattern := range patterns {
+			if globMatch(pattern, name, true) {
+				res = append(res, [2]string{name, c.params[name].value.String()})
+				break
+			}
+		}
+	}
+	return res
+}
+
+// Set changes the parameters of name and value pairs. Either all of them
+// change or, when one of them can't be set, none.
+func (c *Config) Set(args ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	params := make([]*configParam, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		param, ok := c.params[strings.ToLower(args[i])]
+		if !ok {
+			return fmt.Errorf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i])
+		}
+		if param.flags&configMutable == 0 {
+			return configSetError(args[i], "can't set immutable config")
+		}
+		if slices.Contains(params, param) {
+			return configSetError(args[i], "duplicate parameter")
+		}
+		params = append(params, param)
+	}
+	old := make([]string, len(params))
+	for i, param := range params {
+		old[i] = param.value.String()
+		if err := param.value.Set(args[2*i+1]); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				params[j].value.Set(old[j])
+			}
+			return configSetError(args[2*i], err.Error())
+		}
+	}
+	return nil
+}
+
+func configSetError(name, reason string) error {
+	return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", name, reason)
+}
+
+// Rewrite writes the current values to the config file. The lines of the
+// parameters are replaced in place, comments and unknown lines are kept,
+// and parameters which changed from their defaults are appended.
+func (c *Config) Rewrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == "" {
+		return errNoConfigFile
+	}
+	content, err := os.ReadFile(c.file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var lines []string
+	if len(content) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	}
+	file, err := os.CreateTemp(filepath.Dir(c.file), "temp-config-*.conf")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if _, err := file.WriteString(strings.Join(c.rewriteLines(lines), "\n") + "\n"); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), c.file)
+}
+
+func (c *Config) rewriteLines(lines []string) []string {
+	written := make(map[string]bool)
+	res := make([]string, 0, len(lines))
+	for _, line := range lines {
+		args, err := splitConfigArgs(line)
+		if err != nil || len(args) == 0 || strings.HasPrefix(args[0], "#") {
+			res = append(res, line)
+			continue
+		}
+		param, ok := c.params[strings.ToLower(args[0])]
+		if !ok || param.flags&configNoRewrite != 0 {
+			res = append(res, line)
+			continue
+		}
+		// the first line of a parameter gets the value, the others go
+		if !written[param.name] {
+			res = append(res, param.line())
+			written[param.name] = true
+		}
+	}
+	var added []string
+	for _, name := range c.names() {
+		param := c.params[name]
+		if written[name] || param.flags&configNoRewrite != 0 || param.value.String() == param.defaultValue {
+			continue
+		}
+		added = append(added, param.line())
+	}
+	if len(added) > 0 && !slices.Contains(res, configGeneratedComment) {
+		res = append(res, configGeneratedComment)
+	}
+	return append(res, added...)
+}
+
+func (c *Config) names() []string {
+	names := make([]string, 0, len(c.params))
+	for name := range c.params {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// splitConfigArgs splits a line of the config file in arguments separated by
+// spaces. Arguments can be in double quotes, with the escapes of
+// quoteConfigArg, or in single quotes, where only \' is an escape.
+func splitConfigArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isConfigSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		var arg []byte
+		switch line[i] {
+		case '"':
+			for i++; ; i++ {
+				if i == len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+				if line[i] == '"' {
+					break
+				}
+				if line[i] != '\\' || i+1 == len(line) {
+					arg = append(arg, line[i])
+					continue
+				}
+				i++
+				switch line[i] {
+				case 'n':
+					arg = append(arg, '\n')
+				case 'r':
+					arg = append(arg, '\r')
+				case 't':
+					arg = append(arg, '\t')
+				case 'a':
+					arg = append(arg, '\a')
+				case 'b':
+					arg = append(arg, '\b')
+				case 'x':
+					if i+3 <= len(line) {
+						if b, err := strconv.ParseUint(line[i+1:i+3], 16, 8); err == nil {
+							arg = append(arg, byte(b))
+							i += 2
+							continue
+						}
+					}
+					arg = append(arg, 'x')
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+			i++
+		case '\'':
+			for i++; ; i++ {
+				if i == len(line) {
+					return nil, errors.New("unbalanced quotes")
+				}
+				if line[i] == '\'' {
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+				}
+				arg = append(arg, line[i])
+			}
+			i++
+		default:
+			for i < len(line) && !isConfigSpace(line[i]) {
+				arg = append(arg, line[i])
+				i++
+			}
+			args = append(args, string(arg))
+			continue
+		}
+		// a closing quote must be followed by a space or the end of the line
+		if i < len(line) && !isConfigSpace(line[i]) {
+			return nil, errors.New("closing quote must be followed by a space")
+		}
+		args = append(args, string(arg))
+	}
+}
+
+func isConfigSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+// quoteConfigArg returns s as an argument of the config file, in double
+// quotes when it is empty or has spaces, quotes or special characters.
+func quoteConfigArg(s string) string {
+	plain := s != ""
+	for i := 0; i < len(s) && plain; i++ {
+		plain = s[i] > ' ' && s[i] < 0x7f && s[i] != '"' && s[i] != '\'' && s[i] != '\\'
+	}
+	if plain {
+		return s
+	}
+	var res strings.Builder
+	res.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch b := s[i]; {
+		case b == '\\' || b == '"':
+			res.WriteByte('\\')
+			res.WriteByte(b)
+		case b == '\n':
+			res.WriteString(`\n`)
+		case b == '\r':
+			res.WriteString(`\r`)
+		case b == '\t':
+			res.WriteString(`\t`)
+		case b == '\a':
+			res.WriteString(`\a`)
+		case b == '\b':
+			res.WriteString(`\b`)
+		case b < ' ' || b >= 0x7f:
+			fmt.Fprintf(&res, `\x%02x`, b)
+		default:
+			res.WriteByte(b)
+		}
+	}
+	res.WriteByte('"')
+	return res.String()
+}
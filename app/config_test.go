@@ -0,0 +1,181 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSplitConfigArgs(t *testing.T) {
+	for _, test := range []struct {
+		line     string
+		expected []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"port 6380", []string{"port", "6380"}},
+		{"  save 3600 1\t300 100 ", []string{"save", "3600", "1", "300", "100"}},
+		{`save ""`, []string{"save", ""}},
+		{`dir "/tmp/a dir"`, []string{"dir", "/tmp/a dir"}},
+		{`dir 'it\'s'`, []string{"dir", "it's"}},
+		{`name "a\"b\\c\n\x41\xZZ"`, []string{"name", "a\"b\\c\nAxZZ"}},
+	} {
+		args, err := splitConfigArgs(test.line)
+		if err != nil || !slices.Equal(args, test.expected) {
+			t.Errorf("for %q expected %q, but got %q, %v", test.line, test.expected, args, err)
+		}
+	}
+	for _, line := range []string{`dir "unbalanced`, `dir 'unbalanced`, `dir "a"b`} {
+		if _, err := splitConfigArgs(line); err == nil {
+			t.Errorf("expected error for %q", line)
+		}
+	}
+}
+
+func TestQuoteConfigArg(t *testing.T) {
+	for _, s := range []string{"plain", "", "a b", `a"b`, "it's", `back\slash`, "\n\r\t\x00\xff"} {
+		args, err := splitConfigArgs("name " + quoteConfigArg(s))
+		if err != nil || len(args) != 2 || args[1] != s {
+			t.Errorf("for %q expected it back, but got %q, %v", s, args, err)
+		}
+	}
+	if quoted := quoteConfigArg("plain"); quoted != "plain" {
+		t.Errorf("expected plain unquoted, but got %q", quoted)
+	}
+}
+
+func newTestConfig() (*Config, *configValue[int], *configValue[bool], *configValue[string]) {
+	config := NewConfig(flag.NewFlagSet("test", flag.ContinueOnError))
+	timeout := config.Int("timeout", 0, 0, 100, configMutable, "")
+	readOnly := config.Bool("replica-read-only", true, configMutable, "")
+	fsync := config.Enum("appendfsync", "everysec", []string{"always", "everysec", "no"}, 0, "")
+	config.Memory("auto-aof-rewrite-min-size", 0, 0, 1<<40, configMutable, "")
+	return config, timeout, readOnly, fsync
+}
+
+func TestConfigSet(t *testing.T) {
+	config, timeout, readOnly, _ := newTestConfig()
+	if err := config.Set("TIMEOUT", "10", "replica-read-only", "no", "auto-aof-rewrite-min-size", "1mb"); err != nil {
+		t.Fatal(err)
+	}
+	if timeout.Get() != 10 || readOnly.Get() {
+		t.Errorf("expected timeout 10 and replica-read-only no, but got %d, %v", timeout.Get(), readOnly.Get())
+	}
+	expected := [][2]string{{"auto-aof-rewrite-min-size", "1048576"}, {"replica-read-only", "no"}, {"timeout", "10"}}
+	if params := config.Get("*M*", "replica-*"); !slices.Equal(params, expected) {
+		t.Errorf("expected %q, but got %q", expected, params)
+	}
+
+	for _, args := range [][]string{
+		{"timeout", "20", "replica-read-only", "maybe"},
+		{"timeout", "101"},
+		{"timeout", "20", "timeout", "30"},
+		{"appendfsync", "always"},
+		{"unknown", "1"},
+	} {
+		if err := config.Set(args...); err == nil || !strings.HasPrefix(err.Error(), "ERR ") {
+			t.Errorf("for %q expected an error, but got %v", args, err)
+		}
+	}
+	// a failed CONFIG SET changes nothing
+	if timeout.Get() != 10 || readOnly.Get() {
+		t.Errorf("expected timeout 10 and replica-read-only no, but got %d, %v", timeout.Get(), readOnly.Get())
+	}
+}
+
+func TestConfigLoadAndRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	content := "# my config\ntimeout 5\n\nappendfsync always\ntimeout 6\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, timeout, readOnly, fsync := newTestConfig()
+	if err := config.Load([]string{path, "--replica-read-only=no"}); err != nil {
+		t.Fatal(err)
+	}
+	if timeout.Get() != 6 || fsync.Get() != "always" || readOnly.Get() {
+		t.Errorf("expected the file and the flags applied, but got %d, %s, %v", timeout.Get(), fsync.Get(), readOnly.Get())
+	}
+	if !config.IsSet("timeout") || !config.IsSet("replica-read-only") || config.IsSet("auto-aof-rewrite-min-size") {
+		t.Errorf("expected timeout and replica-read-only set, auto-aof-rewrite-min-size not")
+	}
+
+	if err := config.Set("timeout", "7", "auto-aof-rewrite-min-size", "100"); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# my config\ntimeout 7\n\nappendfsync always\n" + configGeneratedComment + "\nauto-aof-rewrite-min-size 100\nreplica-read-only no\n"
+	if string(rewritten) != expected {
+		t.Errorf("expected %q, but got %q", expected, rewritten)
+	}
+
+	// unknown parameters are refused at startup
+	if err := os.WriteFile(path, []byte(content+"unknown yes\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, _, _, _ = newTestConfig()
+	if err := config.Load([]string{path}); err == nil {
+		t.Errorf("expected error for unknown parameter")
+	}
+}
+
+func TestConfigRewriteWithoutFile(t *testing.T) {
+	config, _, _, _ := newTestConfig()
+	if err := config.Load(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Rewrite(); err != errNoConfigFile {
+		t.Errorf("expected %v, but got %v", errNoConfigFile, err)
+	}
+}
+
+func TestConfigRequestLimitsAreCapped(t *testing.T) {
+	for _, args := range [][]string{
+		{"proto-max-bulk-len", strconv.FormatInt(maxBulkLength+1, 10)},
+		{"client-query-buffer-limit", strconv.FormatInt(maxQueryBufferLimit+1, 10)},
+	} {
+		if err := config.Set(args...); err == nil {
+			t.Errorf("expected %q to be refused", args)
+		}
+	}
+}
+
+func TestConfigMaxmemory(t *testing.T) {
+	t.Cleanup(func() { config.Set("maxmemory", "0") })
+	if err := config.Set("maxmemory", "100mb"); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][2]string{{"maxmemory", "104857600"}}
+	if params := config.Get("maxmemory"); !slices.Equal(params, expected) {
+		t.Errorf("expected %q, but got %q", expected, params)
+	}
+}
+
+func TestConfigMultiLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	if err := os.WriteFile(path, []byte("save 900 1\nsave 300 10\nsave 60 10000\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := NewConfig(flag.NewFlagSet("test", flag.ContinueOnError))
+	save := configVar(config, "save", savePoints{{3600, 1}}, parseSavePoints, savePoints.String, configMutable|configMultiLine, "")
+	if err := config.Load([]string{path}); err != nil {
+		t.Fatal(err)
+	}
+	if points := save.String(); points != "900 1 300 10 60 10000" {
+		t.Errorf("expected the save lines merged, but got %q", points)
+	}
+	// CONFIG SET replaces them
+	if err := config.Set("save", "10 1"); err != nil || save.String() != "10 1" {
+		t.Errorf("expected save points replaced, but got %q, %v", save.String(), err)
+	}
+}
@@ -2,39 +2,284 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/rdb"
+)
+
+const (
+	// protoInlineMaxSize limits the length of "*<count>" and "$<len>" lines
+	protoInlineMaxSize = 64 * 1024
+	maxMultibulkLength = 1024 * 1024
+	// maxArgsPrealloc caps the arguments slice allocated before the
+	// arguments actually arrive
+	maxArgsPrealloc = 1024
+	// maxBulkLength limits bulk strings of every link, the master's too,
+	// proto-max-bulk-len can't be above it
+	maxBulkLength int64 = 4 * 1024 * 1024 * 1024
+	// maxQueryBufferLimit is the highest client-query-buffer-limit, sums of
+	// request sizes stay far from overflowing below it
+	maxQueryBufferLimit int64 = 1024 * 1024 * 1024 * 1024
+)
+
+var (
+	lastClientID        atomic.Int64
+	errQueryBufferLimit = errors.New("closing client that reached max query buffer length")
+)
+
+// ProtocolError is a malformed request. Its message is replied to the client
+// before the connection is closed.
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.msg
+}
+
+type replyMode int
+
+const (
+	replyOn replyMode = iota
+	replyOff
+	// replySkip suppresses replies of the current command
+	replySkip
+	// replySkipNext suppresses replies of the next command
+	replySkipNext
 )
 
 type RedisConnect struct {
+	ID            int64
+	Name          string
+	User          string
+	Protocol      int
 	PrevReadBytes int
 	ReadBytes     int
 	Conn          net.Conn
 	IsBorrowed    bool
+	released      chan struct{}
+	IsMaster      bool
+	IsReplica     bool
 	reader        *bufio.Reader
-	writer        *bufio.Writer
-	readTimeout   time.Duration
+	output        *outputBuffer
 	writeTimeout  time.Duration
+	fd            int
+	// infoMu guards the fields shown by CLIENT LIST against concurrent
+	// readers, the connection goroutine itself reads them without locking
+	infoMu          sync.Mutex
+	createdAt       time.Time
+	lastInteraction time.Time
+	lastCmd         string
+	queryBufSize    int
+	isBlocked       bool
+	noEvict         bool
+	// noTouch is only shown, keys have no access time to leave alone
+	noTouch bool
+	// listeningPort is announced by replicas with REPLCONF listening-port
+	listeningPort int
+	// capaEOF is set for replicas which accept a diskless snapshot
+	capaEOF bool
+	// writeOffset is the replication offset after the last write of the
+	// client, WAIT waits for it
+	writeOffset int64
+	// dirty counts the keys changed by the current command, execute
+	// propagates the writes which changed any
+	dirty           int
+	replyMode       replyMode
+	closeAfterReply bool
+	// Stream gets the raw bytes of every command read from the connection,
+	// replicas forward the stream of their master with it
+	Stream func([]byte)
+	raw    []byte
+	// subscriptions counts the channels the client is subscribed to
+	subscriptions atomic.Int32
+	// isLink is set for the links a sentinel opens, they aren't clients
+	isLink bool
+	// detached connections are served by a goroutine of their own instead
+	// of a worker
+	detached bool
 }
 
 func NewRedisConnect(conn net.Conn) *RedisConnect {
+	rc := newRedisConnect(conn)
+	clientsRegistry.Register(rc)
+	go rc.writeLoop()
+	return rc
+}
+
+// NewMasterRedisConnect returns the connection of a replica with its master,
+// stream gets the raw commands read from it.
+func NewMasterRedisConnect(conn net.Conn, stream func([]byte)) *RedisConnect {
+	rc := newRedisConnect(conn)
+	rc.IsMaster = true
+	rc.Stream = stream
+	clientsRegistry.Register(rc)
+	go rc.writeLoop()
+	return rc
+}
+
+// NewLinkRedisConnect returns the connection of a link a sentinel opened to
+// another server. It's not a client of ours: CLIENT LIST doesn't show it and
+// it's never closed when idle.
+func NewLinkRedisConnect(conn net.Conn) *RedisConnect {
+	rc := newRedisConnect(conn)
+	rc.isLink = true
+	go rc.writeLoop()
+	return rc
+}
+
+func newRedisConnect(conn net.Conn) *RedisConnect {
 	// Use sync.Pool for conn
-	return &RedisConnect{
-		Conn:         conn,
-		IsBorrowed:   false,
-		reader:       bufio.NewReader(conn),
-		writer:       bufio.NewWriter(conn),
-		readTimeout:  1 * time.Second,
-		writeTimeout: 1 * time.Second,
+	now := time.Now()
+	rc := &RedisConnect{
+		ID:              lastClientID.Add(1),
+		User:            "default",
+		Protocol:        RESP2,
+		Conn:            conn,
+		IsBorrowed:      false,
+		output:          newOutputBuffer(),
+		writeTimeout:    1 * time.Second,
+		fd:              -1,
+		createdAt:       now,
+		lastInteraction: now,
+		lastCmd:         "NULL",
+	}
+	rc.reader = bufio.NewReaderSize(idleReader{rc}, int(clientReadBufferSize.Get()))
+	if sc, ok := conn.(syscall.Conn); ok {
+		if raw, err := sc.SyscallConn(); err == nil {
+			raw.Control(func(fd uintptr) {
+				rc.fd = int(fd)
+			})
+		}
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		setKeepAlive(tcpConn, tcpKeepAlive.Get())
+	}
+	return rc
+}
+
+// NewFakeRedisConnect returns a client without a socket, the AOF loader
+// runs commands with it. Replies are dropped.
+func NewFakeRedisConnect() *RedisConnect {
+	rc := &RedisConnect{
+		ID:       -1,
+		User:     "default",
+		Protocol: RESP2,
+		// the file is trusted like the master, request limits don't apply
+		IsMaster: true,
+		output:   newOutputBuffer(),
+		fd:       -1,
+		lastCmd:  "NULL",
+	}
+	rc.output.suppressed = true
+	return rc
+}
+
+// setKeepAlive applies tcp-keepalive, zero disables keepalive probes.
+func setKeepAlive(conn *net.TCPConn, seconds int) {
+	if seconds <= 0 {
+		conn.SetKeepAlive(false)
+		return
+	}
+	conn.SetKeepAlive(true)
+	conn.SetKeepAlivePeriod(time.Duration(seconds) * time.Second)
+}
+
+// idleReader refreshes the read deadline before every read, so a client
+// that sends nothing for the idle timeout gets disconnected.
+type idleReader struct {
+	rc *RedisConnect
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	var deadline time.Time
+	if timeout := r.rc.idleTimeout(); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	r.rc.Conn.SetReadDeadline(deadline)
+	return r.rc.Conn.Read(p)
+}
+
+// idleTimeout returns the timeout after which the client is closed when
+// idle. As in Redis, replicas, pub/sub subscribers and the links of
+// sentinels are never closed, and the master link after repl-timeout, the
+// master pings more often. Blocked clients don't read until they are served,
+// so the deadline can't fire for them.
+func (rc *RedisConnect) idleTimeout() time.Duration {
+	if rc.IsMaster {
+		return time.Duration(replTimeout.Get()) * time.Second
+	}
+	if idleTimeout.Get() <= 0 || rc.isLink || rc.Class() != ClientClassNormal {
+		return 0
+	}
+	return time.Duration(idleTimeout.Get()) * time.Second
+}
+
+// longLived tells if the client stays connected for long: subscribers, like
+// the links of sentinels to monitored instances, and every client of a
+// sentinel, most of them other sentinels.
+func (rc *RedisConnect) longLived() bool {
+	return !rc.IsMaster && (rc.Class() == ClientClassPubSub || sentinelMode.Get())
+}
+
+// Borrow takes the connection from its worker. The worker stops reading the
+// connection after the current command, and the returned channel is closed
+// once it's done.
+func (rc *RedisConnect) Borrow() <-chan struct{} {
+	rc.IsBorrowed = true
+	rc.released = make(chan struct{})
+	return rc.released
+}
+
+// release is called by the worker when it stops using a borrowed connection.
+func (rc *RedisConnect) release() {
+	close(rc.released)
+}
+
+// touch records the command being executed for CLIENT LIST.
+func (rc *RedisConnect) touch(parsedCmd []string) {
+	rc.infoMu.Lock()
+	defer rc.infoMu.Unlock()
+	rc.lastCmd = commandFullName(parsedCmd)
+	rc.lastInteraction = time.Now()
+	rc.queryBufSize = rc.reader.Buffered()
+}
+
+func (rc *RedisConnect) SetName(name string) {
+	rc.infoMu.Lock()
+	defer rc.infoMu.Unlock()
+	rc.Name = name
+}
+
+func (rc *RedisConnect) setReplyMode(mode replyMode) {
+	rc.replyMode = mode
+	rc.output.mu.Lock()
+	defer rc.output.mu.Unlock()
+	rc.output.suppressed = mode == replyOff || mode == replySkip
+}
+
+// commandDone moves CLIENT REPLY SKIP on to the next command.
+func (rc *RedisConnect) commandDone() {
+	switch rc.replyMode {
+	case replySkip:
+		rc.setReplyMode(replyOn)
+	case replySkipNext:
+		rc.setReplyMode(replySkip)
 	}
 }
 
 func (rc *RedisConnect) ReadLine() (string, error) {
-	// rc.Conn.SetReadDeadline(time.Now().Add(rc.readTimeout))
 	var text []byte
 	for {
 		appendText, isPrefix, err := rc.reader.ReadLine()
@@ -57,85 +302,249 @@ func (rc *RedisConnect) ReadFull(buf []byte) error {
 }
 
 func (rc *RedisConnect) SendCommand(cmd string, args ...string) error {
-	// rc.Conn.SetWriteDeadline(time.Now().Add(rc.writeTimeout))
-	_, err := rc.writer.WriteString(respCommand(cmd, args...))
+	err := rc.Send(respCommand(cmd, args...))
 	if err != nil {
 		return fmt.Errorf("sending %s command err: %w", cmd, err)
 	}
-	err = rc.writer.Flush()
-	if err != nil {
-		return fmt.Errorf("sending %s command flush err: %w", cmd, err)
-	}
 	return nil
 }
 
-func (rc *RedisConnect) Send(msg string) error {
-	// rc.Conn.SetWriteDeadline(time.Now().Add(rc.writeTimeout))
-	_, err := rc.writer.WriteString(msg)
+// ReadRDBSnapshot reads the RDB snapshot which follows FULLRESYNC and
+// returns the dataset.
+func (rc *RedisConnect) ReadRDBSnapshot() (map[string]ValueWithExpiration, error) {
+	text, err := rc.ReadLine()
 	if err != nil {
-		return fmt.Errorf("sending msg err: %w", err)
+		return nil, fmt.Errorf("reading length of RDB snapshot failed: %w", err)
+	}
+	if len(text) == 0 || text[0] != '$' {
+		return nil, fmt.Errorf("expecting RDB snapshot length, got %q", text)
+	}
+	if mark, ok := strings.CutPrefix(text, "$EOF:"); ok {
+		return rc.readRDBUntilMark(mark)
 	}
-	err = rc.writer.Flush()
+	n, err := strconv.ParseInt(text[1:], 10, 64)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("reading length of RDB snapshot failed: %w", err)
+	}
+	payload := io.LimitReader(rc.reader, n)
+	data, err := rdb.Read(payload)
 	if err != nil {
-		return fmt.Errorf("sending msg flush err: %w", err)
+		return nil, fmt.Errorf("parsing RDB snapshot failed: %w", err)
 	}
-	return nil
+	// skip anything after the checksum to stay in sync with the stream
+	if _, err = io.Copy(io.Discard, payload); err != nil {
+		return nil, fmt.Errorf("reading payload of RDB snapshot failed: %w", err)
+	}
+	rc.ReadBytes += int(n)
+	slog.Debug("read RDB snapshot", "bytes", n, "keys", len(data))
+	return data, nil
 }
 
-func (rc *RedisConnect) ReadRDBSnapshot() error {
-	// rc.Conn.SetReadDeadline(time.Now().Add(rc.readTimeout))
+// ReplyError is an error reply of a server.
+type ReplyError string
+
+func (e ReplyError) Error() string {
+	return string(e)
+}
+
+// PushReply is an out of band RESP3 push message.
+type PushReply []any
+
+// ReadReply reads a reply of a server. Strings of any kind are returned as
+// string, integers as int64, aggregates as []any with maps flattened into
+// key-value pairs, errors as ReplyError and nulls as nil.
+func (rc *RedisConnect) ReadReply() (any, error) {
 	text, err := rc.ReadLine()
 	if err != nil {
-		return fmt.Errorf("reading length of RDB snapshot failed: %w", err)
+		return nil, err
 	}
-	n, err := strconv.Atoi(text[1:])
-	if err != nil {
-		return fmt.Errorf("reading length of RDB snapshot failed: %w", err)
+	if len(text) == 0 {
+		return nil, fmt.Errorf("expecting reply, got empty line")
+	}
+	switch text[0] {
+	case '+':
+		return text[1:], nil
+	case '-':
+		return ReplyError(text[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(text[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing integer reply %q: %w", text, err)
+		}
+		return n, nil
+	case '_':
+		return nil, nil
+	case '#':
+		return text[1:] == "t", nil
+	case ',':
+		return text[1:], nil
+	case '$', '=':
+		n, err := strconv.Atoi(text[1:])
+		if err != nil || int64(n) > maxBulkLength {
+			return nil, fmt.Errorf("parsing length of reply %q", text)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		// like ReadCommand, the buffer grows while the payload arrives
+		var payload bytes.Buffer
+		copied, err := io.CopyN(&payload, rc.reader, int64(n+2))
+		rc.ReadBytes += int(copied)
+		if err != nil {
+			return nil, fmt.Errorf("can't read bulk string reply: %w", err)
+		}
+		buf := payload.Bytes()
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return nil, fmt.Errorf("bulk string reply is not terminated by CRLF")
+		}
+		if text[0] == '=' && n >= 4 {
+			// verbatim strings start with their format
+			return string(buf[4:n]), nil
+		}
+		return string(buf[:n]), nil
+	case '*', '>', '~', '%':
+		n, err := strconv.Atoi(text[1:])
+		if err != nil || n > maxMultibulkLength {
+			return nil, fmt.Errorf("parsing length of reply %q", text)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		if text[0] == '%' {
+			n *= 2
+		}
+		items := make([]any, 0, min(n, maxArgsPrealloc))
+		for i := 0; i < n; i++ {
+			item, err := rc.ReadReply()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		if text[0] == '>' {
+			return PushReply(items), nil
+		}
+		return items, nil
 	}
-	buf := make([]byte, n)
-	err = rc.ReadFull(buf)
+	return nil, fmt.Errorf("unknown reply type %q", text)
+}
 
+func (rc *RedisConnect) RememberPreviousBytes() {
+	rc.infoMu.Lock()
+	defer rc.infoMu.Unlock()
+	rc.PrevReadBytes = rc.ReadBytes
+}
+
+// readHeader reads a "*<count>" or "$<len>" line of a request.
+func (rc *RedisConnect) readHeader() (string, error) {
+	var line []byte
+	for {
+		chunk, err := rc.reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > protoInlineMaxSize {
+			if line[0] == '*' {
+				return "", &ProtocolError{"Protocol error: too big mbulk count string"}
+			}
+			return "", &ProtocolError{"Protocol error: too big bulk count string"}
+		}
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return "", fmt.Errorf("can't read line: %w", err)
+		}
+	}
+	rc.consume(line)
+	line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+	return string(line), nil
+}
+
+// readRDBUntilMark parses a diskless snapshot as it arrives, the end of the
+// snapshot is marked by the random string from its header.
+func (rc *RedisConnect) readRDBUntilMark(mark string) (map[string]ValueWithExpiration, error) {
+	if len(mark) != rdbEOFMarkSize {
+		return nil, fmt.Errorf("wrong EOF mark of RDB snapshot %q", mark)
+	}
+	counter := &countingReader{r: rc.reader}
+	data, err := rdb.Read(counter)
 	if err != nil {
-		return fmt.Errorf("reading payload of RDB snapshot failed: %w", err)
+		return nil, fmt.Errorf("parsing RDB snapshot failed: %w", err)
+	}
+	end := make([]byte, rdbEOFMarkSize)
+	if _, err = io.ReadFull(counter, end); err != nil {
+		return nil, fmt.Errorf("reading EOF mark of RDB snapshot failed: %w", err)
+	}
+	if string(end) != mark {
+		return nil, fmt.Errorf("RDB snapshot doesn't end with its EOF mark")
 	}
-	slog.Debug("read from connection", "buf", buf)
+	rc.ReadBytes += counter.n
+	slog.Debug("read diskless RDB snapshot", "bytes", counter.n, "keys", len(data))
+	return data, nil
+}
 
-	// TODO: return snapshot to make something with it
-	return nil
+type countingReader struct {
+	r io.Reader
+	n int
 }
 
-func (rc *RedisConnect) RememberPreviousBytes() {
-	rc.PrevReadBytes = rc.ReadBytes
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += n
+	return n, err
+}
+
+// consume counts the bytes taken by the parser and keeps them when the stream
+// is forwarded.
+func (rc *RedisConnect) consume(p []byte) {
+	rc.ReadBytes += len(p)
+	if rc.Stream != nil {
+		rc.raw = append(rc.raw, p...)
+	}
 }
 
 func (rc *RedisConnect) ReadCommand() ([]string, error) {
-	text, err := rc.ReadLine()
-	if len(text) == 0 || err != nil || text[0] != '*' {
+	rc.raw = rc.raw[:0]
+	startBytes := rc.ReadBytes
+	text, err := rc.readHeader()
+	if err != nil {
 		return nil, fmt.Errorf("expecting RESP array as a comand: %w", err)
 	}
+	if len(text) == 0 || text[0] != '*' {
+		return nil, fmt.Errorf("expecting RESP array as a comand, got %q", text)
+	}
 	arrayLength, err := strconv.Atoi(text[1:])
-	if err != nil {
-		return nil, fmt.Errorf("can't parse array length: %w", err)
+	if err != nil || arrayLength > maxMultibulkLength {
+		return nil, &ProtocolError{"Protocol error: invalid multibulk length"}
 	}
-	res := make([]string, 0, arrayLength)
+	res := make([]string, 0, max(0, min(arrayLength, maxArgsPrealloc)))
 	for i := 0; i < arrayLength; i++ {
-		text, err := rc.ReadLine()
-		if len(text) == 0 || err != nil || text[0] != '$' {
+		text, err := rc.readHeader()
+		if err != nil {
 			return nil, fmt.Errorf("expecting array of bulk strings: %w", err)
 		}
+		if len(text) == 0 || text[0] != '$' {
+			return nil, &ProtocolError{fmt.Sprintf("Protocol error: expected '$', got '%s'", text[:min(1, len(text))])}
+		}
 		bufLen, err := strconv.Atoi(text[1:])
-		if err != nil {
-			return nil, fmt.Errorf("can't parse bulk string length: %w", err)
+		if err != nil || bufLen < 0 || int64(bufLen) > maxBulkLength || (!rc.IsMaster && int64(bufLen) > protoMaxBulkLen.Get()) {
+			return nil, &ProtocolError{"Protocol error: invalid bulk length"}
+		}
+		if !rc.IsMaster && int64(rc.ReadBytes-startBytes)+int64(bufLen)+2 > clientQueryBufferLimit.Get() {
+			return nil, errQueryBufferLimit
 		}
-		buf := make([]byte, bufLen+2)
-		err = rc.ReadFull(buf)
+		// the buffer grows while the payload arrives, so a huge announced
+		// length doesn't allocate anything up front
+		var buf bytes.Buffer
+		_, err = io.CopyN(&buf, rc.reader, int64(bufLen+2))
+		rc.consume(buf.Bytes())
 		if err != nil {
 			return nil, fmt.Errorf("can't read bulk string payload: %w", err)
 		}
-		if buf[bufLen] != '\r' || buf[bufLen+1] != '\n' {
-			return nil, fmt.Errorf("can't read bulk string payload: %w", err)
+		payload := buf.Bytes()
+		if payload[bufLen] != '\r' || payload[bufLen+1] != '\n' {
+			return nil, &ProtocolError{"Protocol error: bulk string is not terminated by CRLF"}
 		}
-		res = append(res, string(buf[:bufLen]))
+		res = append(res, string(payload[:bufLen]))
 	}
 
 	return res, nil
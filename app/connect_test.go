@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newTestRedisConnect(data []byte) *RedisConnect {
+	return &RedisConnect{reader: bufio.NewReader(bytes.NewReader(data))}
+}
+
+func TestReadCommandLimits(t *testing.T) {
+	for _, test := range []struct {
+		request       string
+		expectedError string
+	}{
+		{"*2000000\r\n", "Protocol error: invalid multibulk length"},
+		{"*x\r\n", "Protocol error: invalid multibulk length"},
+		{"*1\r\n$-1\r\n", "Protocol error: invalid bulk length"},
+		{"*1\r\n$1000000000000\r\n", "Protocol error: invalid bulk length"},
+		{"*1\r\n$9223372036854775807\r\nx", "Protocol error: invalid bulk length"},
+		{"*1\r\n+PING\r\n", "Protocol error: expected '$', got '+'"},
+		{"*1\r\n$4\r\nPINGxx", "Protocol error: bulk string is not terminated by CRLF"},
+		{"*" + strings.Repeat("1", protoInlineMaxSize+1) + "\r\n", "Protocol error: too big mbulk count string"},
+	} {
+		_, err := newTestRedisConnect([]byte(test.request)).ReadCommand()
+		var protocolErr *ProtocolError
+		if !errors.As(err, &protocolErr) || protocolErr.Error() != test.expectedError {
+			t.Errorf("for %q expected %q, but got %v", test.request, test.expectedError, err)
+		}
+	}
+}
+
+func TestReadCommandMasterLimits(t *testing.T) {
+	// the master isn't bound by proto-max-bulk-len, but lengths which can't
+	// be real are refused
+	rc := newTestRedisConnect([]byte("*1\r\n$9223372036854775807\r\nx"))
+	rc.IsMaster = true
+	var protocolErr *ProtocolError
+	if _, err := rc.ReadCommand(); !errors.As(err, &protocolErr) {
+		t.Errorf("expected protocol error, but got %v", err)
+	}
+}
+
+func TestReadCommandQueryBufferLimit(t *testing.T) {
+	defer clientQueryBufferLimit.Set(clientQueryBufferLimit.String())
+	clientQueryBufferLimit.Set("16")
+
+	_, err := newTestRedisConnect([]byte("*1\r\n$20\r\n")).ReadCommand()
+	if err != errQueryBufferLimit {
+		t.Errorf("expected query buffer limit error, but got %v", err)
+	}
+}
+
+func FuzzReadCommand(f *testing.F) {
+	f.Add([]byte("*1\r\n$4\r\nPING\r\n"))
+	f.Add([]byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n*1\r\n$4\r\nPING\r\n"))
+	f.Add([]byte("*-1\r\n"))
+	f.Add([]byte("*1\r\n$-1\r\n"))
+	f.Add([]byte("*1\r\n$9223372036854775807\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rc := newTestRedisConnect(data)
+		for {
+			cmd, err := rc.ReadCommand()
+			if err != nil {
+				return
+			}
+			if rc.ReadBytes > len(data) {
+				t.Fatalf("read %d bytes from %d byte input %q", rc.ReadBytes, len(data), data)
+			}
+			if len(cmd) == 0 {
+				continue
+			}
+			again, err := newTestRedisConnect([]byte(respCommand(cmd[0], cmd[1:]...))).ReadCommand()
+			if err != nil || !slices.Equal(cmd, again) {
+				t.Fatalf("re-encoded %q decoded as %q, %v", cmd, again, err)
+			}
+		}
+	})
+}
+
+func TestReadReply(t *testing.T) {
+	for _, test := range []struct {
+		reply    string
+		expected any
+	}{
+		{"+PONG\r\n", "PONG"},
+		{"-ERR oops\r\n", ReplyError("ERR oops")},
+		{":42\r\n", int64(42)},
+		{"$3\r\nfoo\r\n", "foo"},
+		{"$-1\r\n", nil},
+		{"_\r\n", nil},
+		{"=7\r\ntxt:foo\r\n", "foo"},
+		{"*2\r\n:1\r\n$1\r\na\r\n", []any{int64(1), "a"}},
+		{"%1\r\n+key\r\n:1\r\n", []any{"key", int64(1)}},
+		{">2\r\n$7\r\nmessage\r\n$2\r\nhi\r\n", PushReply{"message", "hi"}},
+	} {
+		reply, err := newTestRedisConnect([]byte(test.reply)).ReadReply()
+		if err != nil || !reflect.DeepEqual(reply, test.expected) {
+			t.Errorf("for %q expected %#v, but got %#v, %v", test.reply, test.expected, reply, err)
+		}
+	}
+	for _, reply := range []string{"$9223372036854775807\r\nx", "$5000000000\r\nx", "$3\r\nfoobar\r\n", "$3\r\nfo"} {
+		if _, err := newTestRedisConnect([]byte(reply)).ReadReply(); err == nil {
+			t.Errorf("expected error for %q", reply)
+		}
+	}
+}
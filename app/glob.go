@@ -0,0 +1,93 @@
+package main
+
+import "unicode"
+
+// globMatch reports if s matches the glob-style pattern the way Redis does
+// for KEYS and CONFIG GET: "*" matches any sequence, "?" any character,
+// "[...]" a set of characters with ranges and "^" for negation, and "\"
+// escapes the next character.
+func globMatch(pattern, s string, nocase bool) bool {
+	return globMatchRunes([]rune(pattern), []rune(s), nocase)
+}
+
+func globMatchRunes(p, str []rune, nocase bool) bool {
+	equal := func(a, b rune) bool {
+		if nocase {
+			return unicode.ToLower(a) == unicode.ToLower(b)
+		}
+		return a == b
+	}
+	for len(p) > 0 {
+		switch p[0] {
+		case '*':
+			for len(p) > 1 && p[1] == '*' {
+				p = p[1:]
+			}
+			if len(p) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if globMatchRunes(p[1:], str[i:], nocase) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			p = p[1:]
+			not := len(p) > 0 && p[0] == '^'
+			if not {
+				p = p[1:]
+			}
+			match := false
+			for len(p) > 0 && p[0] != ']' {
+				switch {
+				case p[0] == '\\' && len(p) >= 2:
+					p = p[1:]
+					match = match || equal(p[0], str[0])
+				case len(p) >= 3 && p[1] == '-':
+					start, end := p[0], p[2]
+					if start > end {
+						start, end = end, start
+					}
+					c := str[0]
+					if nocase {
+						start, end, c = unicode.ToLower(start), unicode.ToLower(end), unicode.ToLower(c)
+					}
+					match = match || c >= start && c <= end
+					p = p[2:]
+				default:
+					match = match || equal(p[0], str[0])
+				}
+				p = p[1:]
+			}
+			if len(p) == 0 {
+				// the pattern ends without "]", treat it as the end of set
+				p = []rune{']'}
+			}
+			if match == not {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(p) >= 2 {
+				p = p[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || !equal(p[0], str[0]) {
+				return false
+			}
+			str = str[1:]
+		}
+		p = p[1:]
+	}
+	return len(str) == 0
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestGlobMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		s       string
+		nocase  bool
+		match   bool
+	}{
+		{"*", "", false, true},
+		{"*", "anything", false, true},
+		{"h?llo", "hello", false, true},
+		{"h?llo", "hllo", false, false},
+		{"h*llo", "heeeello", false, true},
+		{"h[ae]llo", "hallo", false, true},
+		{"h[ae]llo", "hillo", false, false},
+		{"h[^e]llo", "hallo", false, true},
+		{"h[^e]llo", "hello", false, false},
+		{"h[a-b]llo", "hbllo", false, true},
+		{"h[b-a]llo", "hallo", false, true},
+		{"h\\*llo", "h*llo", false, true},
+		{"h\\*llo", "hello", false, false},
+		{"maxmemory*", "maxmemory-policy", false, true},
+		{"DIR", "dir", true, true},
+		{"DIR", "dir", false, false},
+		{"*a*b", "xaxxb", false, true},
+		{"*a*b", "xaxxbc", false, false},
+		{"[abc", "a", false, true},
+	} {
+		if got := globMatch(test.pattern, test.s, test.nocase); got != test.match {
+			t.Errorf("globMatch(%q, %q, %v) = %v, expected %v", test.pattern, test.s, test.nocase, got, test.match)
+		}
+	}
+}
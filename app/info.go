@@ -1,49 +1,209 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+const redisVersion = "7.2.0"
+
 type RedisInfo struct {
+	persistence *Persistence
+	stats       statsInfo
 	replication replicationInfo
 }
 
+// genMasterReplId returns a new random replication id of 40 hex characters.
 func genMasterReplId() string {
-	return "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb"
+	return randomHex(40)
+}
+
+// randomHex returns n random hex characters, n must be even.
+func randomHex(n int) string {
+	buf := make([]byte, n/2)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
 }
 
-func NewRedisInfo(role string) RedisInfo {
+func NewRedisInfo(role string, replicas *ReplicasManager, master *RedisClient, persistence *Persistence) RedisInfo {
 	return RedisInfo{
-		replicationInfo{
+		persistence: persistence,
+		replication: replicationInfo{
 			role:             role,
 			masterReplId:     genMasterReplId(),
-			masterReplOffset: 0,
+			secondReplOffset: -1,
+			failoverState:    "no-failover",
+			replicas:         replicas,
+			master:           master,
 		},
 	}
 }
 
 func (info *RedisInfo) String() string {
-	return fmt.Sprintf("%s", &info.replication)
+	return fmt.Sprintf("%s\n%s\n%s", info.persistence, &info.stats, &info.replication)
+}
+
+// ResetStats resets the Stats section.
+func (info *RedisInfo) ResetStats() {
+	info.stats.Reset()
+}
+
+// Section returns the named INFO section or the whole INFO for "all",
+// "everything" and "default".
+func (info *RedisInfo) Section(name string) string {
+	switch strings.ToLower(name) {
+	case "all", "everything", "default":
+		return info.String()
+	case "persistence":
+		return info.persistence.String()
+	case "stats":
+		return info.stats.String()
+	case "replication":
+		return info.replication.String()
+	}
+	return ""
+}
+
+func (info *RedisInfo) GetRole() string {
+	info.replication.mu.RLock()
+	defer info.replication.mu.RUnlock()
+	return info.replication.role
+}
+
+// GetMaster returns the link with the master, it is nil on masters.
+func (info *RedisInfo) GetMaster() *RedisClient {
+	info.replication.mu.RLock()
+	defer info.replication.mu.RUnlock()
+	return info.replication.master
 }
 
 func (info *RedisInfo) GetMasterReplId() string {
+	info.replication.mu.RLock()
+	defer info.replication.mu.RUnlock()
 	return info.replication.masterReplId
 }
 
+// GetReplIds returns the replication ids the server can continue the stream
+// for. The previous id is valid only up to secondOffset.
+func (info *RedisInfo) GetReplIds() (replId, replId2 string, secondOffset int64) {
+	info.replication.mu.RLock()
+	defer info.replication.mu.RUnlock()
+	return info.replication.masterReplId, info.replication.masterReplId2, info.replication.secondReplOffset
+}
+
+// SetMasterReplId is used by replicas to take the replid of their master.
+func (info *RedisInfo) SetMasterReplId(replId string) {
+	info.replication.mu.Lock()
+	defer info.replication.mu.Unlock()
+	info.replication.masterReplId = replId
+}
+
+func (info *RedisInfo) SetFailoverState(state string) {
+	info.replication.mu.Lock()
+	defer info.replication.mu.Unlock()
+	info.replication.failoverState = state
+}
+
+// BecomeReplica switches the role to replica of master.
+func (info *RedisInfo) BecomeReplica(master *RedisClient) {
+	info.replication.mu.Lock()
+	defer info.replication.mu.Unlock()
+	info.replication.role = "slave"
+	info.replication.master = master
+}
+
+// BecomeMaster switches the role to master with a new replid. The old one is
+// kept as replid2, so replicas of the same master can continue the stream up
+// to offset.
+func (info *RedisInfo) BecomeMaster(offset int64) {
+	info.replication.mu.Lock()
+	defer info.replication.mu.Unlock()
+	info.replication.role = "master"
+	info.replication.master = nil
+	info.replication.masterReplId2 = info.replication.masterReplId
+	info.replication.secondReplOffset = offset + 1
+	info.replication.masterReplId = genMasterReplId()
+}
+
 type replicationInfo struct {
-	role             string
-	masterReplId     string
-	masterReplOffset int
+	mu           sync.RWMutex
+	role         string
+	masterReplId string
+	// masterReplId2 is the replid of the previous master, it is valid up to
+	// secondReplOffset
+	masterReplId2    string
+	secondReplOffset int64
+	// failoverState is the progress of FAILOVER
+	failoverState string
+	replicas      *ReplicasManager
+	// master is the link with the master on replicas
+	master *RedisClient
 }
 
 func (replication *replicationInfo) String() string {
+	replication.mu.RLock()
+	master := replication.master
+	replication.mu.RUnlock()
+	masterFields := ""
+	if master != nil {
+		masterFields = master.infoFields()
+	}
+	replicasFields := replication.replicas.infoFields()
+	backlogSize, firstByteOffset, histlen := replication.replicas.backlog.Stats()
+
+	replication.mu.RLock()
+	defer replication.mu.RUnlock()
+	replId2 := replication.masterReplId2
+	if replId2 == "" {
+		replId2 = strings.Repeat("0", 40)
+	}
 	return fmt.Sprintf(
 		`# Replication
 role:%s
+%s%smaster_failover_state:%s
 master_replid:%s
+master_replid2:%s
 master_repl_offset:%d
+second_repl_offset:%d
+repl_backlog_active:1
+repl_backlog_size:%d
+repl_backlog_first_byte_offset:%d
+repl_backlog_histlen:%d
 `, replication.role,
+		masterFields,
+		replicasFields,
+		replication.failoverState,
 		replication.masterReplId,
-		replication.masterReplOffset,
+		replId2,
+		replication.replicas.Offset(),
+		replication.secondReplOffset,
+		backlogSize,
+		firstByteOffset,
+		histlen,
+	)
+}
+
+type statsInfo struct {
+	clientQueryBufferLimitDisconnections  atomic.Int64
+	clientOutputBufferLimitDisconnections atomic.Int64
+}
+
+// Reset zeroes the counters for CONFIG RESETSTAT.
+func (stats *statsInfo) Reset() {
+	stats.clientQueryBufferLimitDisconnections.Store(0)
+	stats.clientOutputBufferLimitDisconnections.Store(0)
+}
+
+func (stats *statsInfo) String() string {
+	return fmt.Sprintf(
+		`# Stats
+client_query_buffer_limit_disconnections:%d
+client_output_buffer_limit_disconnections:%d
+`, stats.clientQueryBufferLimitDisconnections.Load(),
+		stats.clientOutputBufferLimitDisconnections.Load(),
 	)
 }
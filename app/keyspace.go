@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Keyspace is the dataset. Whole dataset operations, like taking a snapshot
+// or loading one, are atomic for single key operations.
+type Keyspace struct {
+	mu   sync.RWMutex
+	data map[string]ValueWithExpiration
+	// dirty counts changes of keys for the save points
+	dirty atomic.Int64
+}
+
+func NewKeyspace() *Keyspace {
+	return &Keyspace{
+		data: make(map[string]ValueWithExpiration),
+	}
+}
+
+func (ks *Keyspace) Load(key string) (ValueWithExpiration, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	value, ok := ks.data[key]
+	return value, ok
+}
+
+func (ks *Keyspace) Store(key string, value ValueWithExpiration) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.data[key] = value
+	ks.dirty.Add(1)
+}
+
+// CompareAndDelete deletes the key if it still holds old.
+func (ks *Keyspace) CompareAndDelete(key string, old ValueWithExpiration) bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if value, ok := ks.data[key]; !ok || value != old {
+		return false
+	}
+	delete(ks.data, key)
+	ks.dirty.Add(1)
+	return true
+}
+
+// Delete deletes the key, it tells if the key was there and if it was
+// expired.
+func (ks *Keyspace) Delete(key string) (deleted, expired bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	value, ok := ks.data[key]
+	if !ok {
+		return false, false
+	}
+	delete(ks.data, key)
+	ks.dirty.Add(1)
+	return true, value.IsExpired(time.Now())
+}
+
+// Dirty returns the number of changes made to the keys.
+func (ks *Keyspace) Dirty() int64 {
+	return ks.dirty.Load()
+}
+
+// Snapshot returns a point-in-time copy of the keys which aren't expired.
+func (ks *Keyspace) Snapshot() map[string]ValueWithExpiration {
+	data, _ := ks.SnapshotWithDirty()
+	return data
+}
+
+// SnapshotWithDirty returns Snapshot and the dirty counter at that point.
+func (ks *Keyspace) SnapshotWithDirty() (map[string]ValueWithExpiration, int64) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	now := time.Now()
+	res := make(map[string]ValueWithExpiration, len(ks.data))
+	for key, value := range ks.data {
+		if !value.IsExpired(now) {
+			res[key] = value
+		}
+	}
+	return res, ks.dirty.Load()
+}
+
+// Keys returns the keys which aren't expired and match the glob pattern.
+func (ks *Keyspace) Keys(pattern string) []string {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	now := time.Now()
+	var res []string
+	for key, value := range ks.data {
+		if !value.IsExpired(now) && globMatch(pattern, key, false) {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+// Replace swaps the whole dataset.
+func (ks *Keyspace) Replace(data map[string]ValueWithExpiration) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.data = data
+}
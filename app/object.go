@@ -0,0 +1,23 @@
+package main
+
+import "github.com/codecrafters-io/redis-starter-go/internal/rdb"
+
+// The values of the keyspace are the ones of RDB files, so snapshots and the
+// check-rdb tool share them.
+type (
+	ValueWithExpiration = rdb.Value
+	Object              = rdb.Object
+	ObjectType          = rdb.ObjectType
+	Stream              = rdb.Stream
+	StreamID            = rdb.StreamID
+	StreamEntry         = rdb.StreamEntry
+	StreamGroup         = rdb.StreamGroup
+)
+
+const (
+	ObjectList   = rdb.ObjectList
+	ObjectSet    = rdb.ObjectSet
+	ObjectZSet   = rdb.ObjectZSet
+	ObjectHash   = rdb.ObjectHash
+	ObjectStream = rdb.ObjectStream
+)
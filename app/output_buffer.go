@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ClientClass int
+
+const (
+	ClientClassNormal ClientClass = iota
+	ClientClassReplica
+	ClientClassPubSub
+)
+
+var errConnectionClosed = errors.New("connection is closed")
+
+type outputBufferLimit struct {
+	hard        int64
+	soft        int64
+	softSeconds int64
+}
+
+// outputBufferLimits holds client-output-buffer-limit for every client class.
+// Zero disables the corresponding limit.
+type outputBufferLimits [3]outputBufferLimit
+
+func (limits outputBufferLimits) String() string {
+	res := make([]string, 0, len(limits))
+	for class, name := range []string{"normal", "slave", "pubsub"} {
+		limit := limits[class]
+		res = append(res, fmt.Sprintf("%s %d %d %d", name, limit.hard, limit.soft, limit.softSeconds))
+	}
+	return strings.Join(res, " ")
+}
+
+// parseOutputBufferLimits parses one or more "<class> <hard limit> <soft
+// limit> <soft seconds>" groups, classes which aren't mentioned keep their
+// limits.
+func parseOutputBufferLimits(limits outputBufferLimits, s string) (outputBufferLimits, error) {
+	args := strings.Fields(s)
+	if len(args)%4 != 0 {
+		return limits, fmt.Errorf("wrong number of arguments in client-output-buffer-limit")
+	}
+	parsed := limits
+	for i := 0; i < len(args); i += 4 {
+		var class ClientClass
+		switch strings.ToLower(args[i]) {
+		case "normal":
+			class = ClientClassNormal
+		case "slave", "replica":
+			class = ClientClassReplica
+		case "pubsub":
+			class = ClientClassPubSub
+		default:
+			return limits, fmt.Errorf("invalid client class %q", args[i])
+		}
+		hard, err := parseMemory(args[i+1])
+		if err != nil {
+			return limits, err
+		}
+		soft, err := parseMemory(args[i+2])
+		if err != nil {
+			return limits, err
+		}
+		softSeconds, err := strconv.ParseInt(args[i+3], 10, 64)
+		if err != nil || softSeconds < 0 {
+			return limits, fmt.Errorf("invalid soft limit seconds %q", args[i+3])
+		}
+		parsed[class] = outputBufferLimit{hard: hard, soft: soft, softSeconds: softSeconds}
+	}
+	return parsed, nil
+}
+
+// outputBuffer keeps replies until the connection writer sends them, so
+// a slow reader never blocks the goroutine producing replies.
+type outputBuffer struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  []byte
+	spare    []byte
+	inFlight int
+	// closing asks the writer to flush pending replies and stop
+	closing bool
+	// dropped stops the writer without flushing
+	dropped bool
+	// suppressed drops replies because of CLIENT REPLY OFF or SKIP
+	suppressed         bool
+	softLimitReachedAt time.Time
+	done               chan struct{}
+}
+
+func newOutputBuffer() *outputBuffer {
+	out := &outputBuffer{done: make(chan struct{})}
+	out.cond = sync.NewCond(&out.mu)
+	return out
+}
+
+func (out *outputBuffer) size() int {
+	return len(out.pending) + out.inFlight
+}
+
+// limitReached checks the buffer against the limit of its client class and
+// returns the reason if the client must be disconnected.
+func (out *outputBuffer) limitReached(limit outputBufferLimit, now time.Time) string {
+	return limit.reached(int64(out.size()), &out.softLimitReachedAt, now)
+}
+
+// reached checks size against the limit. softLimitReachedAt keeps the time
+// the soft limit was reached between calls.
+func (limit outputBufferLimit) reached(size int64, softLimitReachedAt *time.Time, now time.Time) string {
+	if limit.hard > 0 && size >= limit.hard {
+		return "hard limit"
+	}
+	if limit.soft == 0 || size < limit.soft {
+		*softLimitReachedAt = time.Time{}
+		return ""
+	}
+	if softLimitReachedAt.IsZero() {
+		*softLimitReachedAt = now
+	}
+	if now.Sub(*softLimitReachedAt) >= time.Duration(limit.softSeconds)*time.Second {
+		return "soft limit"
+	}
+	return ""
+}
+
+func (rc *RedisConnect) Class() ClientClass {
+	if rc.IsReplica {
+		return ClientClassReplica
+	}
+	if rc.subscriptions.Load() > 0 {
+		return ClientClassPubSub
+	}
+	return ClientClassNormal
+}
+
+func (rc *RedisConnect) OutputBufferSize() int {
+	rc.output.mu.Lock()
+	defer rc.output.mu.Unlock()
+	return rc.output.size()
+}
+
+func (rc *RedisConnect) Send(msg string) error {
+	out := rc.output
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if out.closing || out.dropped {
+		return errConnectionClosed
+	}
+	if out.suppressed {
+		return nil
+	}
+	out.pending = append(out.pending, msg...)
+	if reason := out.limitReached(clientOutputBufferLimits.Get()[rc.Class()], time.Now()); reason != "" {
+		slog.Warn(
+			"client scheduled to be closed for overcoming of output buffer limits",
+			"client", rc.ID,
+			"addr", rc.Conn.RemoteAddr(),
+			"limit", reason,
+			"omem", out.size(),
+		)
+		redisInfo.stats.clientOutputBufferLimitDisconnections.Add(1)
+		out.dropped = true
+		out.pending = nil
+		out.cond.Broadcast()
+		rc.Conn.Close()
+		return fmt.Errorf("output buffer %s reached: %w", reason, errConnectionClosed)
+	}
+	out.cond.Broadcast()
+	return nil
+}
+
+// writeLoop sends buffered replies to the socket until the connection is
+// closed.
+func (rc *RedisConnect) writeLoop() {
+	out := rc.output
+	defer close(out.done)
+	defer clientsRegistry.Unregister(rc)
+	defer pubSub.UnsubscribeAll(rc)
+	for {
+		out.mu.Lock()
+		for len(out.pending) == 0 && !out.closing && !out.dropped {
+			out.cond.Wait()
+		}
+		if out.dropped || len(out.pending) == 0 {
+			out.mu.Unlock()
+			return
+		}
+		data := out.pending
+		out.pending, out.spare = out.spare, nil
+		out.inFlight = len(data)
+		out.mu.Unlock()
+
+		_, err := rc.Conn.Write(data)
+
+		out.mu.Lock()
+		out.inFlight = 0
+		out.spare = data[:0]
+		out.cond.Broadcast()
+		if err != nil {
+			slog.Debug("write to connection failed", "client", rc.ID, "err", err)
+			out.dropped = true
+			out.pending = nil
+			out.mu.Unlock()
+			rc.Conn.Close()
+			return
+		}
+		out.mu.Unlock()
+	}
+}
+
+// WaitDrained blocks until everything sent to the connection is written to
+// the socket.
+func (rc *RedisConnect) WaitDrained() error {
+	out := rc.output
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	for out.size() > 0 && !out.closing && !out.dropped {
+		out.cond.Wait()
+	}
+	if out.closing || out.dropped {
+		return errConnectionClosed
+	}
+	return nil
+}
+
+// Close flushes pending replies, waiting at most writeTimeout for a slow
+// reader, and closes the connection.
+func (rc *RedisConnect) Close() error {
+	out := rc.output
+	out.mu.Lock()
+	out.closing = true
+	out.cond.Broadcast()
+	out.mu.Unlock()
+
+	rc.Conn.SetWriteDeadline(time.Now().Add(rc.writeTimeout))
+	<-out.done
+	return rc.Conn.Close()
+}
+
+// Kill closes the connection dropping pending replies.
+func (rc *RedisConnect) Kill() {
+	out := rc.output
+	out.mu.Lock()
+	out.dropped = true
+	out.pending = nil
+	out.cond.Broadcast()
+	out.mu.Unlock()
+	rc.Conn.Close()
+}
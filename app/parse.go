@@ -42,7 +42,7 @@ func parseCommand(request []byte) (result []string, pos int, err error) {
 	pos = arrayInfoEnd + 2
 	for i := 0; i < length; i++ {
 		if pos >= len(request) {
-			return nil, 0, &ErrorNotAllParsed{"#%d element is not presented, but expected"}
+			return nil, 0, &ErrorNotAllParsed{fmt.Sprintf("#%d element is not presented, but expected", i)}
 		}
 		if request[pos] != '$' {
 			err = fmt.Errorf("expecting bulk string prefix '$' but got %c", request[pos])
@@ -57,7 +57,14 @@ func parseCommand(request []byte) (result []string, pos int, err error) {
 			err = fmt.Errorf("parsing length of %d token: %w", i, err)
 			return
 		}
+		if tokenLength < 0 {
+			err = fmt.Errorf("negative length of %d token", i)
+			return
+		}
 		tokenStartPos := pos + tokenInfoEnd + 2
+		if tokenLength > len(request)-tokenStartPos {
+			return nil, 0, &ErrorNotAllParsed{fmt.Sprintf("size of %d token is %d, but request ends", i, tokenLength)}
+		}
 		tokenEndPos := tokenStartPos + tokenLength
 		if tokenEndPos+2 > len(request) {
 			return nil, 0, &ErrorNotAllParsed{fmt.Sprintf("size of %d token is %d, but request ends", i, tokenLength)}
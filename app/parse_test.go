@@ -34,3 +34,22 @@ func TestParseCommand(t *testing.T) {
 		}
 	}
 }
+
+func FuzzParseCommand(f *testing.F) {
+	f.Add([]byte("*1\r\n$4\r\nPING\r\n"))
+	f.Add([]byte("*2\r\n$4\r\nECHO\r\n$3\r\nhey\r\n"))
+	f.Add([]byte("*1\r\n$-5\r\nPING\r\n"))
+	f.Add([]byte("*1\r\n$9223372036854775807\r\n"))
+	f.Fuzz(func(t *testing.T, request []byte) {
+		result, pos, err := parseCommand(request)
+		if err != nil {
+			return
+		}
+		if pos > len(request) {
+			t.Errorf("parsed %d bytes of %d byte request %q", pos, len(request), request)
+		}
+		if len(result) > len(request) {
+			t.Errorf("parsed %d tokens from %d byte request %q", len(result), len(request), request)
+		}
+	})
+}
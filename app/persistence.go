@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	persistenceCronPeriod = 100 * time.Millisecond
+	// bgsaveRetryDelay is how long save points wait after a failed BGSAVE
+	bgsaveRetryDelay = 5 * time.Second
+)
+
+var (
+	errBgsaveInProgress = errors.New("ERR Background save already in progress")
+	errAOFDisabled      = errors.New("ERR Background append only file rewriting requires appendonly yes")
+)
+
+// savePoint asks for a snapshot when at least changes keys changed in the
+// last seconds.
+type savePoint struct {
+	seconds int
+	changes int64
+}
+
+type savePoints []savePoint
+
+func (points savePoints) String() string {
+	items := make([]string, 0, 2*len(points))
+	for _, point := range points {
+		items = append(items, strconv.Itoa(point.seconds), strconv.FormatInt(point.changes, 10))
+	}
+	return strings.Join(items, " ")
+}
+
+// parseSavePoints parses pairs of seconds and changes, an empty string
+// disables automatic snapshots. The points replace the old ones, the save
+// lines of the config file are merged before.
+func parseSavePoints(_ savePoints, s string) (savePoints, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save points %q", s)
+	}
+	res := savePoints{}
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid save point seconds %q", fields[i])
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid save point changes %q", fields[i+1])
+		}
+		res = append(res, savePoint{seconds, changes})
+	}
+	return res, nil
+}
+
+// parseDBFilename accepts a file name, the RDB file is always in dir.
+func parseDBFilename(_ string, s string) (string, error) {
+	if s == "" || filepath.Base(s) != s {
+		return "", errors.New("dbfilename can't be a path, just a filename")
+	}
+	return s, nil
+}
+
+// Persistence takes RDB snapshots of the keyspace, on SAVE and BGSAVE and
+// when a save point is reached, and logs writes to the AOF.
+type Persistence struct {
+	values *Keyspace
+	// path returns the RDB file to write, it is read for every snapshot
+	path func() string
+
+	mu sync.Mutex
+	// aof is nil when appendonly is off
+	aof              *AppendOnlyFile
+	bgsaveInProgress bool
+	bgsaveStart      time.Time
+	// bgsaveScheduled is set by BGSAVE SCHEDULE while a snapshot is taken
+	bgsaveScheduled bool
+	lastBgsaveTry   time.Time
+	lastBgsaveOK    bool
+	// lastBgsaveDuration is -1 until the first BGSAVE finishes
+	lastBgsaveDuration time.Duration
+	lastSave           time.Time
+	// lastSaveDirty is the dirty counter of the keyspace when the last
+	// snapshot was taken
+	lastSaveDirty int64
+	saves         int
+}
+
+func NewPersistence(values *Keyspace, path func() string) *Persistence {
+	return &Persistence{
+		values:             values,
+		path:               path,
+		lastBgsaveOK:       true,
+		lastBgsaveDuration: -1,
+		lastSave:           time.Now(),
+		lastSaveDirty:      values.Dirty(),
+	}
+}
+
+func (p *Persistence) SetAOF(aof *AppendOnlyFile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.aof = aof
+}
+
+// FeedAOF logs a write which changed the keyspace, it must be called with
+// writeMu held so the AOF has writes in the order they were applied.
+func (p *Persistence) FeedAOF(args []string) {
+	p.mu.Lock()
+	aof := p.aof
+	p.mu.Unlock()
+	if aof != nil {
+		aof.Feed(args)
+	}
+}
+
+// RewriteAOF starts a rewrite of the AOF.
+func (p *Persistence) RewriteAOF() error {
+	p.mu.Lock()
+	aof := p.aof
+	p.mu.Unlock()
+	if aof == nil {
+		return errAOFDisabled
+	}
+	return aof.Rewrite()
+}
+
+// Run checks the save points, scheduled BGSAVEs and the growth of the AOF
+// until the process exits.
+func (p *Persistence) Run(points *configValue[savePoints], rewritePercentage *configValue[int], rewriteMinSize *configValue[int64]) {
+	ticker := time.NewTicker(persistenceCronPeriod)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		p.cron(now, points.Get(), rewritePercentage.Get(), rewriteMinSize.Get())
+	}
+}
+
+func (p *Persistence) cron(now time.Time, points savePoints, rewritePercentage int, rewriteMinSize int64) {
+	p.mu.Lock()
+	changes := p.values.Dirty() - p.lastSaveDirty
+	due := false
+	for _, point := range points {
+		if changes >= point.changes && now.Sub(p.lastSave) >= time.Duration(point.seconds)*time.Second {
+			due = true
+		}
+	}
+	// a failed snapshot is retried only after a delay
+	due = due && (p.lastBgsaveOK || now.Sub(p.lastBgsaveTry) > bgsaveRetryDelay)
+	start := !p.bgsaveInProgress && (p.bgsaveScheduled || due)
+	if start && due {
+		slog.Info("Saving", "changes", changes)
+	}
+	aof := p.aof
+	p.mu.Unlock()
+	if start {
+		if err := p.Bgsave(); err != nil && !errors.Is(err, errBgsaveInProgress) {
+			slog.Warn("Failed to start BGSAVE", "err", err)
+		}
+	}
+	if aof != nil && aof.RewriteNeeded(rewritePercentage, rewriteMinSize, now) {
+		slog.Info("Starting automatic rewriting of AOF")
+		if err := aof.Rewrite(); err != nil && !errors.Is(err, errAOFRewriteInProgress) {
+			slog.Warn("Failed to start AOF rewrite", "err", err)
+		}
+	}
+}
+
+// Save writes a snapshot and returns when it is on disk. Like in Redis it
+// blocks the other snapshots meanwhile.
+func (p *Persistence) Save() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bgsaveInProgress {
+		return errBgsaveInProgress
+	}
+	data, dirty := p.values.SnapshotWithDirty()
+	if err := saveRDBFile(p.path(), data); err != nil {
+		return err
+	}
+	p.saved(dirty)
+	return nil
+}
+
+// Bgsave takes a point-in-time copy of the keyspace and writes it in the
+// background, commands keep running meanwhile.
+func (p *Persistence) Bgsave() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bgsaveInProgress {
+		return errBgsaveInProgress
+	}
+	p.bgsaveInProgress = true
+	p.bgsaveScheduled = false
+	p.bgsaveStart = time.Now()
+	p.lastBgsaveTry = p.bgsaveStart
+	data, dirty := p.values.SnapshotWithDirty()
+	path := p.path()
+	go func() {
+		err := saveRDBFile(path, data)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.bgsaveInProgress = false
+		p.lastBgsaveOK = err == nil
+		p.lastBgsaveDuration = time.Since(p.bgsaveStart)
+		if err != nil {
+			slog.Warn("Background saving error", "err", err)
+			return
+		}
+		slog.Info("Background saving terminated with success", "path", path)
+		p.saved(dirty)
+	}()
+	return nil
+}
+
+// ScheduleBgsave starts a BGSAVE, or runs it after the one in progress.
+// It tells if the BGSAVE was only scheduled.
+func (p *Persistence) ScheduleBgsave() (bool, error) {
+	p.mu.Lock()
+	if p.bgsaveInProgress {
+		p.bgsaveScheduled = true
+		p.mu.Unlock()
+		return true, nil
+	}
+	p.mu.Unlock()
+	return false, p.Bgsave()
+}
+
+// saved records a snapshot taken at the dirty counter, mu must be held. A
+// snapshot older than the last one is only counted.
+func (p *Persistence) saved(dirty int64) {
+	p.saves++
+	if dirty < p.lastSaveDirty {
+		return
+	}
+	p.lastSave = time.Now()
+	p.lastSaveDirty = dirty
+}
+
+// LastSave returns the time of the last successful snapshot, it is the start
+// time before the first one.
+func (p *Persistence) LastSave() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastSave
+}
+
+func (p *Persistence) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	inProgress, current := 0, int64(-1)
+	if p.bgsaveInProgress {
+		inProgress, current = 1, int64(time.Since(p.bgsaveStart).Seconds())
+	}
+	status := "ok"
+	if !p.lastBgsaveOK {
+		status = "err"
+	}
+	aofEnabled := 0
+	if p.aof != nil {
+		aofEnabled = 1
+	}
+	lastDuration := int64(-1)
+	if p.lastBgsaveDuration >= 0 {
+		lastDuration = int64(p.lastBgsaveDuration.Seconds())
+	}
+	return fmt.Sprintf(
+		`# Persistence
+loading:0
+rdb_changes_since_last_save:%d
+rdb_bgsave_in_progress:%d
+rdb_last_save_time:%d
+rdb_last_bgsave_status:%s
+rdb_last_bgsave_time_sec:%d
+rdb_current_bgsave_time_sec:%d
+rdb_saves:%d
+aof_enabled:%d
+%s`, p.values.Dirty()-p.lastSaveDirty,
+		inProgress,
+		p.lastSave.Unix(),
+		status,
+		lastDuration,
+		current,
+		p.saves,
+		aofEnabled,
+		p.aof.infoFields(),
+	)
+}
+
+// saveRDBFile writes the dataset to a temporary file next to path and
+// renames it, so path always holds a complete snapshot.
+func saveRDBFile(path string, data map[string]ValueWithExpiration) error {
+	file, err := os.CreateTemp(filepath.Dir(path), fmt.Sprintf("temp-%d-*.rdb", os.Getpid()))
+	if err != nil {
+		return fmt.Errorf("creating temp RDB file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if err := writeRDB(file, data); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("syncing RDB: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("closing RDB: %w", err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("renaming temp RDB file: %w", err)
+	}
+	return nil
+}
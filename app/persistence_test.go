@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/rdb"
+)
+
+// readRDBKeys returns the keys of the RDB file at path.
+func readRDBKeys(t *testing.T, path string) map[string]rdb.Value {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data, err := rdb.Read(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSaveReplacesFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dump.rdb")
+	ks := NewKeyspace()
+	p := NewPersistence(ks, func() string { return path })
+	ks.Store("a", ValueWithExpiration{Value: "1"})
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	ks.Store("b", ValueWithExpiration{Value: "2"})
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if data := readRDBKeys(t, path); len(data) != 2 {
+		t.Errorf("expected a and b saved, but got %v", data)
+	}
+	if temps, _ := filepath.Glob(filepath.Join(dir, "temp-*")); len(temps) != 0 {
+		t.Errorf("expected no temp files left, but got %v", temps)
+	}
+
+	// a failed rename keeps what was there and removes the temp file
+	blocked := filepath.Join(dir, "blocked")
+	if err := os.MkdirAll(filepath.Join(blocked, "inside"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	p.path = func() string { return blocked }
+	if err := p.Save(); err == nil {
+		t.Errorf("expected error renaming over a directory")
+	}
+	if temps, _ := filepath.Glob(filepath.Join(dir, "temp-*")); len(temps) != 0 {
+		t.Errorf("expected the temp file removed, but got %v", temps)
+	}
+}
+
+func TestSavePoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	ks := NewKeyspace()
+	p := NewPersistence(ks, func() string { return path })
+	points := savePoints{{seconds: 1, changes: 1}}
+	start := p.LastSave()
+
+	// nothing changed
+	p.cron(start.Add(2*time.Second), points, 0, 0)
+	ks.Store("a", ValueWithExpiration{Value: "1"})
+	// too early
+	p.cron(start, points, 0, 0)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected no snapshot before the save point, but got %v", err)
+	}
+
+	p.cron(start.Add(2*time.Second), points, 0, 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for p.LastSave().Equal(start) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if data := readRDBKeys(t, path); len(data) != 1 {
+		t.Errorf("expected a saved at the save point, but got %v", data)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bgsaveInProgress || p.lastSaveDirty != ks.Dirty() {
+		t.Errorf("expected the snapshot recorded at dirty %d, but got %d", ks.Dirty(), p.lastSaveDirty)
+	}
+
+	// an older snapshot doesn't move the last save back
+	lastSave := p.lastSave
+	p.saved(0)
+	if p.lastSave != lastSave || p.lastSaveDirty != ks.Dirty() || p.saves != 2 {
+		t.Errorf("expected the last save kept after an older snapshot, but got dirty %d", p.lastSaveDirty)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "sync"
+
+// writeMu serializes writes with their propagation. It is also held while
+// the snapshot for a replica is taken, so the snapshot matches the offset.
+var writeMu sync.Mutex
+
+// propagate appends a write executed by conn to the replication stream. It's
+// the only way for writes to get to replicas, it must be called with writeMu
+// held.
+func propagate(conn *RedisConnect, args []string) {
+	conn.writeOffset = replicasManager.LogCommand(args[0], args[1:]...)
+}
+
+// expireKey deletes a key a master found expired and propagates a DEL, so
+// replicas and the AOF drop it too. While writes are paused the key stays,
+// like the writes it would be expired later.
+func expireKey(values *Keyspace, key string, value ValueWithExpiration) {
+	if clientsRegistry.WritesPaused() {
+		return
+	}
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	if values.CompareAndDelete(key, value) {
+		replicasManager.LogCommand("DEL", key)
+		persistence.FeedAOF([]string{"DEL", key})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// useTestReplication replaces the replication stream and the persistence of
+// the server for the test, it returns the backlog of the stream.
+func useTestReplication(t *testing.T, ks *Keyspace) *ReplicationBacklog {
+	oldReplicas, oldPersistence := replicasManager, persistence
+	t.Cleanup(func() { replicasManager, persistence = oldReplicas, oldPersistence })
+	backlog := NewReplicationBacklog(1024 * 1024)
+	replicasManager = NewReplicasManager(backlog, ks)
+	persistence = NewPersistence(ks, func() string { return "" })
+	return backlog
+}
+
+func TestExecutePropagatesChanges(t *testing.T) {
+	ks := NewKeyspace()
+	backlog := useTestReplication(t, ks)
+	commands := map[string]CommandEntry{
+		"set": {CommandSet{values: ks}, FlagWrite},
+		"get": {CommandGet{values: ks}, FlagReadonly | FlagFast},
+		"del": {CommandDel{values: ks}, FlagWrite},
+	}
+	run := func(source CommandSourceType, args ...string) {
+		if err := execute(slog.Default(), commands, NewFakeRedisConnect(), source, args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream := func() string {
+		data, _ := backlog.Since(1)
+		return string(data)
+	}
+
+	run(UserToMaster, "SET", "a", "1")
+	// deleting nothing changes nothing
+	run(UserToMaster, "DEL", "missing")
+	expected := respCommand("SET", "a", "1")
+	if stream() != expected {
+		t.Errorf("expected %q, but got %q", expected, stream())
+	}
+
+	run(UserToMaster, "SET", "b", "2", "PXAT", "1")
+	expected += respCommand("SET", "b", "2", "PXAT", "1")
+	// replicas and paused writes leave expired keys to later
+	run(UserToReplica, "GET", "b")
+	clientsRegistry.Pause(time.Minute, false)
+	run(UserToMaster, "GET", "b")
+	clientsRegistry.Unpause()
+	if _, ok := ks.Load("b"); !ok || stream() != expected {
+		t.Errorf("expected b kept and %q, but got %v and %q", expected, ok, stream())
+	}
+
+	// the master deletes the key it finds expired for everyone
+	run(UserToMaster, "GET", "b")
+	expected += respCommand("DEL", "b")
+	if _, ok := ks.Load("b"); ok || stream() != expected {
+		t.Errorf("expected b deleted and %q, but got %v and %q", expected, ok, stream())
+	}
+}
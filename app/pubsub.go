@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// PubSub keeps channel subscriptions of clients.
+type PubSub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*RedisConnect]struct{}
+	clients  map[*RedisConnect]map[string]struct{}
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels: make(map[string]map[*RedisConnect]struct{}),
+		clients:  make(map[*RedisConnect]map[string]struct{}),
+	}
+}
+
+// Subscribe adds channel to the subscriptions of conn and returns how many
+// channels conn is subscribed to.
+func (ps *PubSub) Subscribe(conn *RedisConnect, channel string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.channels[channel] == nil {
+		ps.channels[channel] = make(map[*RedisConnect]struct{})
+	}
+	if ps.clients[conn] == nil {
+		ps.clients[conn] = make(map[string]struct{})
+	}
+	ps.channels[channel][conn] = struct{}{}
+	ps.clients[conn][channel] = struct{}{}
+	conn.subscriptions.Store(int32(len(ps.clients[conn])))
+	return len(ps.clients[conn])
+}
+
+// Unsubscribe removes channel from the subscriptions of conn and returns how
+// many channels conn is still subscribed to.
+func (ps *PubSub) Unsubscribe(conn *RedisConnect, channel string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.unsubscribe(conn, channel)
+	return len(ps.clients[conn])
+}
+
+func (ps *PubSub) unsubscribe(conn *RedisConnect, channel string) {
+	delete(ps.channels[channel], conn)
+	if len(ps.channels[channel]) == 0 {
+		delete(ps.channels, channel)
+	}
+	delete(ps.clients[conn], channel)
+	conn.subscriptions.Store(int32(len(ps.clients[conn])))
+	if len(ps.clients[conn]) == 0 {
+		delete(ps.clients, conn)
+	}
+}
+
+// Channels returns the channels conn is subscribed to.
+func (ps *PubSub) Channels(conn *RedisConnect) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	res := make([]string, 0, len(ps.clients[conn]))
+	for channel := range ps.clients[conn] {
+		res = append(res, channel)
+	}
+	return res
+}
+
+// UnsubscribeAll drops the subscriptions of a closed connection.
+func (ps *PubSub) UnsubscribeAll(conn *RedisConnect) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for channel := range ps.clients[conn] {
+		ps.unsubscribe(conn, channel)
+	}
+}
+
+// Publish sends message to the subscribers of channel and returns how many
+// clients got it.
+func (ps *PubSub) Publish(channel, message string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	for conn := range ps.channels[channel] {
+		conn.Send(respPush(conn.Protocol, respBulkString("message"), respBulkString(channel), respBulkString(message)))
+	}
+	return len(ps.channels[channel])
+}
+
+// subscribedContextCommands are the only commands a RESP2 client can run
+// while it's subscribed, its connection carries messages instead of replies.
+var subscribedContextCommands = map[string]bool{
+	"subscribe":   true,
+	"unsubscribe": true,
+	"ping":        true,
+	"quit":        true,
+	"reset":       true,
+}
+
+type CommandSubscribe struct {
+	pubsub *PubSub
+}
+
+func (cmdSubscribe CommandSubscribe) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+	if len(args) == 0 {
+		return sendError(conn, "ERR wrong number of arguments for 'subscribe' command")
+	}
+	for _, channel := range args {
+		count := cmdSubscribe.pubsub.Subscribe(conn, channel)
+		err := conn.Send(respPush(conn.Protocol, respBulkString("subscribe"), respBulkString(channel), respInt(count)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type CommandUnsubscribe struct {
+	pubsub *PubSub
+}
+
+func (cmdUnsubscribe CommandUnsubscribe) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+	channels := args
+	if len(channels) == 0 {
+		channels = cmdUnsubscribe.pubsub.Channels(conn)
+	}
+	if len(channels) == 0 {
+		return conn.Send(respPush(conn.Protocol, respBulkString("unsubscribe"), respNull(conn.Protocol), respInt(0)))
+	}
+	for _, channel := range channels {
+		count := cmdUnsubscribe.pubsub.Unsubscribe(conn, channel)
+		err := conn.Send(respPush(conn.Protocol, respBulkString("unsubscribe"), respBulkString(channel), respInt(count)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type CommandPublish struct {
+	pubsub *PubSub
+}
+
+func (cmdPublish CommandPublish) Call(conn *RedisConnect, _ CommandSourceType, args ...string) error {
+	if len(args) != 2 {
+		return sendError(conn, "ERR wrong number of arguments for 'publish' command")
+	}
+	return conn.Send(respInt(cmdPublish.pubsub.Publish(args[0], args[1])))
+}
+
+// subscribedContextError is the reply to commands not allowed while a RESP2
+// client is subscribed.
+func subscribedContextError(name string) string {
+	return fmt.Sprintf(
+		"ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context",
+		strings.ToLower(name),
+	)
+}
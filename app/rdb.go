@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/rdb"
+)
+
+// rdbEOFMarkSize is the size of the random string which ends a diskless
+// snapshot of unknown size.
+const rdbEOFMarkSize = 40
+
+// writeRDB serializes the dataset with the aux fields of this server.
+func writeRDB(w io.Writer, data map[string]ValueWithExpiration) error {
+	return rdb.Write(w, data, rdbAuxFields(false)...)
+}
+
+// rdbAuxFields returns the aux fields of snapshots, aofBase is set for the
+// base files of the AOF.
+func rdbAuxFields(aofBase bool) []rdb.AuxField {
+	base := "0"
+	if aofBase {
+		base = "1"
+	}
+	return []rdb.AuxField{
+		{Key: "redis-ver", Value: redisVersion},
+		{Key: "redis-bits", Value: "64"},
+		{Key: "ctime", Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		{Key: "aof-base", Value: base},
+	}
+}
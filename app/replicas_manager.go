@@ -1,51 +1,446 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+type replica struct {
+	conn *RedisConnect
+	// online is false while the snapshot is being sent
+	online bool
+	// stream keeps the writes made while the snapshot is being sent, it is
+	// limited like an output buffer. Online replicas get the stream in their
+	// output buffer.
+	stream             []byte
+	softLimitReachedAt time.Time
+	// ackOffset is the offset from the last REPLCONF ACK
+	ackOffset int64
+	ackTime   time.Time
+}
+
 type ReplicasManager struct {
-	replicasConn      []*RedisConnect
+	replicas          []*replica
 	replicasConnMutex sync.RWMutex
-	replicasCommands  chan []string
+	backlog           *ReplicationBacklog
+	values            *Keyspace
+	// acksChanged is closed and replaced on every REPLCONF ACK
+	acksChanged chan struct{}
 }
 
-func NewReplicasManager() *ReplicasManager {
+func NewReplicasManager(backlog *ReplicationBacklog, values *Keyspace) *ReplicasManager {
 	return &ReplicasManager{
-		replicasCommands: make(chan []string),
+		backlog:     backlog,
+		values:      values,
+		acksChanged: make(chan struct{}),
 	}
 }
 
 func (rm *ReplicasManager) GetReplicasCount() int {
-	return len(rm.replicasConn)
+	rm.replicasConnMutex.RLock()
+	defer rm.replicasConnMutex.RUnlock()
+	return len(rm.replicas)
 }
 
-func (rm *ReplicasManager) RegisterReplica(conn *RedisConnect) {
+// registerReplica registers a replica which gets the stream from now on,
+// it must be called with replicasConnMutex locked.
+func (rm *ReplicasManager) registerReplica(conn *RedisConnect, online bool) *replica {
 	slog.Debug("new replica registered")
+	released := conn.Borrow()
+	conn.infoMu.Lock()
+	conn.IsReplica = true
+	conn.infoMu.Unlock()
+	r := &replica{
+		conn:    conn,
+		ackTime: time.Now(),
+	}
+	rm.replicas = append(rm.replicas, r)
+	if online {
+		rm.setOnline(r)
+	}
+	go func() {
+		<-released
+		rm.readAcks(r)
+	}()
+	return r
+}
+
+// setOnline moves the stream kept during the snapshot to the output buffer
+// of the replica, the next writes go there too. It must be called with
+// replicasConnMutex locked.
+func (rm *ReplicasManager) setOnline(r *replica) {
+	r.online = true
+	data := r.stream
+	r.stream, r.softLimitReachedAt = nil, time.Time{}
+	if len(data) > 0 {
+		rm.sendStream(r, data)
+	}
+}
+
+// sendStream appends data to the output buffer of an online replica, it must
+// be called with replicasConnMutex locked.
+func (rm *ReplicasManager) sendStream(r *replica, data []byte) {
+	if err := r.conn.Send(string(data)); err != nil {
+		slog.Warn("writing to replica failed", "client", r.conn.ID, "err", err)
+		rm.removeReplica(r)
+	}
+}
+
+// unregisterReplica forgets the replica and closes its connection, it's safe
+// to call it more than once.
+func (rm *ReplicasManager) unregisterReplica(r *replica) {
 	rm.replicasConnMutex.Lock()
 	defer rm.replicasConnMutex.Unlock()
-	rm.replicasConn = append(rm.replicasConn, conn)
-	conn.IsBorrowed = true
+	rm.removeReplica(r)
+}
+
+// removeReplica must be called with replicasConnMutex locked.
+func (rm *ReplicasManager) removeReplica(r *replica) {
+	for i := range rm.replicas {
+		if rm.replicas[i] == r {
+			rm.replicas = append(rm.replicas[:i], rm.replicas[i+1:]...)
+			r.conn.Kill()
+			slog.Info("replica unregistered", "client", r.conn.ID)
+			return
+		}
+	}
+}
+
+// readAcks handles REPLCONF ACK sent by the replica.
+func (rm *ReplicasManager) readAcks(r *replica) {
+	defer rm.unregisterReplica(r)
+	for {
+		cmd, err := r.conn.ReadCommand()
+		if err != nil {
+			slog.Warn("reading from replica failed", "client", r.conn.ID, "err", err)
+			return
+		}
+		if len(cmd) < 3 || strings.ToLower(cmd[0]) != "replconf" || strings.ToLower(cmd[1]) != "ack" {
+			slog.Debug("unexpected command from replica", "cmd", cmd)
+			continue
+		}
+		offset, err := strconv.ParseInt(cmd[2], 10, 64)
+		if err != nil {
+			slog.Warn("wrong offset in REPLCONF ACK", "cmd", cmd)
+			continue
+		}
+		rm.replicasConnMutex.Lock()
+		r.ackOffset, r.ackTime = offset, time.Now()
+		close(rm.acksChanged)
+		rm.acksChanged = make(chan struct{})
+		rm.replicasConnMutex.Unlock()
+	}
+}
+
+// infoFields returns connected_slaves and a line per replica for INFO
+// replication.
+func (rm *ReplicasManager) infoFields() string {
+	rm.replicasConnMutex.RLock()
+	defer rm.replicasConnMutex.RUnlock()
+	var res strings.Builder
+	fmt.Fprintf(&res, "connected_slaves:%d\n", len(rm.replicas))
+	if minReplicasToWrite.Get() > 0 && minReplicasMaxLag.Get() > 0 {
+		fmt.Fprintf(&res, "min_slaves_good_slaves:%d\n", rm.goodReplicas(time.Now()))
+	}
+	for i, r := range rm.replicas {
+		ip, _, _ := net.SplitHostPort(r.conn.Conn.RemoteAddr().String())
+		r.conn.infoMu.Lock()
+		port := r.conn.listeningPort
+		r.conn.infoMu.Unlock()
+		state := "online"
+		if !r.online {
+			state = "wait_bgsave"
+		}
+		fmt.Fprintf(&res, "slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\n",
+			i, ip, port, state, r.ackOffset, int(time.Since(r.ackTime).Seconds()))
+	}
+	return res.String()
+}
+
+// address is the address the replica listens on.
+func (r *replica) address() string {
+	ip, _, _ := net.SplitHostPort(r.conn.Conn.RemoteAddr().String())
+	r.conn.infoMu.Lock()
+	defer r.conn.infoMu.Unlock()
+	return net.JoinHostPort(ip, strconv.Itoa(r.conn.listeningPort))
+}
+
+// FindReplica reports if a replica listens on address and if it's online.
+func (rm *ReplicasManager) FindReplica(address string) (found, online bool) {
+	rm.replicasConnMutex.RLock()
+	defer rm.replicasConnMutex.RUnlock()
+	for _, r := range rm.replicas {
+		if r.address() == address {
+			return true, r.online
+		}
+	}
+	return false, false
+}
+
+// CaughtUpReplica returns the address of an online replica which acked the
+// whole stream. With non-empty address only that replica is checked.
+func (rm *ReplicasManager) CaughtUpReplica(address string) (string, bool) {
+	rm.replicasConnMutex.RLock()
+	defer rm.replicasConnMutex.RUnlock()
+	offset := rm.backlog.Offset()
+	for _, r := range rm.replicas {
+		if !r.online || r.ackOffset < offset {
+			continue
+		}
+		if replicaAddress := r.address(); address == "" || replicaAddress == address {
+			return replicaAddress, true
+		}
+	}
+	return "", false
+}
+
+// goodReplicas counts online replicas which acked within min-replicas-max-lag,
+// it must be called with replicasConnMutex locked.
+func (rm *ReplicasManager) goodReplicas(now time.Time) int {
+	good := 0
+	for _, r := range rm.replicas {
+		if r.online && now.Sub(r.ackTime) <= time.Duration(minReplicasMaxLag.Get())*time.Second {
+			good++
+		}
+	}
+	return good
 }
 
-func (rm *ReplicasManager) LogCommand(cmd string, args ...string) {
-	cmds := make([]string, 0, len(args)+1)
-	cmds = append(cmds, cmd)
-	cmds = append(cmds, args...)
-	rm.replicasCommands <- cmds
+// EnoughGoodReplicas reports if writes are allowed by min-replicas-to-write.
+func (rm *ReplicasManager) EnoughGoodReplicas() bool {
+	if minReplicasToWrite.Get() <= 0 || minReplicasMaxLag.Get() <= 0 {
+		return true
+	}
+	rm.replicasConnMutex.RLock()
+	defer rm.replicasConnMutex.RUnlock()
+	return rm.goodReplicas(time.Now()) >= minReplicasToWrite.Get()
 }
 
-func (rm *ReplicasManager) NotifyReplicas() {
-	for cmds := range rm.replicasCommands {
-		func() {
-			rm.replicasConnMutex.RLock()
-			defer rm.replicasConnMutex.RUnlock()
-			for i, conn := range rm.replicasConn {
-				// TODO: non-blocking ??
-				slog.Debug("notify replica", "replica_id", i)
-				conn.SendCommand(cmds[0], cmds[1:]...)
-			}
-		}()
+// countAcked must be called with replicasConnMutex locked.
+func (rm *ReplicasManager) countAcked(offset int64) int {
+	acked := 0
+	for _, r := range rm.replicas {
+		if r.ackOffset >= offset {
+			acked++
+		}
+	}
+	return acked
+}
+
+// WaitForAcks blocks until numReplicas replicas acknowledge offset or the
+// timeout fires, zero timeout waits forever. It returns the number of
+// replicas that acknowledged the offset.
+func (rm *ReplicasManager) WaitForAcks(offset int64, numReplicas int, timeout time.Duration) int {
+	rm.replicasConnMutex.RLock()
+	acked := rm.countAcked(offset)
+	rm.replicasConnMutex.RUnlock()
+	if acked >= numReplicas {
+		return acked
+	}
+	// the stream has the commands in the order they were applied
+	writeMu.Lock()
+	rm.LogCommand("REPLCONF", "GETACK", "*")
+	writeMu.Unlock()
+
+	var timeoutC <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+	for {
+		rm.replicasConnMutex.RLock()
+		acked := rm.countAcked(offset)
+		acksChanged := rm.acksChanged
+		rm.replicasConnMutex.RUnlock()
+		if acked >= numReplicas {
+			return acked
+		}
+		select {
+		case <-acksChanged:
+		case <-timeoutC:
+			return acked
+		}
+	}
+}
+
+func (rm *ReplicasManager) Offset() int64 {
+	return rm.backlog.Offset()
+}
+
+// FullResync sends the snapshot to the replica and registers it to get the
+// stream from the snapshot offset. Writes made while the snapshot is being
+// sent are buffered and sent after it.
+func (rm *ReplicasManager) FullResync(conn *RedisConnect, replId string) error {
+	writeMu.Lock()
+	rm.replicasConnMutex.Lock()
+	offset := rm.backlog.Offset()
+	snapshot := rm.values.Snapshot()
+	r := rm.registerReplica(conn, false)
+	rm.replicasConnMutex.Unlock()
+	writeMu.Unlock()
+
+	err := conn.Send(respString(fmt.Sprintf("FULLRESYNC %s %d", replId, offset)))
+	if err != nil {
+		return fmt.Errorf("can't return FULLRESYNC answer: %w", err)
+	}
+	if replDisklessSync.Get() && conn.capaEOF {
+		err = sendRDBDiskless(conn, snapshot)
+	} else {
+		var rdb bytes.Buffer
+		if err = writeRDB(&rdb, snapshot); err != nil {
+			return fmt.Errorf("can't serialize RDB snapshot: %w", err)
+		}
+		err = conn.Send(fmt.Sprintf("$%d\r\n%s", rdb.Len(), rdb.Bytes()))
+	}
+	if err != nil {
+		return fmt.Errorf("can't send RDB snapshot: %w", err)
+	}
+	slog.Info("synchronization with replica succeeded", "offset", offset, "keys", len(snapshot))
+
+	rm.replicasConnMutex.Lock()
+	defer rm.replicasConnMutex.Unlock()
+	rm.setOnline(r)
+	return nil
+}
+
+// sendRDBDiskless streams the snapshot to the socket while it is serialized.
+// The size isn't known in advance, so it's sent as $EOF:<mark> and the
+// snapshot is followed by the mark.
+func sendRDBDiskless(conn *RedisConnect, snapshot map[string]ValueWithExpiration) error {
+	// nothing else is sent to a replica until it's online, once the
+	// FULLRESYNC reply is written the socket is ours
+	if err := conn.WaitDrained(); err != nil {
+		return err
+	}
+	defer conn.Conn.SetWriteDeadline(time.Time{})
+	mark := randomHex(rdbEOFMarkSize)
+	w := bufio.NewWriter(progressWriter{conn.Conn, time.Duration(replTimeout.Get()) * time.Second})
+	w.WriteString("$EOF:" + mark + "\r\n")
+	if err := writeRDB(w, snapshot); err != nil {
+		return err
+	}
+	w.WriteString(mark)
+	return w.Flush()
+}
+
+// progressWriter fails a write only when a chunk makes no progress for
+// timeout, a large snapshot can take longer as a whole.
+type progressWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w progressWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.conn.Write(p)
+}
+
+// PartialResync sends the replica the stream it misses since offset if the
+// backlog still has it and registers the replica. It reports false when a
+// full resync is needed.
+func (rm *ReplicasManager) PartialResync(conn *RedisConnect, replId string, offset int64) (bool, error) {
+	rm.replicasConnMutex.Lock()
+	defer rm.replicasConnMutex.Unlock()
+	data, ok := rm.backlog.Since(offset)
+	if !ok {
+		return false, nil
+	}
+	err := conn.Send(respString(fmt.Sprintf("CONTINUE %s", replId)))
+	if err != nil {
+		return false, fmt.Errorf("can't return CONTINUE answer: %w", err)
+	}
+	slog.Info("partial resynchronization accepted", "offset", offset, "bytes", len(data))
+	r := rm.registerReplica(conn, false)
+	r.stream = data
+	rm.setOnline(r)
+	return true, nil
+}
+
+// DropReplicas disconnects all replicas, they have to sync again.
+func (rm *ReplicasManager) DropReplicas() {
+	rm.replicasConnMutex.Lock()
+	defer rm.replicasConnMutex.Unlock()
+	rm.dropReplicas()
+}
+
+// dropReplicas must be called with replicasConnMutex locked.
+func (rm *ReplicasManager) dropReplicas() {
+	for _, r := range rm.replicas {
+		r.conn.Kill()
+	}
+	rm.replicas = nil
+}
+
+// Reset disconnects all replicas and loads data at offset of the stream, it
+// is used when the server syncs with its master.
+func (rm *ReplicasManager) Reset(offset int64, data map[string]ValueWithExpiration) {
+	rm.replicasConnMutex.Lock()
+	defer rm.replicasConnMutex.Unlock()
+	rm.dropReplicas()
+	rm.values.Replace(data)
+	rm.backlog.Reset(offset)
+}
+
+// Run pings the replicas through the stream every period seconds.
+func (rm *ReplicasManager) Run(period *configValue[int]) {
+	for {
+		time.Sleep(time.Duration(period.Get()) * time.Second)
+		rm.ping()
+	}
+}
+
+// ping feeds a PING to the replicas of a master. Replicas of a replica get
+// the pings of its master, and none is sent while writes are paused, it
+// would move the offset FAILOVER waits for.
+func (rm *ReplicasManager) ping() {
+	if redisInfo.GetMaster() != nil || rm.GetReplicasCount() == 0 {
+		return
+	}
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	if clientsRegistry.WritesPaused() {
+		return
+	}
+	rm.LogCommand("PING")
+}
+
+// LogCommand appends the command to the replication stream and returns the
+// new offset, it must be called with writeMu held.
+func (rm *ReplicasManager) LogCommand(cmd string, args ...string) int64 {
+	return rm.feed([]byte(respCommand(cmd, args...)))
+}
+
+func (rm *ReplicasManager) feed(data []byte) int64 {
+	rm.replicasConnMutex.Lock()
+	defer rm.replicasConnMutex.Unlock()
+	offset := rm.backlog.Write(data)
+	limit := clientOutputBufferLimits.Get()[ClientClassReplica]
+	now := time.Now()
+	for _, r := range slices.Clone(rm.replicas) {
+		if r.online {
+			rm.sendStream(r, data)
+			continue
+		}
+		r.stream = append(r.stream, data...)
+		if reason := limit.reached(int64(len(r.stream)), &r.softLimitReachedAt, now); reason != "" {
+			slog.Warn(
+				"replica scheduled to be closed for overcoming of output buffer limits",
+				"client", r.conn.ID,
+				"limit", reason,
+				"omem", len(r.stream),
+			)
+			redisInfo.stats.clientOutputBufferLimitDisconnections.Add(1)
+			rm.removeReplica(r)
+		}
 	}
+	return offset
 }
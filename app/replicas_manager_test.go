@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// connectedPair returns both ends of a TCP connection, the server end as a
+// client of the server.
+func connectedPair(t *testing.T) (*RedisConnect, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	peer, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRedisConnect(conn), peer
+}
+
+func TestReplicaStreamInOutputBuffer(t *testing.T) {
+	ks := NewKeyspace()
+	rm := NewReplicasManager(NewReplicationBacklog(1024), ks)
+	t.Cleanup(rm.DropReplicas)
+	rm.LogCommand("SET", "a", "1")
+	conn, peer := connectedPair(t)
+
+	if ok, err := rm.PartialResync(conn, "id", 1); !ok || err != nil {
+		t.Fatalf("expected the partial resync accepted, but got %v, %v", ok, err)
+	}
+	rm.LogCommand("SET", "b", "2")
+	// a reply sent meanwhile is queued after the stream, never inside it
+	conn.Send(respString("OK"))
+
+	expected := respString("CONTINUE id") + respCommand("SET", "a", "1") + respCommand("SET", "b", "2") + respString("OK")
+	got := make([]byte, len(expected))
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(peer, got); err != nil || string(got) != expected {
+		t.Errorf("expected %q, but got %q, %v", expected, got, err)
+	}
+	if size := conn.OutputBufferSize(); size != 0 {
+		t.Errorf("expected the output buffer drained, but got %d bytes", size)
+	}
+}
+
+func TestWaitForWritesOfClient(t *testing.T) {
+	ks := NewKeyspace()
+	useTestReplication(t, ks)
+	t.Cleanup(replicasManager.DropReplicas)
+	commands := map[string]CommandEntry{
+		"set":  {CommandSet{values: ks}, FlagWrite},
+		"wait": {CommandWait{replicasManager: replicasManager}, 0},
+	}
+	replicaConn, _ := connectedPair(t)
+	if ok, err := replicasManager.PartialResync(replicaConn, "id", 1); !ok || err != nil {
+		t.Fatalf("expected the replica registered, but got %v, %v", ok, err)
+	}
+	first, firstPeer := connectedPair(t)
+	second, secondPeer := connectedPair(t)
+	for _, conn := range []*RedisConnect{first, second} {
+		if err := execute(slog.Default(), commands, conn, UserToMaster, []string{"SET", "k", "v"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the replica acked the write of the first client only
+	replicasManager.replicasConnMutex.Lock()
+	replicasManager.replicas[0].ackOffset = first.writeOffset
+	replicasManager.replicasConnMutex.Unlock()
+
+	for _, test := range []struct {
+		conn     *RedisConnect
+		peer     net.Conn
+		expected string
+	}{
+		{first, firstPeer, respString("OK") + respInt(1)},
+		{second, secondPeer, respString("OK") + respInt(0)},
+	} {
+		if err := execute(slog.Default(), commands, test.conn, UserToMaster, []string{"WAIT", "1", "50"}); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(test.expected))
+		test.peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(test.peer, got); err != nil || string(got) != test.expected {
+			t.Errorf("expected %q, but got %q, %v", test.expected, got, err)
+		}
+	}
+}
+
+func TestGetAckAfterWrites(t *testing.T) {
+	backlog := useTestReplication(t, NewKeyspace())
+	// a write being applied holds writeMu
+	writeMu.Lock()
+	done := make(chan struct{})
+	go func() {
+		replicasManager.WaitForAcks(1, 1, 10*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	replicasManager.LogCommand("SET", "k", "v")
+	writeMu.Unlock()
+	<-done
+
+	expected := respCommand("SET", "k", "v") + respCommand("REPLCONF", "GETACK", "*")
+	if data, _ := backlog.Since(1); string(data) != expected {
+		t.Errorf("expected %q, but got %q", expected, data)
+	}
+}
+
+func TestPingReplicas(t *testing.T) {
+	backlog := useTestReplication(t, NewKeyspace())
+	t.Cleanup(replicasManager.DropReplicas)
+	t.Cleanup(clientsRegistry.Unpause)
+	// nobody to ping
+	replicasManager.ping()
+	conn, _ := connectedPair(t)
+	if ok, err := replicasManager.PartialResync(conn, "id", 1); !ok || err != nil {
+		t.Fatalf("expected the replica registered, but got %v, %v", ok, err)
+	}
+	replicasManager.ping()
+	clientsRegistry.Pause(time.Minute, false)
+	replicasManager.ping()
+
+	expected := respCommand("PING")
+	if data, _ := backlog.Since(1); string(data) != expected {
+		t.Errorf("expected a single %q, but got %q", expected, data)
+	}
+}
+
+func TestMasterLinkTimeout(t *testing.T) {
+	useTestReplication(t, NewKeyspace())
+	t.Cleanup(func() { config.Set("repl-timeout", "60") })
+	if err := config.Set("repl-timeout", "1"); err != nil {
+		t.Fatal(err)
+	}
+	master := newFakeInstance(t, "")
+	client := NewRedisClient(master.Address(), 0, replicasManager)
+	go client.Run(map[string]CommandEntry{})
+	t.Cleanup(client.Stop)
+
+	// the master accepts the PSYNC and sends nothing
+	reconnected := waitFor(func() bool {
+		master.mu.Lock()
+		defer master.mu.Unlock()
+		return len(master.conns) >= 2
+	})
+	if !reconnected {
+		t.Errorf("expected the replica to reconnect to a silent master")
+	}
+}
+
+func TestDisklessSnapshotTimeout(t *testing.T) {
+	t.Cleanup(func() { config.Set("repl-timeout", "60") })
+	if err := config.Set("repl-timeout", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// random values don't compress
+	snapshot := map[string]ValueWithExpiration{}
+	value := make([]byte, 256*1024)
+	for i := 0; i < 16; i++ {
+		rand.Read(value)
+		snapshot[strconv.Itoa(i)] = ValueWithExpiration{Value: string(value)}
+	}
+	smallBuffers := func(conn *RedisConnect, peer net.Conn) {
+		conn.Conn.(*net.TCPConn).SetWriteBuffer(64 * 1024)
+		peer.(*net.TCPConn).SetReadBuffer(64 * 1024)
+	}
+
+	// a slow replica gets the snapshot in more than repl-timeout
+	conn, peer := connectedPair(t)
+	smallBuffers(conn, peer)
+	go func() {
+		chunk := make([]byte, 512*1024)
+		for {
+			if _, err := peer.Read(chunk); err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	start := time.Now()
+	if err := sendRDBDiskless(conn, snapshot); err != nil || time.Since(start) < time.Second {
+		t.Errorf("expected the snapshot sent slowly, but got %v after %v", err, time.Since(start))
+	}
+
+	// a replica which stops reading fails the transfer
+	stalled, stalledPeer := connectedPair(t)
+	smallBuffers(stalled, stalledPeer)
+	start = time.Now()
+	if err := sendRDBDiskless(stalled, snapshot); err == nil || time.Since(start) > 10*time.Second {
+		t.Errorf("expected a timeout, but got %v after %v", err, time.Since(start))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import "sync"
+
+// ReplicationBacklog is a circular buffer with the latest bytes of the
+// replication stream, used to serve partial resynchronizations.
+type ReplicationBacklog struct {
+	mu  sync.RWMutex
+	buf []byte
+	// idx is the position in buf for the next byte
+	idx int
+	// histlen is the amount of valid data in buf
+	histlen int
+	// offset is the replication offset of the last written byte, it is
+	// master_repl_offset
+	offset int64
+}
+
+func NewReplicationBacklog(size int64) *ReplicationBacklog {
+	return &ReplicationBacklog{buf: make([]byte, max(size, 1))}
+}
+
+// Write appends data to the backlog and returns the new replication offset.
+func (b *ReplicationBacklog) Write(data []byte) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.offset += int64(len(data))
+	for len(data) > 0 {
+		n := copy(b.buf[b.idx:], data)
+		b.idx = (b.idx + n) % len(b.buf)
+		b.histlen = min(b.histlen+n, len(b.buf))
+		data = data[n:]
+	}
+	return b.offset
+}
+
+// Reset drops the history, the stream continues from offset.
+func (b *ReplicationBacklog) Reset(offset int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.idx, b.histlen, b.offset = 0, 0, offset
+}
+
+func (b *ReplicationBacklog) Offset() int64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.offset
+}
+
+// Stats returns the backlog size, the offset of the first byte it keeps and
+// the amount of kept bytes.
+func (b *ReplicationBacklog) Stats() (size, firstByteOffset, histlen int64) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return int64(len(b.buf)), b.offset - int64(b.histlen) + 1, int64(b.histlen)
+}
+
+// Since returns the stream starting at the given offset. As in PSYNC, the
+// offset is the one of the first byte the replica misses. It reports false
+// when this part of the stream isn't in the backlog anymore.
+func (b *ReplicationBacklog) Since(offset int64) ([]byte, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	firstByteOffset := b.offset - int64(b.histlen) + 1
+	if offset < firstByteOffset || offset > b.offset+1 {
+		return nil, false
+	}
+	n := int(b.offset + 1 - offset)
+	res := make([]byte, n)
+	start := (b.idx - n + len(b.buf)) % len(b.buf)
+	copied := copy(res, b.buf[start:])
+	copy(res[copied:], b.buf[:n-copied])
+	return res, true
+}
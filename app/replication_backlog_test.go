@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestReplicationBacklog(t *testing.T) {
+	backlog := NewReplicationBacklog(8)
+	if data, ok := backlog.Since(1); !ok || len(data) != 0 {
+		t.Errorf("empty backlog should continue from offset 1, got %q, %v", data, ok)
+	}
+
+	backlog.Write([]byte("abcde"))
+	if offset := backlog.Write([]byte("fghij")); offset != 10 {
+		t.Errorf("expected offset 10, but got %d", offset)
+	}
+
+	for _, test := range []struct {
+		offset   int64
+		expected string
+		ok       bool
+	}{
+		{offset: 1, ok: false},
+		{offset: 2, ok: false},
+		{offset: 3, expected: "cdefghij", ok: true},
+		{offset: 8, expected: "hij", ok: true},
+		{offset: 11, expected: "", ok: true},
+		{offset: 12, ok: false},
+	} {
+		data, ok := backlog.Since(test.offset)
+		if ok != test.ok || string(data) != test.expected {
+			t.Errorf("since %d expected %q, %v, but got %q, %v", test.offset, test.expected, test.ok, data, ok)
+		}
+	}
+
+	backlog.Write([]byte("0123456789abcdefghij"))
+	if data, ok := backlog.Since(23); !ok || string(data) != "cdefghij" {
+		t.Errorf("expected last 8 bytes after overflow, got %q, %v", data, ok)
+	}
+}
@@ -2,9 +2,16 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
 )
 
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
 func respError(msg string) string {
 	return fmt.Sprintf("-%s\r\n", msg)
 }
@@ -21,6 +28,82 @@ func respBulkString(msg ...string) string {
 	}
 }
 
+// respNull returns the null reply: a null bulk string in RESP2 and the
+// dedicated null type in RESP3.
+func respNull(protocol int) string {
+	if protocol == RESP3 {
+		return "_\r\n"
+	}
+	return "$-1\r\n"
+}
+
+// respArray wraps already encoded replies into an array.
+func respArray(items ...string) string {
+	res := strings.Builder{}
+	res.WriteString(fmt.Sprintf("*%d\r\n", len(items)))
+	for _, item := range items {
+		res.WriteString(item)
+	}
+	return res.String()
+}
+
+// respMap wraps already encoded key-value pairs into a map in RESP3 and into
+// a flat array in RESP2.
+func respMap(protocol int, pairs ...string) string {
+	if protocol != RESP3 {
+		return respArray(pairs...)
+	}
+	res := strings.Builder{}
+	res.WriteString(fmt.Sprintf("%%%d\r\n", len(pairs)/2))
+	for _, item := range pairs {
+		res.WriteString(item)
+	}
+	return res.String()
+}
+
+// respPush wraps already encoded items into an out of band push message in
+// RESP3 and into an array in RESP2.
+func respPush(protocol int, items ...string) string {
+	if protocol != RESP3 {
+		return respArray(items...)
+	}
+	res := strings.Builder{}
+	res.WriteString(fmt.Sprintf(">%d\r\n", len(items)))
+	for _, item := range items {
+		res.WriteString(item)
+	}
+	return res.String()
+}
+
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// respDouble returns a double in RESP3 and its bulk string form in RESP2.
+func respDouble(protocol int, f float64) string {
+	if protocol != RESP3 {
+		return respBulkString(formatDouble(f))
+	}
+	return fmt.Sprintf(",%s\r\n", formatDouble(f))
+}
+
+// respVerbatim returns a verbatim string with the given three letters format
+// in RESP3 and a plain bulk string in RESP2.
+func respVerbatim(protocol int, format string, msg string) string {
+	if protocol != RESP3 {
+		return respBulkString(msg)
+	}
+	return fmt.Sprintf("=%d\r\n%s:%s\r\n", len(msg)+len(format)+1, format, msg)
+}
+
 func respInt(n int) string {
 	return fmt.Sprintf(":%d\r\n", n)
 }
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRespProtocolVersions(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		result   string
+		expected string
+	}{
+		{"null resp2", respNull(RESP2), "$-1\r\n"},
+		{"null resp3", respNull(RESP3), "_\r\n"},
+		{"map resp2", respMap(RESP2, respBulkString("a"), respInt(1)), "*2\r\n$1\r\na\r\n:1\r\n"},
+		{"map resp3", respMap(RESP3, respBulkString("a"), respInt(1)), "%1\r\n$1\r\na\r\n:1\r\n"},
+		{"double resp2", respDouble(RESP2, 1.5), "$3\r\n1.5\r\n"},
+		{"double resp3", respDouble(RESP3, 1.5), ",1.5\r\n"},
+		{"double inf", respDouble(RESP3, math.Inf(-1)), ",-inf\r\n"},
+		{"verbatim resp2", respVerbatim(RESP2, "txt", "hi"), "$2\r\nhi\r\n"},
+		{"verbatim resp3", respVerbatim(RESP3, "txt", "hi"), "=6\r\ntxt:hi\r\n"},
+	} {
+		if test.result != test.expected {
+			t.Errorf("%s: expected %q, but got %q", test.name, test.expected, test.result)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// RoleManager switches the server between master and replica.
+type RoleManager struct {
+	mu              sync.Mutex
+	replicasManager *ReplicasManager
+	// commands are applied from the stream of the master
+	commands map[string]CommandEntry
+	myPort   int
+}
+
+func NewRoleManager(replicasManager *ReplicasManager, commands map[string]CommandEntry, myPort int) *RoleManager {
+	return &RoleManager{
+		replicasManager: replicasManager,
+		commands:        commands,
+		myPort:          myPort,
+	}
+}
+
+// Promote makes a replica a master with a new replid. The old one stays valid
+// up to the current offset, so other replicas of the same master can
+// continue with PSYNC.
+func (roles *RoleManager) Promote() {
+	roles.mu.Lock()
+	defer roles.mu.Unlock()
+	roles.promote()
+}
+
+// PromoteForFailover handles PSYNC FAILOVER: the master asks its replica to
+// take over, which is possible only if they share the history.
+func (roles *RoleManager) PromoteForFailover(replId string) error {
+	roles.mu.Lock()
+	defer roles.mu.Unlock()
+	if replId != redisInfo.GetMasterReplId() {
+		return errors.New("ERR PSYNC FAILOVER replid must match my replid.")
+	}
+	slog.Info("failover request received", "replid", replId)
+	roles.promote()
+	return nil
+}
+
+func (roles *RoleManager) promote() {
+	master := redisInfo.GetMaster()
+	if master == nil {
+		return
+	}
+	master.Stop()
+	offset := int64(master.Offset())
+	redisInfo.BecomeMaster(offset)
+	replicaOf.Set("")
+	slog.Info("master mode enabled", "offset", offset)
+}
+
+// ReplicateFrom makes the server a replica of the master at address, it
+// reports false when it already is.
+func (roles *RoleManager) ReplicateFrom(address string) bool {
+	roles.mu.Lock()
+	defer roles.mu.Unlock()
+	master := redisInfo.GetMaster()
+	if master != nil && master.address == address {
+		return false
+	}
+	roles.replicateFrom(address, nil)
+	return true
+}
+
+// HandOver makes a master a replica of address for FAILOVER: the first PSYNC
+// asks the replica to take over and its result is sent to failover. It never
+// waits for a replication link to stop, so it may be called with writeMu
+// held. It reports false when the server isn't a master anymore.
+func (roles *RoleManager) HandOver(address string, failover chan error) bool {
+	roles.mu.Lock()
+	defer roles.mu.Unlock()
+	if redisInfo.GetMaster() != nil {
+		return false
+	}
+	roles.replicateFrom(address, failover)
+	return true
+}
+
+func (roles *RoleManager) replicateFrom(address string, failover chan error) {
+	master := redisInfo.GetMaster()
+	var offset int
+	if master != nil {
+		master.Stop()
+		offset = master.Offset()
+	} else {
+		offset = int(roles.replicasManager.Offset())
+	}
+	// our replicas follow a different history from now on
+	roles.replicasManager.DropReplicas()
+
+	client := NewRedisClient(address, roles.myPort, roles.replicasManager)
+	client.SetCachedMaster(redisInfo.GetMasterReplId(), offset)
+	client.failover = failover
+	redisInfo.BecomeReplica(client)
+	// CONFIG GET and CONFIG REWRITE show the current master
+	if host, masterPort, err := net.SplitHostPort(address); err == nil {
+		replicaOf.Set(host + " " + masterPort)
+	}
+	go client.Run(roles.commands)
+	slog.Info("replica mode enabled", "master", address)
+}
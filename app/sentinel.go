@@ -0,0 +1,849 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sentinelDefaultPort  = 26379
+	sentinelHelloChannel = "__sentinel__:hello"
+	sentinelCronPeriod   = 100 * time.Millisecond
+	sentinelPingPeriod   = time.Second
+	sentinelInfoPeriod   = 10 * time.Second
+	// sentinelFailoverInfoPeriod is used for replicas of a master which is
+	// down or failing over, their state changes quickly then
+	sentinelFailoverInfoPeriod = time.Second
+	sentinelHelloPeriod        = 2 * time.Second
+	sentinelAskPeriod          = time.Second
+	// sentinelMasterDownValidity is how long an is-master-down-by-addr reply
+	// counts for the objective down state
+	sentinelMasterDownValidity = 5 * time.Second
+	sentinelMaxElectionTimeout = 10 * time.Second
+	// sentinelReconfPeriod limits how often a misconfigured replica is fixed
+	sentinelReconfPeriod = 10 * time.Second
+	// sentinelMaxDesync spreads the failover attempts of sentinels, so they
+	// don't split the votes
+	sentinelMaxDesync = time.Second
+)
+
+// sentinelMonitor is a master given with --sentinel-monitor.
+type sentinelMonitor struct {
+	name    string
+	address string
+	quorum  int
+}
+
+type sentinelMonitors []sentinelMonitor
+
+func (monitors sentinelMonitors) String() string {
+	res := make([]string, 0, len(monitors))
+	for _, m := range monitors {
+		host, port, _ := net.SplitHostPort(m.address)
+		res = append(res, fmt.Sprintf("%s %s %s %d", m.name, host, port, m.quorum))
+	}
+	return strings.Join(res, ", ")
+}
+
+// parseSentinelMonitor parses "<name> <host> <port> <quorum>", every flag
+// adds a master.
+func parseSentinelMonitor(monitors sentinelMonitors, s string) (sentinelMonitors, error) {
+	args := strings.Fields(s)
+	if len(args) != 4 {
+		return nil, fmt.Errorf("expecting '<name> <host> <port> <quorum>', got %q", s)
+	}
+	if _, err := strconv.ParseUint(args[2], 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid port %q", args[2])
+	}
+	quorum, err := strconv.Atoi(args[3])
+	if err != nil || quorum <= 0 {
+		return nil, fmt.Errorf("quorum must be 1 or greater, got %q", args[3])
+	}
+	return append(slices.Clip(monitors), sentinelMonitor{
+		name:    args[0],
+		address: net.JoinHostPort(args[1], args[2]),
+		quorum:  quorum,
+	}), nil
+}
+
+type sentinelInstanceKind int
+
+const (
+	sentinelKindMaster sentinelInstanceKind = iota
+	sentinelKindReplica
+	sentinelKindSentinel
+)
+
+func (kind sentinelInstanceKind) String() string {
+	return [...]string{"master", "slave", "sentinel"}[kind]
+}
+
+type sentinelFailoverState int
+
+const (
+	failoverNone sentinelFailoverState = iota
+	failoverWaitStart
+	failoverSelectReplica
+	failoverSendReplicaOfNoOne
+	failoverWaitPromotion
+	failoverReconfReplicas
+)
+
+func (state sentinelFailoverState) String() string {
+	return [...]string{
+		"none", "wait_start", "select_slave", "send_slaveof_noone", "wait_promotion", "reconf_slaves",
+	}[state]
+}
+
+// sentinelInstance is a master, a replica or another sentinel as seen by
+// the sentinel.
+type sentinelInstance struct {
+	kind    sentinelInstanceKind
+	address string
+	// runID is known for sentinels only, from their hello messages
+	runID string
+	link  *RedisClient
+
+	lastPingSent time.Time
+	// pingPendingSince is when the oldest unanswered PING was sent
+	pingPendingSince time.Time
+	lastAvailable    time.Time
+	reconnectedAt    time.Time
+	lastInfoSent     time.Time
+	lastInfo         time.Time
+	lastHelloSent    time.Time
+	sdownSince       time.Time
+
+	// reported by INFO
+	role          string
+	roleChangedAt time.Time
+	masterAddress string
+	masterLinkUp  bool
+	replOffset    int64
+	reconfSentAt  time.Time
+
+	// sentinels only
+	lastHello         time.Time
+	lastAsked         time.Time
+	masterDown        bool
+	masterDownReplied time.Time
+	leader            string
+	leaderEpoch       int64
+
+	// replicas only, their progress during a failover
+	reconfSent bool
+	reconfDone bool
+}
+
+func (inst *sentinelInstance) host() string {
+	return hostOf(inst.address)
+}
+
+func (inst *sentinelInstance) port() string {
+	return portOf(inst.address)
+}
+
+// name is how events and SENTINEL replies call the instance.
+func (inst *sentinelInstance) name(master *sentinelMaster) string {
+	switch inst.kind {
+	case sentinelKindMaster:
+		return master.name
+	case sentinelKindSentinel:
+		return inst.runID
+	}
+	return inst.address
+}
+
+// sentinelMaster is a monitored master with everything known about it.
+type sentinelMaster struct {
+	name            string
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+
+	instance *sentinelInstance
+	// replicas are keyed by address, sentinels by run id
+	replicas    map[string]*sentinelInstance
+	sentinels   map[string]*sentinelInstance
+	configEpoch int64
+	odownSince  time.Time
+	// failoverDelay spreads the sentinels which see the master down at
+	// once, so the first one asking for votes gets them
+	failoverDelay time.Duration
+
+	// leader is the sentinel we voted for in leaderEpoch
+	leader      string
+	leaderEpoch int64
+
+	failoverState        sentinelFailoverState
+	failoverEpoch        int64
+	failoverStartTime    time.Time
+	failoverStateChanged time.Time
+	// forcedFailover is started by SENTINEL FAILOVER without an agreement
+	forcedFailover bool
+	promoted       *sentinelInstance
+}
+
+// currentAddress returns the address of the master. Once the promoted
+// replica is the master, it's announced with the new config epoch.
+func (master *sentinelMaster) currentAddress() string {
+	if master.failoverState == failoverReconfReplicas {
+		return master.promoted.address
+	}
+	return master.instance.address
+}
+
+// Sentinel monitors masters, agrees with other sentinels that a master is
+// down and promotes one of its replicas.
+type Sentinel struct {
+	mu           sync.Mutex
+	runID        string
+	port         int
+	currentEpoch int64
+	masters      map[string]*sentinelMaster
+}
+
+func NewSentinel(port int, monitors sentinelMonitors, downAfter, failoverTimeout time.Duration) *Sentinel {
+	s := &Sentinel{
+		runID:   randomHex(40),
+		port:    port,
+		masters: make(map[string]*sentinelMaster),
+	}
+	for _, m := range monitors {
+		master := &sentinelMaster{
+			name:            m.name,
+			quorum:          m.quorum,
+			downAfter:       downAfter,
+			failoverTimeout: failoverTimeout,
+			replicas:        make(map[string]*sentinelInstance),
+			sentinels:       make(map[string]*sentinelInstance),
+		}
+		master.instance = s.newInstance(master, sentinelKindMaster, m.address)
+		s.masters[m.name] = master
+		s.event("+monitor", master, master.instance, "quorum %d", m.quorum)
+	}
+	return s
+}
+
+func (s *Sentinel) newInstance(master *sentinelMaster, kind sentinelInstanceKind, address string) *sentinelInstance {
+	inst := &sentinelInstance{
+		kind:          kind,
+		address:       address,
+		lastAvailable: time.Now(),
+	}
+	connName := fmt.Sprintf("sentinel-%s-cmd", s.runID[:8])
+	if kind == sentinelKindSentinel {
+		inst.link = NewSentinelClient(address, func(link *RedisClient) {
+			link.SendSetup(nil, "CLIENT", "SETNAME", connName)
+		}, nil)
+	} else {
+		// one RESP3 connection gets both replies and hello messages
+		inst.link = NewSentinelClient(address, func(link *RedisClient) {
+			link.SendSetup(nil, "HELLO", "3", "SETNAME", connName)
+			link.Subscribe(sentinelHelloChannel)
+		}, s.processPush)
+	}
+	go inst.link.Run(nil)
+	return inst
+}
+
+// Run checks the monitored instances until the process exits.
+func (s *Sentinel) Run() {
+	ticker := time.NewTicker(sentinelCronPeriod)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.cron(now)
+	}
+}
+
+func (s *Sentinel) cron(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, master := range s.masters {
+		s.checkInstance(master, master.instance, now)
+		for _, replica := range master.replicas {
+			s.checkInstance(master, replica, now)
+		}
+		for _, sentinel := range master.sentinels {
+			s.checkInstance(master, sentinel, now)
+		}
+		s.checkObjectivelyDown(master, now)
+		s.askMasterState(master, now)
+		s.handleFailover(master, now)
+	}
+}
+
+// checkInstance sends periodic PING, INFO and hello messages and updates
+// the subjective down state.
+func (s *Sentinel) checkInstance(master *sentinelMaster, inst *sentinelInstance, now time.Time) {
+	if !inst.pingPendingSince.IsZero() && now.Sub(inst.pingPendingSince) > master.downAfter/2 &&
+		now.Sub(inst.reconnectedAt) > master.downAfter/2 {
+		// the connection may be stuck, a new one may do better
+		inst.link.Reconnect()
+		inst.reconnectedAt = now
+	}
+
+	if now.Sub(inst.lastPingSent) >= min(sentinelPingPeriod, master.downAfter) && inst.link.Send(func(reply any) {
+		s.processPong(inst, reply)
+	}, "PING") {
+		inst.lastPingSent = now
+		if inst.pingPendingSince.IsZero() {
+			inst.pingPendingSince = now
+		}
+	}
+
+	if inst.kind != sentinelKindSentinel {
+		infoPeriod := sentinelInfoPeriod
+		if inst.kind == sentinelKindReplica && (!master.odownSince.IsZero() || master.failoverState != failoverNone) {
+			infoPeriod = sentinelFailoverInfoPeriod
+		}
+		if now.Sub(inst.lastInfoSent) >= infoPeriod && inst.link.Send(func(reply any) {
+			s.processInfo(master, inst, reply)
+		}, "INFO", "replication") {
+			inst.lastInfoSent = now
+		}
+		if now.Sub(inst.lastHelloSent) >= sentinelHelloPeriod && s.sendHello(master, inst) {
+			inst.lastHelloSent = now
+		}
+	}
+
+	// like Redis, an instance is down when a PING is unanswered for too
+	// long, or when it can't be connected to for too long
+	var unavailable time.Duration
+	switch {
+	case !inst.pingPendingSince.IsZero():
+		unavailable = now.Sub(inst.pingPendingSince)
+	case !inst.link.IsLinkUp():
+		unavailable = now.Sub(inst.lastAvailable)
+	}
+	sdown := unavailable > master.downAfter
+	switch {
+	case sdown && inst.sdownSince.IsZero():
+		inst.sdownSince = now
+		s.event("+sdown", master, inst, "")
+	case !sdown && !inst.sdownSince.IsZero():
+		inst.sdownSince = time.Time{}
+		s.event("-sdown", master, inst, "")
+	}
+}
+
+// sendHello announces the sentinel and its view of the master to the
+// other sentinels subscribed to the instance.
+func (s *Sentinel) sendHello(master *sentinelMaster, inst *sentinelInstance) bool {
+	ip := inst.link.LocalIP()
+	if ip == "" {
+		return false
+	}
+	address := master.currentAddress()
+	hello := strings.Join([]string{
+		ip,
+		strconv.Itoa(s.port),
+		s.runID,
+		strconv.FormatInt(s.currentEpoch, 10),
+		master.name,
+		hostOf(address),
+		portOf(address),
+		strconv.FormatInt(master.configEpoch, 10),
+	}, ",")
+	return inst.link.Send(nil, "PUBLISH", sentinelHelloChannel, hello)
+}
+
+func (s *Sentinel) processPong(inst *sentinelInstance, reply any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	valid := reply == "PONG"
+	if err, ok := reply.(ReplyError); ok {
+		// the instance works, it just can't serve data right now
+		valid = strings.HasPrefix(string(err), "LOADING") || strings.HasPrefix(string(err), "MASTERDOWN")
+	}
+	if valid {
+		inst.lastAvailable = time.Now()
+		inst.pingPendingSince = time.Time{}
+	}
+}
+
+// processInfo learns replicas of the master and the replication state of
+// replicas, and drives the failover by the roles they report.
+func (s *Sentinel) processInfo(master *sentinelMaster, inst *sentinelInstance, reply any) {
+	text, ok := reply.(string)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	inst.lastInfo = now
+	var masterHost, masterPort string
+	for _, line := range strings.Split(text, "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), ":")
+		switch {
+		case key == "role":
+			if value != inst.role {
+				inst.role, inst.roleChangedAt = value, now
+			}
+		case key == "master_host":
+			masterHost = value
+		case key == "master_port":
+			masterPort = value
+		case key == "master_link_status":
+			inst.masterLinkUp = value == "up"
+		case key == "slave_repl_offset":
+			inst.replOffset, _ = strconv.ParseInt(value, 10, 64)
+		case strings.HasPrefix(key, "slave") && inst == master.instance:
+			if address := parseReplicaInfo(value); address != "" && master.replicas[address] == nil {
+				replica := s.newInstance(master, sentinelKindReplica, address)
+				master.replicas[address] = replica
+				s.event("+slave", master, replica, "")
+			}
+		}
+	}
+	inst.masterAddress = ""
+	if masterHost != "" {
+		inst.masterAddress = net.JoinHostPort(masterHost, masterPort)
+	}
+	if inst.kind != sentinelKindReplica {
+		return
+	}
+
+	switch {
+	case master.failoverState == failoverWaitPromotion && inst == master.promoted && inst.role == "master":
+		master.configEpoch = master.failoverEpoch
+		s.event("+promoted-slave", master, inst, "")
+		s.setFailoverState(master, failoverReconfReplicas, now)
+	case master.failoverState == failoverReconfReplicas && inst.reconfSent && !inst.reconfDone &&
+		inst.masterAddress == master.promoted.address && inst.masterLinkUp:
+		inst.reconfDone = true
+		s.event("+slave-reconf-done", master, inst, "")
+	case master.failoverState == failoverNone && master.instance.sdownSince.IsZero() &&
+		now.Sub(inst.roleChangedAt) > 2*sentinelHelloPeriod && now.Sub(inst.reconfSentAt) > sentinelReconfPeriod:
+		// the old master coming back after a failover, or a replica
+		// following another master, gets the configuration we agreed on
+		eventType := ""
+		if inst.role == "master" {
+			eventType = "+convert-to-slave"
+		} else if inst.role == "slave" && inst.masterAddress != master.instance.address {
+			eventType = "+fix-slave-config"
+		}
+		if eventType != "" && inst.link.Send(nil, "REPLICAOF", master.instance.host(), master.instance.port()) {
+			inst.reconfSentAt = now
+			s.event(eventType, master, inst, "")
+		}
+	}
+}
+
+// parseReplicaInfo returns the address of a replica from its
+// "ip=...,port=...,state=..." line of INFO replication.
+func parseReplicaInfo(value string) string {
+	var ip, port string
+	for _, field := range strings.Split(value, ",") {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "ip":
+			ip = value
+		case "port":
+			port = value
+		}
+	}
+	if ip == "" || port == "" {
+		return ""
+	}
+	return net.JoinHostPort(ip, port)
+}
+
+func (s *Sentinel) processPush(push PushReply) {
+	if len(push) != 3 || push[0] != "message" || push[1] != sentinelHelloChannel {
+		return
+	}
+	if hello, ok := push[2].(string); ok {
+		s.processHello(hello)
+	}
+}
+
+// processHello learns other sentinels and the master configuration with
+// the greatest epoch from a hello message.
+func (s *Sentinel) processHello(hello string) {
+	fields := strings.Split(hello, ",")
+	if len(fields) != 8 {
+		return
+	}
+	epoch, err1 := strconv.ParseInt(fields[3], 10, 64)
+	configEpoch, err2 := strconv.ParseInt(fields[7], 10, 64)
+	if err1 != nil || err2 != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	runID := fields[2]
+	master := s.masters[fields[4]]
+	if runID == s.runID || master == nil {
+		return
+	}
+	address := net.JoinHostPort(fields[0], fields[1])
+	peer := master.sentinels[runID]
+	if peer != nil && peer.address != address {
+		peer.link.Close()
+		delete(master.sentinels, runID)
+		peer = nil
+	}
+	if peer == nil {
+		// a restarted sentinel comes back with a new run id
+		for id, other := range master.sentinels {
+			if other.address == address {
+				other.link.Close()
+				delete(master.sentinels, id)
+				s.event("-dup-sentinel", master, other, "")
+			}
+		}
+		peer = s.newInstance(master, sentinelKindSentinel, address)
+		peer.runID = runID
+		master.sentinels[runID] = peer
+		s.event("+sentinel", master, peer, "")
+	}
+	peer.lastHello = time.Now()
+
+	s.updateEpoch(epoch)
+	if configEpoch > master.configEpoch {
+		master.configEpoch = configEpoch
+		newAddress := net.JoinHostPort(fields[5], fields[6])
+		if newAddress != master.instance.address {
+			s.event("+config-update-from", master, peer, "")
+			s.switchMaster(master, newAddress)
+		}
+	}
+}
+
+func (s *Sentinel) updateEpoch(epoch int64) {
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		s.event("+new-epoch", nil, nil, "%d", epoch)
+	}
+}
+
+// checkObjectivelyDown counts the sentinels which agree that the master is
+// down.
+func (s *Sentinel) checkObjectivelyDown(master *sentinelMaster, now time.Time) {
+	votes := 0
+	if !master.instance.sdownSince.IsZero() {
+		votes = 1
+		for _, peer := range master.sentinels {
+			if peer.masterDown && now.Sub(peer.masterDownReplied) < sentinelMasterDownValidity {
+				votes++
+			}
+		}
+	}
+	odown := votes > 0 && votes >= master.quorum
+	switch {
+	case odown && master.odownSince.IsZero():
+		master.odownSince = now
+		master.failoverDelay = rand.N(sentinelMaxDesync)
+		s.event("+odown", master, master.instance, "#quorum %d/%d", votes, master.quorum)
+	case !odown && !master.odownSince.IsZero():
+		master.odownSince = time.Time{}
+		s.event("-odown", master, master.instance, "")
+	}
+}
+
+// askMasterState asks the other sentinels if they see the master down. During
+// a failover the same request asks for their vote.
+func (s *Sentinel) askMasterState(master *sentinelMaster, now time.Time) {
+	if master.instance.sdownSince.IsZero() {
+		return
+	}
+	runID := "*"
+	if master.failoverState != failoverNone {
+		runID = s.runID
+	}
+	for _, peer := range master.sentinels {
+		if now.Sub(peer.lastAsked) < sentinelAskPeriod {
+			continue
+		}
+		ok := peer.link.Send(func(reply any) {
+			s.processMasterState(peer, reply)
+		}, "SENTINEL", "is-master-down-by-addr",
+			master.instance.host(), master.instance.port(), strconv.FormatInt(s.currentEpoch, 10), runID)
+		if ok {
+			peer.lastAsked = now
+		}
+	}
+}
+
+func (s *Sentinel) processMasterState(peer *sentinelInstance, reply any) {
+	items, ok := reply.([]any)
+	if !ok || len(items) != 3 {
+		return
+	}
+	down, _ := items[0].(int64)
+	leader, _ := items[1].(string)
+	leaderEpoch, _ := items[2].(int64)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer.masterDown = down == 1
+	peer.masterDownReplied = time.Now()
+	if leader != "" && leader != "*" {
+		peer.leader, peer.leaderEpoch = leader, leaderEpoch
+	}
+}
+
+// IsMasterDownByAddr answers another sentinel about the master on address,
+// and gives our vote for runID in epoch unless runID is "*".
+func (s *Sentinel) IsMasterDownByAddr(address string, epoch int64, runID string) (down bool, leader string, leaderEpoch int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	leader = "*"
+	for _, master := range s.masters {
+		if master.instance.address != address {
+			continue
+		}
+		down = !master.instance.sdownSince.IsZero()
+		if runID != "*" {
+			leader, leaderEpoch = s.voteLeader(master, epoch, runID)
+		}
+		break
+	}
+	return down, leader, leaderEpoch
+}
+
+// voteLeader votes for runID unless we already voted in epoch, and returns
+// our vote.
+func (s *Sentinel) voteLeader(master *sentinelMaster, epoch int64, runID string) (string, int64) {
+	s.updateEpoch(epoch)
+	if master.leaderEpoch < epoch && s.currentEpoch <= epoch {
+		master.leader, master.leaderEpoch = runID, s.currentEpoch
+		s.event("+vote-for-leader", master, master.instance, "%s %d", runID, epoch)
+		if runID != s.runID {
+			// let the sentinel we voted for do its job before trying
+			master.failoverStartTime = time.Now().Add(rand.N(sentinelMaxDesync))
+		}
+	}
+	return master.leader, master.leaderEpoch
+}
+
+// electedLeader counts the votes for epoch and returns the winner if it has
+// the majority and the quorum.
+func (s *Sentinel) electedLeader(master *sentinelMaster, epoch int64) string {
+	votes := make(map[string]int)
+	for _, peer := range master.sentinels {
+		if peer.leader != "" && peer.leaderEpoch == epoch {
+			votes[peer.leader]++
+		}
+	}
+	winner := mostVoted(votes)
+	// we vote for the winner so far, or for ourselves
+	if winner == "" {
+		winner = s.runID
+	}
+	if leader, leaderEpoch := s.voteLeader(master, epoch, winner); leaderEpoch == epoch {
+		votes[leader]++
+	}
+	winner = mostVoted(votes)
+	voters := len(master.sentinels) + 1
+	if winner == "" || votes[winner] < voters/2+1 || votes[winner] < master.quorum {
+		return ""
+	}
+	return winner
+}
+
+func mostVoted(votes map[string]int) string {
+	winner := ""
+	for runID, n := range votes {
+		if n > votes[winner] || n == votes[winner] && runID > winner {
+			winner = runID
+		}
+	}
+	return winner
+}
+
+// startFailover starts a failover of a master which is down, or of any
+// master when forced by SENTINEL FAILOVER.
+func (s *Sentinel) startFailover(master *sentinelMaster, forced bool, now time.Time) {
+	s.updateEpoch(s.currentEpoch + 1)
+	master.failoverEpoch = s.currentEpoch
+	master.forcedFailover = forced
+	master.failoverStartTime = now
+	s.event("+try-failover", master, master.instance, "")
+	s.setFailoverState(master, failoverWaitStart, now)
+	// ask for votes right away
+	for _, peer := range master.sentinels {
+		peer.lastAsked = time.Time{}
+	}
+}
+
+func (s *Sentinel) setFailoverState(master *sentinelMaster, state sentinelFailoverState, now time.Time) {
+	master.failoverState = state
+	master.failoverStateChanged = now
+	if state != failoverNone {
+		s.event("+failover-state-"+strings.ReplaceAll(state.String(), "_", "-"), master, master.instance, "")
+	}
+}
+
+func (s *Sentinel) abortFailover(master *sentinelMaster, reason string, now time.Time) {
+	s.event("-failover-abort-"+reason, master, master.instance, "")
+	master.failoverState = failoverNone
+	master.failoverStartTime = now
+	master.forcedFailover = false
+	master.promoted = nil
+	for _, replica := range master.replicas {
+		replica.reconfSent, replica.reconfDone = false, false
+	}
+}
+
+// handleFailover moves the failover of master on.
+func (s *Sentinel) handleFailover(master *sentinelMaster, now time.Time) {
+	switch master.failoverState {
+	case failoverNone:
+		if !master.odownSince.IsZero() && now.Sub(master.odownSince) >= master.failoverDelay &&
+			now.Sub(master.failoverStartTime) >= 2*master.failoverTimeout {
+			s.startFailover(master, false, now)
+		}
+	case failoverWaitStart:
+		if !master.forcedFailover && s.electedLeader(master, master.failoverEpoch) != s.runID {
+			if now.Sub(master.failoverStartTime) > min(sentinelMaxElectionTimeout, master.failoverTimeout) {
+				s.abortFailover(master, "not-elected", now)
+			}
+			return
+		}
+		s.event("+elected-leader", master, master.instance, "")
+		s.setFailoverState(master, failoverSelectReplica, now)
+	case failoverSelectReplica:
+		replica := s.selectReplica(master, now)
+		if replica == nil {
+			s.abortFailover(master, "no-good-slave", now)
+			return
+		}
+		master.promoted = replica
+		s.event("+selected-slave", master, replica, "")
+		s.setFailoverState(master, failoverSendReplicaOfNoOne, now)
+	case failoverSendReplicaOfNoOne:
+		if master.promoted.link.Send(nil, "REPLICAOF", "NO", "ONE") {
+			s.setFailoverState(master, failoverWaitPromotion, now)
+		} else if now.Sub(master.failoverStateChanged) > master.failoverTimeout {
+			s.abortFailover(master, "slave-timeout", now)
+		}
+	case failoverWaitPromotion:
+		// processInfo notices the promotion
+		if now.Sub(master.failoverStateChanged) > master.failoverTimeout {
+			s.abortFailover(master, "slave-timeout", now)
+		}
+	case failoverReconfReplicas:
+		s.reconfReplicas(master, now)
+	}
+}
+
+// selectReplica picks the replica to promote: an available one with the
+// greatest offset.
+func (s *Sentinel) selectReplica(master *sentinelMaster, now time.Time) *sentinelInstance {
+	// INFO is frequent only while the master is down
+	infoValidity := 5 * sentinelInfoPeriod
+	if !master.instance.sdownSince.IsZero() {
+		infoValidity = 3 * sentinelFailoverInfoPeriod
+	}
+	candidates := make([]*sentinelInstance, 0, len(master.replicas))
+	for _, replica := range master.replicas {
+		if !replica.sdownSince.IsZero() || !replica.link.IsLinkUp() ||
+			now.Sub(replica.lastAvailable) > 5*sentinelPingPeriod ||
+			now.Sub(replica.lastInfo) > infoValidity {
+			continue
+		}
+		candidates = append(candidates, replica)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	slices.SortFunc(candidates, func(a, b *sentinelInstance) int {
+		if a.replOffset != b.replOffset {
+			return int(b.replOffset - a.replOffset)
+		}
+		return strings.Compare(a.address, b.address)
+	})
+	return candidates[0]
+}
+
+// reconfReplicas points the other replicas to the promoted one and switches
+// the master once they follow it or the failover times out.
+func (s *Sentinel) reconfReplicas(master *sentinelMaster, now time.Time) {
+	done := true
+	for _, replica := range master.replicas {
+		if replica == master.promoted || replica.reconfDone || !replica.sdownSince.IsZero() {
+			continue
+		}
+		done = false
+		if !replica.reconfSent && replica.link.Send(nil, "REPLICAOF", master.promoted.host(), master.promoted.port()) {
+			replica.reconfSent = true
+			replica.reconfSentAt = now
+			s.event("+slave-reconf-sent", master, replica, "")
+		}
+	}
+	if !done && now.Sub(master.failoverStateChanged) <= master.failoverTimeout {
+		return
+	}
+	if !done {
+		s.event("-failover-end-for-timeout", master, master.instance, "")
+	}
+	s.event("+failover-end", master, master.instance, "")
+	s.switchMaster(master, master.promoted.address)
+}
+
+// switchMaster starts monitoring the master on address. The old master
+// becomes one of its replicas.
+func (s *Sentinel) switchMaster(master *sentinelMaster, address string) {
+	old := master.instance
+	s.event("+switch-master", nil, nil, "%s %s %s %s %s",
+		master.name, old.host(), old.port(), hostOf(address), portOf(address))
+
+	addresses := []string{old.address}
+	for replicaAddress, replica := range master.replicas {
+		replica.link.Close()
+		if replicaAddress != address && replicaAddress != old.address {
+			addresses = append(addresses, replicaAddress)
+		}
+	}
+	old.link.Close()
+	master.instance = s.newInstance(master, sentinelKindMaster, address)
+	master.replicas = make(map[string]*sentinelInstance)
+	for _, replicaAddress := range addresses {
+		replica := s.newInstance(master, sentinelKindReplica, replicaAddress)
+		master.replicas[replicaAddress] = replica
+		s.event("+slave", master, replica, "")
+	}
+	master.odownSince = time.Time{}
+	master.failoverState = failoverNone
+	master.forcedFailover = false
+	master.promoted = nil
+}
+
+func hostOf(address string) string {
+	host, _, _ := net.SplitHostPort(address)
+	return host
+}
+
+func portOf(address string) string {
+	_, port, _ := net.SplitHostPort(address)
+	return port
+}
+
+// event logs a sentinel event and publishes it on the channel named after
+// its type, like "+sdown" or "+switch-master".
+func (s *Sentinel) event(eventType string, master *sentinelMaster, inst *sentinelInstance, format string, args ...any) {
+	msg := ""
+	if inst != nil {
+		msg = fmt.Sprintf("%s %s %s %s", inst.kind, inst.name(master), inst.host(), inst.port())
+		if inst.kind != sentinelKindMaster {
+			msg += fmt.Sprintf(" @ %s %s %s", master.name, master.instance.host(), master.instance.port())
+		}
+	}
+	if format != "" {
+		if msg != "" {
+			msg += " "
+		}
+		msg += fmt.Sprintf(format, args...)
+	}
+	slog.Info("sentinel event", "type", eventType, "details", msg)
+	pubSub.Publish(eventType, msg)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"time"
+)
+
+const (
+	sentinelDialTime = time.Second
+	// sentinelLinkRetryMax keeps reconnecting often, an instance coming back
+	// is noticed quickly
+	sentinelLinkRetryMax = time.Second
+)
+
+// sentinelLink is the part of a RedisClient of a sentinel connected to a
+// monitored instance or to another sentinel. Commands are sent without
+// waiting, their replies are passed to callbacks in order by the goroutine
+// running the client, so a stuck instance never blocks the sentinel.
+type sentinelLink struct {
+	// setup runs on every new connection before any other command is sent
+	setup func(*RedisClient)
+	// onPush gets push messages, it may be nil
+	onPush func(PushReply)
+	// pending has the callbacks of the commands waiting for replies, it's
+	// guarded by the mutex of the client
+	pending []func(any)
+}
+
+// NewSentinelClient returns a link of a sentinel to address, Run keeps it
+// connected.
+func NewSentinelClient(address string, setup func(*RedisClient), onPush func(PushReply)) *RedisClient {
+	client := NewRedisClient(address, 0, nil)
+	client.sentinel = &sentinelLink{setup: setup, onPush: onPush}
+	return client
+}
+
+// readReplies passes the replies read from conn to the callbacks of their
+// commands until the connection is lost.
+func (client *RedisClient) readReplies(conn *RedisConnect) {
+	for {
+		reply, err := conn.ReadReply()
+		if err != nil {
+			slog.Debug("sentinel link lost", "address", client.address, "err", err)
+			return
+		}
+		if push, ok := reply.(PushReply); ok {
+			if client.sentinel.onPush != nil {
+				client.sentinel.onPush(push)
+			}
+			continue
+		}
+		client.mu.Lock()
+		var callback func(any)
+		if pending := client.sentinel.pending; len(pending) > 0 {
+			callback = pending[0]
+			client.sentinel.pending = pending[1:]
+		}
+		client.mu.Unlock()
+		if callback != nil {
+			callback(reply)
+		}
+	}
+}
+
+// Send sends a command, callback gets its reply and may be nil. It returns
+// false if the link is down.
+func (client *RedisClient) Send(callback func(any), cmd string, args ...string) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.state != ReplStateConnected {
+		return false
+	}
+	return client.send(callback, cmd, args...)
+}
+
+// send sends a command during the setup too, client.mu must be held.
+func (client *RedisClient) send(callback func(any), cmd string, args ...string) bool {
+	if client.conn.SendCommand(cmd, args...) != nil {
+		return false
+	}
+	client.sentinel.pending = append(client.sentinel.pending, callback)
+	return true
+}
+
+// SendSetup sends a command of the setup, before the link is up.
+func (client *RedisClient) SendSetup(callback func(any), cmd string, args ...string) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.send(callback, cmd, args...)
+}
+
+// Subscribe subscribes a RESP3 link to channel during the setup, the
+// confirmation comes as a push message, so no reply is expected.
+func (client *RedisClient) Subscribe(channel string) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.conn.SendCommand("SUBSCRIBE", channel) == nil
+}
+
+// LocalIP returns the address of our side of the connection, other
+// sentinels reach us on it.
+func (client *RedisClient) LocalIP() string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.state != ReplStateConnected {
+		return ""
+	}
+	ip, _, _ := net.SplitHostPort(client.conn.Conn.LocalAddr().String())
+	return ip
+}
+
+// Reconnect drops the connection, Run opens a new one.
+func (client *RedisClient) Reconnect() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.state == ReplStateConnected {
+		client.conn.Kill()
+	}
+}
+
+// Close stops the link without waiting for Run to return, the callback it
+// may be running waits for the lock of the sentinel.
+func (client *RedisClient) Close() {
+	go client.Stop()
+}
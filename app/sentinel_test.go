@@ -0,0 +1,279 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// unusedAddress returns an address nothing listens on.
+func unusedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+func newTestSentinel(t *testing.T, address string, quorum int, downAfter, failoverTimeout time.Duration) (*Sentinel, *sentinelMaster) {
+	s := NewSentinel(0, sentinelMonitors{{name: "mymaster", address: address, quorum: quorum}}, downAfter, failoverTimeout)
+	t.Cleanup(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, master := range s.masters {
+			master.instance.link.Close()
+			for _, inst := range master.replicas {
+				inst.link.Close()
+			}
+			for _, inst := range master.sentinels {
+				inst.link.Close()
+			}
+		}
+	})
+	return s, s.masters["mymaster"]
+}
+
+// addPeer adds a sentinel as if it sent a hello message.
+func addPeer(t *testing.T, s *Sentinel, master *sentinelMaster, runID string) *sentinelInstance {
+	peer := s.newInstance(master, sentinelKindSentinel, unusedAddress(t))
+	peer.runID = runID
+	master.sentinels[runID] = peer
+	return peer
+}
+
+func TestSentinelDownStates(t *testing.T) {
+	downAfter := 100 * time.Millisecond
+	s, master := newTestSentinel(t, unusedAddress(t), 2, downAfter, time.Second)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst := master.instance
+	now := time.Now()
+
+	// an unreachable master is down once down-after passed
+	inst.lastAvailable = now.Add(-downAfter / 2)
+	s.checkInstance(master, inst, now)
+	if !inst.sdownSince.IsZero() {
+		t.Errorf("expected the master not down before down-after")
+	}
+	inst.lastAvailable = now.Add(-2 * downAfter)
+	s.checkInstance(master, inst, now)
+	if inst.sdownSince.IsZero() {
+		t.Errorf("expected the master subjectively down")
+	}
+
+	// alone it's not enough for the quorum of 2
+	peer := addPeer(t, s, master, "peer")
+	s.checkObjectivelyDown(master, now)
+	if !master.odownSince.IsZero() {
+		t.Errorf("expected the master not objectively down without the quorum")
+	}
+	peer.masterDown, peer.masterDownReplied = true, now
+	s.checkObjectivelyDown(master, now)
+	if master.odownSince.IsZero() {
+		t.Errorf("expected the master objectively down")
+	}
+	s.mu.Unlock()
+	down, leader, _ := s.IsMasterDownByAddr(inst.address, 0, "*")
+	s.mu.Lock()
+	if !down || leader != "*" {
+		t.Errorf("expected the master reported down without a vote, but got %v, %q", down, leader)
+	}
+	// replies of other sentinels expire
+	s.checkObjectivelyDown(master, now.Add(2*sentinelMasterDownValidity))
+	if !master.odownSince.IsZero() {
+		t.Errorf("expected the master not objectively down with an old reply")
+	}
+
+	// a PING unanswered for too long is down too, even with the link up
+	inst.lastAvailable = now
+	s.checkInstance(master, inst, now)
+	if !inst.sdownSince.IsZero() {
+		t.Errorf("expected the master available")
+	}
+	inst.pingPendingSince = now.Add(-2 * downAfter)
+	inst.reconnectedAt = now
+	s.checkInstance(master, inst, now)
+	if inst.sdownSince.IsZero() {
+		t.Errorf("expected the master down with a PING unanswered")
+	}
+}
+
+func TestSentinelLeaderElection(t *testing.T) {
+	s, master := newTestSentinel(t, unusedAddress(t), 2, time.Second, time.Second)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := addPeer(t, s, master, "a")
+	b := addPeer(t, s, master, "b")
+
+	// our own vote is not the majority of 3
+	if leader := s.electedLeader(master, 1); leader != "" {
+		t.Errorf("expected no leader, but got %q", leader)
+	}
+	if master.leader != s.runID || master.leaderEpoch != 1 {
+		t.Errorf("expected our vote for ourselves in epoch 1, but got %q in %d", master.leader, master.leaderEpoch)
+	}
+	a.leader, a.leaderEpoch = s.runID, 1
+	if leader := s.electedLeader(master, 1); leader != s.runID {
+		t.Errorf("expected us elected, but got %q", leader)
+	}
+
+	// we follow the sentinel the others voted for
+	a.leader, a.leaderEpoch = "b", 2
+	b.leader, b.leaderEpoch = "b", 2
+	if leader := s.electedLeader(master, 2); leader != "b" {
+		t.Errorf("expected b elected, but got %q", leader)
+	}
+
+	// one vote per epoch, asking again gets the same vote
+	s.mu.Unlock()
+	_, leader, epoch := s.IsMasterDownByAddr(master.instance.address, 3, "a")
+	_, again, againEpoch := s.IsMasterDownByAddr(master.instance.address, 3, "b")
+	s.mu.Lock()
+	if leader != "a" || epoch != 3 || again != "a" || againEpoch != 3 {
+		t.Errorf("expected the vote for a in epoch 3 kept, but got %q %d, then %q %d", leader, epoch, again, againEpoch)
+	}
+	if s.currentEpoch != 3 {
+		t.Errorf("expected the current epoch 3, but got %d", s.currentEpoch)
+	}
+}
+
+// fakeInstance answers the commands of a sentinel like a server whose INFO
+// replication is info. REPLICAOF NO ONE turns it into a master. It accepts
+// the PSYNC of a replica and sends it no stream.
+type fakeInstance struct {
+	listener net.Listener
+
+	mu        sync.Mutex
+	info      string
+	replicaOf []string
+	psync     []string
+	conns     []net.Conn
+}
+
+func newFakeInstance(t *testing.T, info string) *fakeInstance {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst := &fakeInstance{listener: listener, info: info}
+	go inst.serve()
+	t.Cleanup(inst.Close)
+	return inst
+}
+
+func (inst *fakeInstance) serve() {
+	for {
+		conn, err := inst.listener.Accept()
+		if err != nil {
+			return
+		}
+		inst.mu.Lock()
+		inst.conns = append(inst.conns, conn)
+		inst.mu.Unlock()
+		go inst.serveConn(NewRedisConnect(conn))
+	}
+}
+
+func (inst *fakeInstance) serveConn(conn *RedisConnect) {
+	defer conn.Kill()
+	for {
+		args, err := conn.ReadCommand()
+		if err != nil {
+			return
+		}
+		inst.mu.Lock()
+		switch strings.ToLower(args[0]) {
+		case "ping":
+			conn.Send(respString("PONG"))
+		case "info":
+			conn.Send(respBulkString(inst.info))
+		case "replicaof":
+			inst.replicaOf = args[1:]
+			if strings.EqualFold(strings.Join(args[1:], " "), "no one") {
+				inst.info = "# Replication\r\nrole:master\r\nconnected_slaves:0\r\n"
+			}
+			conn.Send(respString("OK"))
+		case "subscribe":
+			// the confirmation is a push message, sentinels ignore it
+		case "publish":
+			conn.Send(respInt(0))
+		case "psync":
+			inst.psync = args[1:]
+			conn.Send(respString("CONTINUE"))
+		case "replconf":
+			if !strings.EqualFold(args[1], "ack") {
+				conn.Send(respString("OK"))
+			}
+		default:
+			conn.Send(respString("OK"))
+		}
+		inst.mu.Unlock()
+	}
+}
+
+func (inst *fakeInstance) Address() string {
+	return inst.listener.Addr().String()
+}
+
+// Close stops the instance as if it crashed.
+func (inst *fakeInstance) Close() {
+	inst.listener.Close()
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	for _, conn := range inst.conns {
+		conn.Close()
+	}
+}
+
+// runUntil runs the sentinel until done returns true, done is called with
+// the lock of the sentinel.
+func runUntil(t *testing.T, s *Sentinel, what string, done func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		s.cron(time.Now())
+		s.mu.Lock()
+		ok := done()
+		s.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+func TestSentinelFailover(t *testing.T) {
+	replica := newFakeInstance(t, "")
+	master := newFakeInstance(t, "# Replication\r\nrole:master\r\nconnected_slaves:1\r\n"+
+		"slave0:ip=127.0.0.1,port="+portOf(replica.Address())+",state=online,offset=10,lag=0\r\n")
+	replica.info = "# Replication\r\nrole:slave\r\nmaster_host:127.0.0.1\r\nmaster_port:" + portOf(master.Address()) +
+		"\r\nmaster_link_status:up\r\nslave_repl_offset:10\r\n"
+
+	s, monitored := newTestSentinel(t, master.Address(), 1, 200*time.Millisecond, time.Second)
+	runUntil(t, s, "the replica discovered", func() bool {
+		r := monitored.replicas[replica.Address()]
+		return r != nil && r.link.IsLinkUp() && !r.lastInfo.IsZero()
+	})
+
+	master.Close()
+	runUntil(t, s, "the replica promoted", func() bool {
+		return monitored.instance.address == replica.Address()
+	})
+	replica.mu.Lock()
+	replicaOf := replica.replicaOf
+	replica.mu.Unlock()
+	if !slices.Equal(replicaOf, []string{"NO", "ONE"}) {
+		t.Errorf("expected REPLICAOF NO ONE sent to the replica, but got %q", replicaOf)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if monitored.replicas[master.Address()] == nil || monitored.configEpoch != 1 || monitored.failoverState != failoverNone {
+		t.Errorf("expected the old master a replica of the new one in config epoch 1, but got %v in %d",
+			monitored.replicas, monitored.configEpoch)
+	}
+}
@@ -1,21 +1,22 @@
 package main
 
 import (
-	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"log/slog"
+	"math"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
-)
 
-const (
-	workersCount = 4
-	bufSize      = 1024
+	"github.com/codecrafters-io/redis-starter-go/internal/appendonly"
+	"github.com/codecrafters-io/redis-starter-go/internal/rdb"
 )
 
 // command:
@@ -25,65 +26,190 @@ const (
 //
 
 var (
-	values      sync.Map
-	port        = flag.Int("port", 6379, "port")
-	logLevel    = flag.String("loglevel", "DEBUG", "log level")
-	replicaOf   = flag.String("replicaof", "", "master replica in format '<MASTER_HOST> <MASTER_PORT>'")
-	redisInfo   RedisInfo
-	redisClient *RedisClient
+	values = NewKeyspace()
+	// config holds the parameters, they are flags and lines of the config
+	// file too
+	config    = NewConfig(flag.CommandLine)
+	port      = config.Int("port", 6379, 0, 65535, 0, "port")
+	logLevel  = configVar(config, "loglevel", slog.LevelDebug, parseLogLevel, formatLogLevel, configMutable, "log level: debug, info, warn or error")
+	replicaOf = config.String("replicaof", "", 0, "master replica in format '<MASTER_HOST> <MASTER_PORT>'")
+	redisInfo RedisInfo
+
+	workers              = config.Int("workers", 4, 1, 1024, 0, "number of goroutines serving clients, each serves a client at a time, pub/sub subscribers and the clients of sentinels get goroutines of their own")
+	clientReadBufferSize = config.Memory("client-read-buffer-size", 1024, 16, 64*1024*1024, configMutable, "size of the read buffer of new connections")
+	// maxmemory is accepted for CONFIG GET and SET, but keys are never
+	// evicted
+	maxmemory = config.Memory("maxmemory", 0, 0, math.MaxInt64, configMutable, "memory limit of the dataset (0 for no limit), eviction is not enforced")
+
+	clientsRegistry = NewClientsRegistry()
+	pubSub          = NewPubSub()
+	// replicasManager serves replicas and keeps the replication stream
+	replicasManager *ReplicasManager
+
+	protoMaxBulkLen        = config.Memory("proto-max-bulk-len", 512*1024*1024, 1, maxBulkLength, configMutable, "max size of a single bulk string in a request")
+	clientQueryBufferLimit = config.Memory("client-query-buffer-limit", 1024*1024*1024, 1, maxQueryBufferLimit, configMutable, "max size of a single request")
+
+	clientOutputBufferLimits = configVar(config, "client-output-buffer-limit", outputBufferLimits{
+		ClientClassNormal:  {},
+		ClientClassReplica: {hard: 256 * 1024 * 1024, soft: 64 * 1024 * 1024, softSeconds: 60},
+		ClientClassPubSub:  {hard: 32 * 1024 * 1024, soft: 8 * 1024 * 1024, softSeconds: 60},
+	}, parseOutputBufferLimits, outputBufferLimits.String, configMutable, "output buffer limits in format '<class> <hard limit> <soft limit> <soft seconds>'")
+
+	replBacklogSize  = config.Memory("repl-backlog-size", 1024*1024, 1, math.MaxInt64, 0, "size of the replication backlog")
+	replDisklessSync = config.Bool("repl-diskless-sync", true, configMutable, "stream snapshots straight to replicas which support it")
+	replTimeout      = config.Int("repl-timeout", 60, 1, math.MaxInt32, configMutable, "drop the link with the master after N seconds without data from it, and a replica which reads nothing of a diskless snapshot for N seconds")
+	replPingPeriod   = config.Int("repl-ping-replica-period", 10, 1, math.MaxInt32, configMutable, "ping the replicas every N seconds, so they can tell a quiet master from a dead link")
+
+	idleTimeout  = config.Int("timeout", 0, 0, math.MaxInt32, configMutable, "close the connection after a client is idle for N seconds (0 to disable)")
+	tcpKeepAlive = config.Int("tcp-keepalive", 300, 0, math.MaxInt32, configMutable, "send TCP ACKs to clients every N seconds (0 to disable)")
+
+	minReplicasToWrite = config.Int("min-replicas-to-write", 0, 0, math.MaxInt32, configMutable, "refuse writes with less than N good replicas (0 to disable)")
+	minReplicasMaxLag  = config.Int("min-replicas-max-lag", 10, 0, math.MaxInt32, configMutable, "replicas which acked within N seconds are good")
+
+	replicaReadOnly       = config.Bool("replica-read-only", true, configMutable, "refuse writes of clients on replicas")
+	replicaServeStaleData = config.Bool("replica-serve-stale-data", true, configMutable, "serve data while a replica has no link with its master")
+
+	dir        = config.String("dir", ".", 0, "directory of the RDB file")
+	dbFilename = configVar(config, "dbfilename", "dump.rdb", parseDBFilename, strings.Clone, configMutable, "name of the RDB file")
+	save       = configVar(config, "save", savePoints{{3600, 1}, {300, 100}, {60, 10000}}, parseSavePoints, savePoints.String, configMutable|configMultiLine, "take a snapshot after N seconds if M keys changed, in format '<seconds> <changes> ...', empty to disable")
+	// persistence takes the snapshots and keeps the AOF
+	persistence *Persistence
+
+	appendOnly        = config.Bool("appendonly", false, 0, "log writes to the append only file and load it at startup instead of the RDB file")
+	appendFilename    = config.String("appendfilename", "appendonly.aof", 0, "base name of the append only files")
+	appendDirname     = config.String("appenddirname", "appendonlydir", 0, "directory of the append only files, inside dir")
+	appendFsync       = config.Enum("appendfsync", aofFsyncEverySec, []string{aofFsyncAlways, aofFsyncEverySec, aofFsyncNo}, 0, "when to fsync the append only file: always, everysec or no")
+	aofLoadTruncated  = config.Bool("aof-load-truncated", true, configMutable, "load an append only file with a command cut at the end, dropping that command")
+	aofUseRDBPreamble = config.Bool("aof-use-rdb-preamble", true, 0, "write the base file of rewrites in the RDB format")
+
+	autoAOFRewritePercentage = config.Int("auto-aof-rewrite-percentage", 100, 0, math.MaxInt32, configMutable, "rewrite the append only file when it grew by N percent since the last rewrite (0 to disable)")
+	autoAOFRewriteMinSize    = config.Memory("auto-aof-rewrite-min-size", 64*1024*1024, 0, math.MaxInt64, configMutable, "minimum size of the append only file for automatic rewrites")
+
+	// sentinels don't serve CONFIG, their parameters are only flags and
+	// lines of the config file
+	sentinelMode            = config.Bool("sentinel", false, configNoRewrite, "run as a sentinel of the masters given with --sentinel-monitor")
+	sentinelMonitorList     = configVar(config, "sentinel-monitor", sentinelMonitors(nil), parseSentinelMonitor, sentinelMonitors.String, configNoRewrite, "master to monitor in format '<name> <host> <port> <quorum>', can be repeated")
+	sentinelDownAfter       = config.Int("sentinel-down-after-milliseconds", 30000, 1, math.MaxInt32, configNoRewrite, "an instance not replying for N milliseconds is subjectively down")
+	sentinelFailoverTimeout = config.Int("sentinel-failover-timeout", 180000, 1, math.MaxInt32, configNoRewrite, "failover timeout in milliseconds")
 )
 
-type ValueWithExpiration struct {
-	Value  string
-	Expire time.Time
+// userCommandSource tells if clients talk to a master or to a replica, the
+// role can be changed by REPLICAOF at any moment.
+func userCommandSource() CommandSourceType {
+	if redisInfo.GetRole() == "slave" {
+		return UserToReplica
+	}
+	return UserToMaster
 }
 
-func getRDBSnapshot() []byte {
-	emptySnapshot := []byte("UkVESVMwMDEx+glyZWRpcy12ZXIFNy4yLjD6CnJlZGlzLWJpdHPAQPoFY3RpbWXCbQi8ZfoIdXNlZC1tZW3CsMQQAPoIYW9mLWJhc2XAAP/wbjv+wP9aog==")
-	rdbSnapshot := make([]byte, 88)
-	_, err := base64.StdEncoding.Decode(rdbSnapshot, emptySnapshot)
-	if err != nil {
-		log.Panic("something wrong with rdb snapshot", err)
+// execute runs a parsed command. Writes and the stream of the master are
+// applied under writeMu together with their propagation, so the stream has
+// them in the order they were applied and snapshots match its offset.
+func execute(logger *slog.Logger, commands map[string]CommandEntry, conn *RedisConnect, commandSource CommandSourceType, parsedCmd []string) error {
+	lwr := strings.ToLower(parsedCmd[0])
+	cmd, ok := commands[lwr]
+	isWrite := ok && cmd.Flags&FlagWrite != 0
+	if commandSource != MasterToReplica {
+		clientsRegistry.WaitUnpaused(isWrite)
+	}
+	if isWrite || conn.Stream != nil {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+	}
+	if conn.Stream != nil {
+		// everything from the master goes on, even commands we don't know
+		defer func() { conn.Stream(conn.raw) }()
+	}
+	if conn.Protocol != RESP3 && conn.subscriptions.Load() > 0 && !subscribedContextCommands[lwr] {
+		return sendError(conn, subscribedContextError(lwr))
+	}
+	if !ok {
+		logger.Warn("unknown command", "parsedCmd", parsedCmd)
+		if commandSource != MasterToReplica {
+			conn.Send(respError(fmt.Sprintf("ERR unknown command %s", lwr)))
+		}
+		return nil
+	}
+	if isWrite && commandSource == UserToMaster && !replicasManager.EnoughGoodReplicas() {
+		return sendError(conn, "NOREPLICAS Not enough good replicas to write.")
+	}
+	if isWrite && commandSource == UserToReplica && replicaReadOnly.Get() {
+		return sendError(conn, "READONLY You can't write against a read only replica.")
+	}
+	if commandSource == UserToReplica && cmd.Flags&FlagStale == 0 && !replicaServeStaleData.Get() {
+		if master := redisInfo.GetMaster(); master != nil && !master.IsLinkUp() {
+			return sendError(conn, "MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.")
+		}
 	}
-	res := []byte("$88\r\n")
-	res = append(res, rdbSnapshot...)
-	return res
+	conn.dirty = 0
+	err := cmd.Call(conn, commandSource, parsedCmd[1:]...)
+	// writes of clients to a writable replica stay local, the stream of the
+	// replica is the stream of its master
+	if isWrite && commandSource == UserToMaster && conn.dirty > 0 {
+		propagate(conn, parsedCmd)
+	}
+	if isWrite && conn.dirty > 0 {
+		persistence.FeedAOF(parsedCmd)
+	}
+	return err
 }
 
-func readFromConnection(logger *slog.Logger, commands map[string]Command, conn *RedisConnect, commandSource CommandSourceType) {
+func readFromConnection(logger *slog.Logger, commands map[string]CommandEntry, conn *RedisConnect, commandSource CommandSourceType) {
 	var (
 		err       error
 		parsedCmd []string
 	)
 	for parsedCmd, err = conn.ReadCommand(); err == nil; parsedCmd, err = conn.ReadCommand() {
+		// like Redis, empty multibulks are skipped
 		if len(parsedCmd) == 0 {
-			conn.Send(respError("ERR empty command"))
-			return
+			continue
+		}
+		source := commandSource
+		if source != MasterToReplica {
+			source = userCommandSource()
+		}
+		conn.touch(parsedCmd)
+		if err = execute(logger, commands, conn, source, parsedCmd); err != nil {
+			logger.Warn("error perform command", "cmd", parsedCmd[0], "err", err)
+		}
+		if errors.Is(err, errConnectionClosed) {
+			break
 		}
-		lwr := strings.ToLower(parsedCmd[0])
-		cmd, ok := commands[lwr]
-		if !ok {
-			logger.Warn("unknown command", "parsedCmd", parsedCmd)
-			if commandSource != MasterToReplica {
-				conn.Send(respError(fmt.Sprintf("ERR unknown command %s", lwr)))
-			}
-		} else {
-			if err = cmd.Call(conn, commandSource, parsedCmd[1:]...); err != nil {
-				logger.Warn("error perform command", "cmd", cmd, "err", err)
-			}
+		conn.commandDone()
+		if conn.closeAfterReply {
+			err = nil
+			break
 		}
 
 		conn.RememberPreviousBytes()
 		if conn.IsBorrowed {
 			break
 		}
+		if !conn.detached && conn.longLived() {
+			// serveConnection moves the client to a goroutine of its own
+			conn.detached = true
+			break
+		}
+	}
+	var protocolErr *ProtocolError
+	if errors.As(err, &protocolErr) && commandSource != MasterToReplica {
+		conn.Send(respError("ERR " + protocolErr.Error()))
+	}
+	if errors.Is(err, errQueryBufferLimit) {
+		redisInfo.stats.clientQueryBufferLimitDisconnections.Add(1)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		logger.Info("closing idle client", "client", conn.ID)
+		return
+	}
+	if err != nil {
+		logger.Warn("failed read", "err", err)
 	}
-	logger.Warn("failed read", "err", err)
 	return
 }
 
 // TODO: move logger to context
-func commandWorker(commandSource CommandSourceType, workerId int, listener net.Listener, commands map[string]Command) {
+func commandWorker(workerId int, listener net.Listener, commands map[string]CommandEntry) {
 	logger := slog.Default().With("worker", workerId)
 
 	for {
@@ -94,82 +220,203 @@ func commandWorker(commandSource CommandSourceType, workerId int, listener net.L
 			continue
 		}
 		logger.Debug("new connection established")
-		redisConn := NewRedisConnect(conn)
-		readFromConnection(logger, commands, redisConn, commandSource)
-		if !redisConn.IsBorrowed {
-			conn.Close()
-		}
+		serveConnection(logger, commands, NewRedisConnect(conn))
+	}
+}
+
+// serveConnection serves a client until it disconnects or its connection
+// is borrowed. Clients staying connected for long move to a goroutine of
+// their own, so they don't keep a worker from the others.
+func serveConnection(logger *slog.Logger, commands map[string]CommandEntry, conn *RedisConnect) {
+	wasDetached := conn.detached
+	if !conn.detached && conn.longLived() {
+		conn.detached = true
+	} else {
+		readFromConnection(logger, commands, conn, UserToMaster)
+	}
+	switch {
+	case conn.detached && !wasDetached:
+		go serveConnection(logger, commands, conn)
+	case conn.IsBorrowed:
+		conn.release()
+	default:
+		conn.Close()
 	}
 }
 
+// serve runs the workers accepting clients.
+func serve(listener net.Listener, commands map[string]CommandEntry) {
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers.Get(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			commandWorker(i, listener, commands)
+		}()
+	}
+	wg.Wait()
+}
+
+// runSentinel serves clients and other sentinels while monitoring masters.
+func runSentinel(listener net.Listener) {
+	sentinel := NewSentinel(
+		port.Get(),
+		sentinelMonitorList.Get(),
+		time.Duration(sentinelDownAfter.Get())*time.Millisecond,
+		time.Duration(sentinelFailoverTimeout.Get())*time.Millisecond,
+	)
+	commands := map[string]CommandEntry{
+		"ping":        {CommandPing{}, FlagFast | FlagStale},
+		"info":        {CommandSentinelInfo{sentinel}, FlagStale},
+		"hello":       {CommandHello{redisInfo: &redisInfo}, FlagFast | FlagStale},
+		"client":      {CommandClient{clients: clientsRegistry}, FlagAdmin | FlagStale},
+		"sentinel":    {CommandSentinel{sentinel}, FlagAdmin | FlagStale},
+		"subscribe":   {CommandSubscribe{pubSub}, FlagStale},
+		"unsubscribe": {CommandUnsubscribe{pubSub}, FlagStale},
+	}
+	go sentinel.Run()
+	serve(listener, commands)
+}
+
 func parseAddress(hostPort string) string {
 	return strings.Join(strings.Split(hostPort, " "), ":")
 }
 
-func main() {
-	var (
-		level           slog.Level
-		replicasManager *ReplicasManager
-		commandSource   CommandSourceType
-	)
-	flag.Parse()
-	err := level.UnmarshalText([]byte(*logLevel))
+// levelFunc lets the logger follow CONFIG SET loglevel.
+type levelFunc func() slog.Level
+
+func (f levelFunc) Level() slog.Level {
+	return f()
+}
+
+// parseLogLevel accepts the levels of slog and the ones of redis.conf.
+func parseLogLevel(_ slog.Level, s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "verbose":
+		return slog.LevelDebug, nil
+	case "notice":
+		return slog.LevelInfo, nil
+	case "warning":
+		return slog.LevelWarn, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", s)
+	}
+	return level, nil
+}
+
+func formatLogLevel(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
+
+// loadRDBFile fills the keyspace from the RDB file, the server starts empty
+// when there is no file.
+func loadRDBFile(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Info("No RDB file, starting empty", "path", path)
+		return nil
+	}
 	if err != nil {
-		log.Panicf("error parsing log-level: %v", err)
+		return err
+	}
+	defer file.Close()
+	start := time.Now()
+	data, err := rdb.Read(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	values.Replace(data)
+	slog.Info("DB loaded from disk", "keys", len(data), "seconds", time.Since(start).Seconds())
+	return nil
+}
+
+func main() {
+	var master *RedisClient
+	if err := config.Load(os.Args[1:]); err != nil {
+		log.Fatalf("Failed loading config: %v", err)
 	}
 	logger := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-		Level: level,
+		Level: levelFunc(logLevel.Get),
 	})
 	slog.SetDefault(slog.New(logger))
 
-	if *replicaOf != "" {
-		commandSource = UserToReplica
-		redisInfo = NewRedisInfo("slave")
-		address := parseAddress(*replicaOf)
-		redisClient, err = NewRedisClient(address, *port)
-		if err != nil {
-			log.Panic(err)
-		}
-		slog.Info("connected to redis server", "address", address)
-	} else {
-		commandSource = UserToMaster
-		redisInfo = NewRedisInfo("master")
-		replicasManager = NewReplicasManager()
+	backlog := NewReplicationBacklog(replBacklogSize.Get())
+	replicasManager = NewReplicasManager(backlog, values)
+	role := "master"
+	if replicaOf.Get() != "" {
+		role = "slave"
+		master = NewRedisClient(parseAddress(replicaOf.Get()), port.Get(), replicasManager)
 	}
+	persistence = NewPersistence(values, func() string { return filepath.Join(dir.Get(), dbFilename.Get()) })
+	redisInfo = NewRedisInfo(role, replicasManager, master, persistence)
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", *port))
+	if sentinelMode.Get() && !config.IsSet("port") {
+		port.Set(strconv.Itoa(sentinelDefaultPort))
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port.Get()))
 	if err != nil {
-		log.Fatalf("Failed to bind to port %d", *port)
+		log.Fatalf("Failed to bind to port %d", port.Get())
 		os.Exit(1)
 	}
-	slog.Debug("redis is listening", "port", *port)
-
-	commands := map[string]Command{
-		"echo":     CommandEcho{},
-		"ping":     CommandPing{},
-		"set":      CommandSet{replicasManager: replicasManager, values: &values},
-		"get":      CommandGet{values: &values},
-		"info":     CommandInfo{redisInfo: &redisInfo},
-		"replconf": CommandReplConf{},
-		"psync":    CommandPsync{replicasManager},
-		"wait":     CommandWait{replicasManager},
+	slog.Debug("redis is listening", "port", port.Get())
+	if sentinelMode.Get() {
+		runSentinel(listener)
+		return
 	}
 
-	wg := sync.WaitGroup{}
+	commands := map[string]CommandEntry{
+		"echo":     {CommandEcho{}, FlagFast},
+		"ping":     {CommandPing{}, FlagFast | FlagStale},
+		"set":      {CommandSet{values: values}, FlagWrite},
+		"get":      {CommandGet{values: values}, FlagReadonly | FlagFast},
+		"del":      {CommandDel{values: values}, FlagWrite},
+		"keys":     {CommandKeys{values: values}, FlagReadonly},
+		"type":     {CommandType{values: values}, FlagReadonly | FlagFast},
+		"config":   {CommandConfig{config, &redisInfo}, FlagAdmin | FlagStale},
+		"save":     {CommandSave{persistence}, FlagAdmin},
+		"bgsave":   {CommandBgsave{persistence}, FlagAdmin},
+		"lastsave": {CommandLastSave{persistence}, FlagFast | FlagStale},
 
-	for i := 0; i < 4; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			commandWorker(commandSource, i, listener, commands)
-		}()
+		"bgrewriteaof": {CommandBgRewriteAOF{persistence}, FlagAdmin},
+		"info":         {CommandInfo{redisInfo: &redisInfo}, FlagStale},
+		"hello":        {CommandHello{redisInfo: &redisInfo}, FlagFast | FlagStale},
+		"client":       {CommandClient{clients: clientsRegistry}, FlagAdmin | FlagStale},
+		"replconf":     {CommandReplConf{}, FlagAdmin | FlagStale},
+		"wait":         {CommandWait{replicasManager}, 0},
+
+		"subscribe":   {CommandSubscribe{pubSub}, FlagStale},
+		"unsubscribe": {CommandUnsubscribe{pubSub}, FlagStale},
+		"publish":     {CommandPublish{pubSub}, FlagFast | FlagStale},
 	}
+	// role changes start replication, which applies commands
+	roles := NewRoleManager(replicasManager, commands, port.Get())
+	commands["psync"] = CommandEntry{CommandPsync{replicasManager, roles}, FlagAdmin}
+	replicaOfCmd := CommandEntry{CommandReplicaOf{roles}, FlagAdmin | FlagStale}
+	commands["replicaof"] = replicaOfCmd
+	commands["slaveof"] = replicaOfCmd
+	commands["failover"] = CommandEntry{CommandFailover{NewFailover(roles, replicasManager)}, FlagAdmin | FlagStale}
 
-	if replicasManager != nil {
-		go replicasManager.NotifyReplicas()
-		// TODO: graceful replica notifiers
-	} else {
-		go redisClient.Listen(commands)
+	// the AOF has the latest writes, the RDB file is used without it
+	if appendOnly.Get() {
+		paths := appendonly.NewPaths(dir.Get(), appendDirname.Get(), appendFilename.Get())
+		if err := loadAppendOnlyFiles(paths, commands, values, aofLoadTruncated.Get()); err != nil {
+			log.Fatalf("Failed loading AOF: %v", err)
+		}
+		aof, err := OpenAppendOnlyFile(paths, appendFsync.Get(), aofUseRDBPreamble.Get(), values)
+		if err != nil {
+			log.Fatalf("Failed opening AOF: %v", err)
+		}
+		persistence.SetAOF(aof)
+	} else if err := loadRDBFile(filepath.Join(dir.Get(), dbFilename.Get())); err != nil {
+		log.Fatalf("Failed loading RDB: %v", err)
 	}
-	wg.Wait()
+
+	if master != nil {
+		go master.Run(commands)
+	}
+	go persistence.Run(save, autoAOFRewritePercentage, autoAOFRewriteMinSize)
+	go replicasManager.Run(replPingPeriod)
+	serve(listener, commands)
 }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// parseMemory parses sizes the way redis.conf does: a plain number of bytes
+// or a number with one of the k, kb, m, mb, g, gb units (case insensitive).
+func parseMemory(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"gb", 1024 * 1024 * 1024},
+		{"mb", 1024 * 1024},
+		{"kb", 1024},
+		{"g", 1000 * 1000 * 1000},
+		{"m", 1000 * 1000},
+		{"k", 1000},
+		{"b", 1},
+	}
+	lwr := strings.ToLower(s)
+	mul := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(lwr, unit.suffix) {
+			lwr, mul = strings.TrimSuffix(lwr, unit.suffix), unit.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lwr, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mul {
+		return 0, fmt.Errorf("invalid memory value %q", s)
+	}
+	return n * mul, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected int64
+		ok       bool
+	}{
+		{"100", 100, true},
+		{"1k", 1000, true},
+		{"1KB", 1024, true},
+		{"2mb", 2 * 1024 * 1024, true},
+		{"3g", 3000 * 1000 * 1000, true},
+		{"8589934591gb", 8589934591 << 30, true},
+		{"9223372036854775807", 9223372036854775807, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"1tb", 0, false},
+		{"8589934592gb", 0, false},
+		{"17179869185gb", 0, false},
+		{"9223372036854775807k", 0, false},
+		{"9223372036854775808", 0, false},
+	}
+	for _, test := range tests {
+		n, err := parseMemory(test.s)
+		if test.ok && (err != nil || n != test.expected) {
+			t.Errorf("%q: expected %d, but got %d, %v", test.s, test.expected, n, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%q: expected error, but got %d", test.s, n)
+		}
+	}
+}
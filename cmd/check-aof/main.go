@@ -0,0 +1,139 @@
+// Command check-aof validates an append only file offline. It accepts the
+// manifest of the multi part layout, the directory holding it, or a single
+// file. Every file listed is parsed command by command, an RDB preamble is
+// decoded and its checksum verified. The first bad command is reported with
+// its offset, and -fix truncates the last file to the last valid command.
+//
+//	check-aof [-fix] appendonlydir/appendonly.aof.manifest
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/appendonly"
+	"github.com/codecrafters-io/redis-starter-go/internal/rdb"
+)
+
+func main() {
+	fix := flag.Bool("fix", false, "truncate the last file to the last valid command")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-fix] <manifest|dir|file.aof>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	files, err := listFiles(flag.Arg(0))
+	if err == nil {
+		err = check(files, *fix)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// listFiles returns the files to check in the order they are loaded.
+func listFiles(path string) ([]string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if stat.IsDir() {
+		manifests, err := filepath.Glob(filepath.Join(path, "*"+appendonly.ManifestSuffix))
+		if err != nil {
+			return nil, err
+		}
+		if len(manifests) != 1 {
+			return nil, fmt.Errorf("expected one manifest in %s, found %d", path, len(manifests))
+		}
+		path = manifests[0]
+	}
+	if !strings.HasSuffix(path, appendonly.ManifestSuffix) {
+		return []string{path}, nil
+	}
+	manifest, err := appendonly.ReadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, info := range manifest.Files() {
+		files = append(files, filepath.Join(filepath.Dir(path), info.Name))
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("manifest %s lists no files", path)
+	}
+	return files, nil
+}
+
+func check(files []string, fix bool) error {
+	for i, path := range files {
+		last := i == len(files)-1
+		valid, err := checkFile(path)
+		if err == nil {
+			continue
+		}
+		fmt.Printf("%s: ok up to offset %d\n", path, valid)
+		err = fmt.Errorf("%s: %w", path, err)
+		if !fix {
+			return err
+		}
+		var rdbErr *rdb.Error
+		if !last || errors.As(err, &rdbErr) {
+			// a bad preamble or a file other than the last can't be fixed
+			// without losing the writes after it
+			return fmt.Errorf("%w, only the commands at the end of the last file can be truncated", err)
+		}
+		fmt.Println(err)
+		if err := os.Truncate(path, valid); err != nil {
+			return fmt.Errorf("truncating %s: %w", path, err)
+		}
+		fmt.Printf("%s: truncated to %d bytes\n", path, valid)
+	}
+	fmt.Println("AOF looks OK")
+	return nil
+}
+
+// checkFile parses path and returns the offset after the last valid command.
+func checkFile(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := appendonly.NewReader(file)
+	if reader.HasPreamble() {
+		keys := 0
+		info, err := rdb.Decode(reader, func(rdb.Key) error {
+			keys++
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("RDB preamble: %w", err)
+		}
+		fmt.Printf("%s: RDB preamble version %d with %d keys\n", path, info.Version, keys)
+	}
+	commands := 0
+	for {
+		_, err := reader.ReadCommand()
+		if err == nil {
+			commands++
+			continue
+		}
+		if errors.Is(err, appendonly.ErrTruncated) {
+			err = fmt.Errorf("command truncated at offset %d", reader.Offset())
+		} else if err == io.EOF {
+			fmt.Printf("%s: %d commands\n", path, commands)
+			return reader.Offset(), nil
+		}
+		return reader.Offset(), err
+	}
+}
@@ -0,0 +1,115 @@
+// Command check-rdb validates an RDB file offline. It decodes every record,
+// verifies the checksum and reports the first record it can't decode. With
+// -json it dumps the keys, one JSON object per line.
+//
+//	check-rdb [-json] dump.rdb
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/rdb"
+)
+
+// keyRecord is a key dumped by -json, the expiration fields are omitted for
+// keys without one.
+type keyRecord struct {
+	Offset   int64  `json:"offset"`
+	DB       uint64 `json:"db"`
+	Key      string `json:"key"`
+	Type     string `json:"type"`
+	Encoding string `json:"encoding"`
+	ExpireAt *int64 `json:"expire_at_ms,omitempty"`
+	TTL      *int64 `json:"ttl_ms,omitempty"`
+}
+
+func newKeyRecord(key rdb.Key, now time.Time) keyRecord {
+	record := keyRecord{
+		Offset:   key.Offset,
+		DB:       key.DB,
+		Key:      key.Name,
+		Type:     "string",
+		Encoding: rdb.TypeName(key.Type),
+	}
+	if key.Value.Object != nil {
+		record.Type = key.Value.Object.Type.String()
+	}
+	if !key.Value.Expire.IsZero() {
+		// the TTL is negative for keys which are already expired
+		expireAt, ttl := key.Value.Expire.UnixMilli(), key.Value.Expire.Sub(now).Milliseconds()
+		record.ExpireAt, record.TTL = &expireAt, &ttl
+	}
+	return record
+}
+
+func main() {
+	dumpJSON := flag.Bool("json", false, "dump the keys as JSON lines to stdout, the report goes to stderr")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-json] <file.rdb>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := check(flag.Arg(0), *dumpJSON); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func check(path string, dumpJSON bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	report := os.Stdout
+	if dumpJSON {
+		report = os.Stderr
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	encoder := json.NewEncoder(out)
+
+	now := time.Now()
+	keys, expired := 0, 0
+	info, err := rdb.Decode(bufio.NewReader(file), func(key rdb.Key) error {
+		keys++
+		if key.Value.IsExpired(now) {
+			expired++
+		}
+		if dumpJSON {
+			return encoder.Encode(newKeyRecord(key, now))
+		}
+		return nil
+	})
+	if info.Version > 0 {
+		fmt.Fprintf(report, "RDB version %d\n", info.Version)
+	}
+	for _, field := range info.Aux {
+		fmt.Fprintf(report, "aux %s: %s\n", field.Key, field.Value)
+	}
+	fmt.Fprintf(report, "keys: %d, already expired: %d\n", keys, expired)
+	var rdbErr *rdb.Error
+	if errors.As(err, &rdbErr) {
+		return fmt.Errorf("first bad record: %s at offset %d: %v", rdbErr.Record, rdbErr.Offset, rdbErr.Err)
+	}
+	if err != nil {
+		return err
+	}
+	if info.Checksum == 0 {
+		fmt.Fprintln(report, "checksum: disabled")
+	} else {
+		fmt.Fprintf(report, "checksum: %016x ok\n", info.Checksum)
+	}
+	fmt.Fprintln(report, "RDB looks OK")
+	return nil
+}
@@ -0,0 +1,94 @@
+package appendonly
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	paths := NewPaths(t.TempDir(), ".", "appendonly.aof")
+	manifest := &Manifest{
+		Base:    &FileInfo{Name: paths.BaseName(2, true), Seq: 2, Type: TypeBase},
+		Incrs:   []FileInfo{{Name: paths.IncrName(3), Seq: 3, Type: TypeIncr}, {Name: paths.IncrName(4), Seq: 4, Type: TypeIncr}},
+		BaseSeq: 2,
+		IncrSeq: 4,
+	}
+	if err := WriteManifest(paths, manifest); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadManifest(paths.Manifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.String() != manifest.String() || read.BaseSeq != 2 || read.IncrSeq != 4 {
+		t.Errorf("expected %q, but got %q", manifest, read)
+	}
+	if read.Base.Name != "appendonly.aof.2.base.rdb" || read.Incrs[0].Name != "appendonly.aof.3.incr.aof" {
+		t.Errorf("unexpected file names in %q", read)
+	}
+}
+
+func TestReaderCommands(t *testing.T) {
+	complete := "*2\r\n$3\r\nGET\r\n$1\r\na\r\n*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$4\r\n1\r\n2\r\n"
+	reader := NewReader(strings.NewReader(complete))
+	var commands [][]string
+	for {
+		cmd, err := reader.ReadCommand()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		commands = append(commands, cmd)
+	}
+	expected := [][]string{{"GET", "a"}, {"SET", "b", "1\r\n2"}}
+	if !slices.EqualFunc(commands, expected, slices.Equal) {
+		t.Errorf("expected %q, but got %q", expected, commands)
+	}
+	if reader.Offset() != int64(len(complete)) {
+		t.Errorf("expected offset %d, but got %d", len(complete), reader.Offset())
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	first := "*2\r\n$3\r\nGET\r\n$1\r\na\r\n"
+	tests := []struct {
+		name   string
+		tail   string
+		err    error
+		offset int64
+	}{
+		{"truncated line", "*2\r\n$3", ErrTruncated, 0},
+		{"only the count", "*3\r\n", ErrTruncated, 0},
+		{"missing elements", "*2\r\n$3\r\nSET\r\n", ErrTruncated, 0},
+		{"truncated payload", "*2\r\n$3\r\nGET\r\n$5\r\nab", ErrTruncated, 0},
+		{"missing CRLF", "*1\r\n$3\r\nGET\r", ErrTruncated, 0},
+		{"not a command", "+OK\r\n", &FormatError{}, 0},
+		{"bad bulk", "*1\r\n:3\r\n", &FormatError{}, 4},
+		{"huge bulk", "*1\r\n$9223372036854775807\r\nx", &FormatError{}, 4},
+		{"bad terminator", "*1\r\n$3\r\nGETxx*1", &FormatError{}, 4},
+	}
+	for _, test := range tests {
+		reader := NewReader(strings.NewReader(first + test.tail))
+		if _, err := reader.ReadCommand(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		_, err := reader.ReadCommand()
+		var formatErr *FormatError
+		switch {
+		case test.err == ErrTruncated && !errors.Is(err, ErrTruncated):
+			t.Errorf("%s: expected truncated error, but got %v", test.name, err)
+		case test.err != ErrTruncated && !errors.As(err, &formatErr):
+			t.Errorf("%s: expected format error, but got %v", test.name, err)
+		case formatErr != nil && formatErr.Offset != int64(len(first))+test.offset:
+			t.Errorf("%s: expected offset %d, but got %d", test.name, int64(len(first))+test.offset, formatErr.Offset)
+		}
+		if reader.Offset() != int64(len(first)) {
+			t.Errorf("%s: expected valid offset %d, but got %d", test.name, len(first), reader.Offset())
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Package appendonly reads the files of the append only log of Redis: the
+// manifest of the multi part layout and the commands of each file.
+package appendonly
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	ManifestSuffix  = ".manifest"
+	BaseSuffix      = ".base"
+	IncrSuffix      = ".incr"
+	RDBFormatSuffix = ".rdb"
+	FormatSuffix    = ".aof"
+
+	TypeBase    = "b"
+	TypeHistory = "h"
+	TypeIncr    = "i"
+)
+
+// Paths locates the files of the AOF, they are in dir and named after
+// name. legacy is the single file AOF of older versions.
+type Paths struct {
+	Dir    string
+	Name   string
+	Legacy string
+}
+
+func NewPaths(dir, dirName, name string) Paths {
+	return Paths{
+		Dir:    filepath.Join(dir, dirName),
+		Name:   name,
+		Legacy: filepath.Join(dir, name),
+	}
+}
+
+func (paths Paths) File(name string) string {
+	return filepath.Join(paths.Dir, name)
+}
+
+func (paths Paths) Manifest() string {
+	return paths.File(paths.Name + ManifestSuffix)
+}
+
+type FileInfo struct {
+	Name string
+	Seq  int
+	// Type is TypeBase, TypeIncr or TypeHistory
+	Type string
+}
+
+// BaseName names the base file created by a rewrite.
+func (paths Paths) BaseName(seq int, rdbPreamble bool) string {
+	format := FormatSuffix
+	if rdbPreamble {
+		format = RDBFormatSuffix
+	}
+	return fmt.Sprintf("%s.%d%s%s", paths.Name, seq, BaseSuffix, format)
+}
+
+// IncrName names an incr file.
+func (paths Paths) IncrName(seq int) string {
+	return fmt.Sprintf("%s.%d%s%s", paths.Name, seq, IncrSuffix, FormatSuffix)
+}
+
+// Manifest lists the base file and the incr files in the order they are
+// loaded. History files, left by rewrites which were interrupted before
+// deleting them, are dropped when it is read.
+type Manifest struct {
+	Base    *FileInfo
+	Incrs   []FileInfo
+	BaseSeq int
+	IncrSeq int
+}
+
+// Files returns the base and the incr files.
+func (manifest *Manifest) Files() []FileInfo {
+	var res []FileInfo
+	if manifest.Base != nil {
+		res = append(res, *manifest.Base)
+	}
+	return append(res, manifest.Incrs...)
+}
+
+func (manifest *Manifest) String() string {
+	var res strings.Builder
+	for _, info := range manifest.Files() {
+		fmt.Fprintf(&res, "file %s seq %d type %s\n", info.Name, info.Seq, info.Type)
+	}
+	return res.String()
+}
+
+// ReadManifest parses lines in format "file <name> seq <seq> type <type>".
+func ReadManifest(path string) (*Manifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	manifest := &Manifest{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid AOF manifest %s line %d", path, line)
+		}
+		info := FileInfo{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.Name = fields[i+1]
+			case "seq":
+				if info.Seq, err = strconv.Atoi(fields[i+1]); err != nil {
+					return nil, fmt.Errorf("invalid AOF manifest %s line %d", path, line)
+				}
+			case "type":
+				info.Type = fields[i+1]
+			}
+		}
+		if info.Name == "" || strings.ContainsRune(info.Name, filepath.Separator) {
+			return nil, fmt.Errorf("invalid AOF file name in manifest %s line %d", path, line)
+		}
+		switch info.Type {
+		case TypeBase:
+			if manifest.Base != nil {
+				return nil, fmt.Errorf("more than one base AOF in manifest %s", path)
+			}
+			manifest.Base = &info
+			manifest.BaseSeq = info.Seq
+		case TypeIncr:
+			if info.Seq <= manifest.IncrSeq {
+				return nil, fmt.Errorf("incr AOF files out of order in manifest %s", path)
+			}
+			manifest.Incrs = append(manifest.Incrs, info)
+			manifest.IncrSeq = info.Seq
+		case TypeHistory:
+		default:
+			return nil, fmt.Errorf("unknown AOF file type %q in manifest %s line %d", info.Type, path, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// WriteManifest replaces the manifest atomically.
+func WriteManifest(paths Paths, manifest *Manifest) error {
+	file, err := os.CreateTemp(paths.Dir, "temp-"+paths.Name+ManifestSuffix+"-*")
+	if err != nil {
+		return fmt.Errorf("creating temp AOF manifest: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if _, err := file.WriteString(manifest.String()); err != nil {
+		return fmt.Errorf("writing AOF manifest: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("syncing AOF manifest: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("closing AOF manifest: %w", err)
+	}
+	if err := os.Rename(file.Name(), paths.Manifest()); err != nil {
+		return fmt.Errorf("renaming temp AOF manifest: %w", err)
+	}
+	return nil
+}
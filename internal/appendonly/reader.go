@@ -0,0 +1,155 @@
+package appendonly
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	// maxLineSize limits the lines with counts and lengths
+	maxLineSize = 64 * 1024
+	maxPrealloc = 1024
+	// maxBulkLen is above any proto-max-bulk-len the server accepts, longer
+	// bulks are corruption
+	maxBulkLen = 4 * 1024 * 1024 * 1024
+)
+
+// ErrTruncated is returned when a file ends in the middle of a command, as
+// it happens when the server is killed while writing.
+var ErrTruncated = errors.New("unexpected end of file")
+
+// FormatError reports bytes which are not a command.
+type FormatError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("bad format at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+// Reader reads the commands of an AOF file. Files can start with an RDB
+// snapshot, the preamble, which is read through the Reader itself.
+type Reader struct {
+	r *bufio.Reader
+	// offset counts the bytes read, valid is the end of the last complete
+	// command or of the preamble
+	offset int64
+	valid  int64
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+// HasPreamble tells if the file starts with an RDB snapshot.
+func (r *Reader) HasPreamble() bool {
+	signature, _ := r.r.Peek(5)
+	return r.offset == 0 && string(signature) == "REDIS"
+}
+
+// Offset returns the end of the last complete command, a truncated file
+// can be cut there.
+func (r *Reader) Offset() int64 {
+	return r.valid
+}
+
+// ReadCommand returns the next command, io.EOF at the end of the file, and
+// ErrTruncated when the file ends in the middle of the command.
+func (r *Reader) ReadCommand() ([]string, error) {
+	r.valid = r.offset
+	line, err := r.readLine()
+	if err == io.EOF && r.offset == r.valid {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return nil, &FormatError{r.valid, fmt.Errorf("expected '*', got %q", line)}
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 1 {
+		return nil, &FormatError{r.valid, fmt.Errorf("invalid command length %q", line[1:])}
+	}
+	res := make([]string, 0, min(count, maxPrealloc))
+	for i := 0; i < count; i++ {
+		start := r.offset
+		line, err := r.readLine()
+		if err == io.EOF {
+			// the file ends right after a line of the command
+			return nil, ErrTruncated
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, &FormatError{start, fmt.Errorf("expected '$', got %q", line)}
+		}
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil || n < 0 || n > maxBulkLen {
+			return nil, &FormatError{start, fmt.Errorf("invalid bulk length %q", line[1:])}
+		}
+		// the buffer grows while the payload is read, so a corrupted length
+		// doesn't allocate anything up front
+		var buf bytes.Buffer
+		copied, err := io.CopyN(&buf, r.r, n+2)
+		r.offset += copied
+		if err == io.EOF {
+			return nil, ErrTruncated
+		}
+		if err != nil {
+			return nil, err
+		}
+		payload := buf.Bytes()
+		if payload[n] != '\r' || payload[n+1] != '\n' {
+			return nil, &FormatError{start, errors.New("bulk string is not terminated by CRLF")}
+		}
+		res = append(res, string(payload[:n]))
+	}
+	return res, nil
+}
+
+// readLine reads a line ending with CRLF, without it.
+func (r *Reader) readLine() (string, error) {
+	start := r.offset
+	var line []byte
+	for {
+		chunk, err := r.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		r.offset += int64(len(chunk))
+		if len(line) > maxLineSize {
+			return "", &FormatError{start, errors.New("line too long")}
+		}
+		if err == io.EOF {
+			if len(line) == 0 {
+				return "", io.EOF
+			}
+			return "", ErrTruncated
+		}
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", &FormatError{start, errors.New("line is not terminated by CRLF")}
+	}
+	return string(line[:len(line)-2]), nil
+}
@@ -0,0 +1,372 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Compact encodings Redis stores small values with inside RDB strings.
+
+// lzfDecompress expands LZF data to n bytes. Each control byte either starts
+// a run of up to 32 literal bytes, or is a back reference with a length in
+// its top 3 bits and the high bits of the offset in the low 5.
+func lzfDecompress(in []byte, n int) (string, error) {
+	corrupted := errors.New("corrupted LZF data")
+	out := make([]byte, 0, min(n, maxPrealloc))
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			length := ctrl + 1
+			if i+length > len(in) {
+				return "", corrupted
+			}
+			out = append(out, in[i:i+length]...)
+			i += length
+			continue
+		}
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return "", corrupted
+			}
+			length += int(in[i])
+			i++
+		}
+		length += 2
+		if i >= len(in) {
+			return "", corrupted
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return "", corrupted
+		}
+		// the reference may overlap the bytes being appended
+		for j := 0; j < length; j++ {
+			out = append(out, out[ref+j])
+		}
+		if len(out) > n {
+			return "", corrupted
+		}
+	}
+	if len(out) != n {
+		return "", fmt.Errorf("LZF data expands to %d bytes instead of %d", len(out), n)
+	}
+	return string(out), nil
+}
+
+// parseZiplist returns the entries of a ziplist: a header with the total
+// size, the tail offset and the count, then entries made of the length of
+// the previous entry, an encoding and the data, and a 0xFF terminator.
+func parseZiplist(b []byte) ([]string, error) {
+	corrupted := errors.New("corrupted ziplist")
+	if len(b) < 11 || binary.LittleEndian.Uint32(b) != uint32(len(b)) {
+		return nil, corrupted
+	}
+	var items []string
+	pos := 10
+	for {
+		if pos >= len(b) {
+			return nil, corrupted
+		}
+		if b[pos] == 0xFF {
+			if pos != len(b)-1 {
+				return nil, corrupted
+			}
+			return items, nil
+		}
+		if b[pos] < 0xFE {
+			pos++
+		} else {
+			pos += 5
+		}
+		if pos >= len(b) {
+			return nil, corrupted
+		}
+		encoding := b[pos]
+		var header, length int
+		var item string
+		switch encoding >> 6 {
+		case 0:
+			header, length = 1, int(encoding&0x3F)
+		case 1:
+			if pos+2 > len(b) {
+				return nil, corrupted
+			}
+			header, length = 2, int(encoding&0x3F)<<8|int(b[pos+1])
+		case 2:
+			if pos+5 > len(b) {
+				return nil, corrupted
+			}
+			header, length = 5, int(binary.BigEndian.Uint32(b[pos+1:]))
+		default:
+			header = 1
+			switch {
+			case encoding == 0xC0:
+				length = 2
+			case encoding == 0xD0:
+				length = 4
+			case encoding == 0xE0:
+				length = 8
+			case encoding == 0xF0:
+				length = 3
+			case encoding == 0xFE:
+				length = 1
+			case encoding >= 0xF1 && encoding <= 0xFD:
+				item = strconv.Itoa(int(encoding&0x0F) - 1)
+			default:
+				return nil, corrupted
+			}
+		}
+		if length < 0 || pos+header+length > len(b) {
+			return nil, corrupted
+		}
+		data := b[pos+header : pos+header+length]
+		switch {
+		case encoding>>6 != 3:
+			item = string(data)
+		case length > 0:
+			item = strconv.FormatInt(littleEndianInt(data), 10)
+		}
+		items = append(items, item)
+		pos += header + length
+	}
+}
+
+// parseListpack returns the entries of a listpack: a header with the total
+// size and the count, then entries made of an encoding, the data and the
+// entry size encoded backwards, and a 0xFF terminator.
+func parseListpack(b []byte) ([]string, error) {
+	corrupted := errors.New("corrupted listpack")
+	if len(b) < 7 || binary.LittleEndian.Uint32(b) != uint32(len(b)) {
+		return nil, corrupted
+	}
+	var items []string
+	pos := 6
+	for {
+		if pos >= len(b) {
+			return nil, corrupted
+		}
+		encoding := b[pos]
+		if encoding == 0xFF {
+			if pos != len(b)-1 {
+				return nil, corrupted
+			}
+			return items, nil
+		}
+		var header, length int
+		isInt := false
+		switch {
+		case encoding&0x80 == 0:
+			items = append(items, strconv.Itoa(int(encoding)))
+			pos += 1 + listpackBacklenSize(1)
+			continue
+		case encoding&0xC0 == 0x80:
+			header, length = 1, int(encoding&0x3F)
+		case encoding&0xE0 == 0xC0:
+			if pos+2 > len(b) {
+				return nil, corrupted
+			}
+			// 13 bit signed integer
+			n := int(encoding&0x1F)<<8 | int(b[pos+1])
+			if n >= 1<<12 {
+				n -= 1 << 13
+			}
+			items = append(items, strconv.Itoa(n))
+			pos += 2 + listpackBacklenSize(2)
+			continue
+		case encoding&0xF0 == 0xE0:
+			if pos+2 > len(b) {
+				return nil, corrupted
+			}
+			header, length = 2, int(encoding&0x0F)<<8|int(b[pos+1])
+		case encoding == 0xF0:
+			if pos+5 > len(b) {
+				return nil, corrupted
+			}
+			header, length = 5, int(binary.LittleEndian.Uint32(b[pos+1:]))
+		case encoding >= 0xF1 && encoding <= 0xF4:
+			header, length, isInt = 1, [...]int{2, 3, 4, 8}[encoding-0xF1], true
+		default:
+			return nil, corrupted
+		}
+		if length < 0 || pos+header+length > len(b) {
+			return nil, corrupted
+		}
+		data := b[pos+header : pos+header+length]
+		if isInt {
+			items = append(items, strconv.FormatInt(littleEndianInt(data), 10))
+		} else {
+			items = append(items, string(data))
+		}
+		pos += header + length + listpackBacklenSize(header+length)
+	}
+}
+
+// listpackBacklenSize is the size of the backwards encoded entry size, which
+// takes 7 bits per byte.
+func listpackBacklenSize(n int) int {
+	switch {
+	case n <= 127:
+		return 1
+	case n < 16383:
+		return 2
+	case n < 2097151:
+		return 3
+	case n < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// listpackWriter builds a listpack, integers get the smallest encoding.
+type listpackWriter struct {
+	buf   []byte
+	count int
+}
+
+func (lp *listpackWriter) appendString(s string) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(n, 10) == s {
+		lp.appendInt(n)
+		return
+	}
+	var entry []byte
+	switch {
+	case len(s) < 1<<6:
+		entry = []byte{0x80 | byte(len(s))}
+	case len(s) < 1<<12:
+		entry = []byte{0xE0 | byte(len(s)>>8), byte(len(s))}
+	default:
+		entry = binary.LittleEndian.AppendUint32([]byte{0xF0}, uint32(len(s)))
+	}
+	lp.appendEntry(append(entry, s...))
+}
+
+func (lp *listpackWriter) appendInt(n int64) {
+	var entry []byte
+	switch {
+	case n >= 0 && n <= 127:
+		entry = []byte{byte(n)}
+	case n >= -1<<12 && n < 1<<12:
+		entry = []byte{0xC0 | byte(uint64(n)>>8)&0x1F, byte(n)}
+	case n >= -1<<15 && n < 1<<15:
+		entry = binary.LittleEndian.AppendUint16([]byte{0xF1}, uint16(n))
+	case n >= -1<<23 && n < 1<<23:
+		entry = []byte{0xF2, byte(n), byte(n >> 8), byte(n >> 16)}
+	case n >= -1<<31 && n < 1<<31:
+		entry = binary.LittleEndian.AppendUint32([]byte{0xF3}, uint32(n))
+	default:
+		entry = binary.LittleEndian.AppendUint64([]byte{0xF4}, uint64(n))
+	}
+	lp.appendEntry(entry)
+}
+
+func (lp *listpackWriter) appendEntry(entry []byte) {
+	lp.buf = append(lp.buf, entry...)
+	// the size is read from the last byte backwards, 7 bits per byte with
+	// the high bit set on all but the last one read, so the lowest bits come
+	// last: 200 is 0x01 0xC8
+	size := uint64(len(entry))
+	backlen := make([]byte, listpackBacklenSize(len(entry)))
+	for i := len(backlen) - 1; i >= 0; i-- {
+		backlen[i] = byte(size & 0x7F)
+		if i != 0 {
+			backlen[i] |= 0x80
+		}
+		size >>= 7
+	}
+	lp.buf = append(lp.buf, backlen...)
+	lp.count++
+}
+
+func (lp *listpackWriter) bytes() []byte {
+	res := binary.LittleEndian.AppendUint32(nil, uint32(6+len(lp.buf)+1))
+	// the count saturates, readers count entries then
+	res = binary.LittleEndian.AppendUint16(res, uint16(min(lp.count, 0xFFFF)))
+	res = append(res, lp.buf...)
+	return append(res, 0xFF)
+}
+
+// parseIntset returns the members of an intset: the size of integers, the
+// count and the sorted integers.
+func parseIntset(b []byte) ([]string, error) {
+	if len(b) < 8 {
+		return nil, errors.New("corrupted intset")
+	}
+	size := int(binary.LittleEndian.Uint32(b))
+	count := int(binary.LittleEndian.Uint32(b[4:]))
+	if size != 2 && size != 4 && size != 8 || count < 0 || len(b) != 8+size*count {
+		return nil, errors.New("corrupted intset")
+	}
+	items := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		items = append(items, strconv.FormatInt(littleEndianInt(b[8+i*size:8+(i+1)*size]), 10))
+	}
+	return items, nil
+}
+
+// parseZipmap returns the fields and values of a zipmap, the hash encoding
+// of Redis before 2.6: a count byte, then keys and values with their
+// lengths, values also having some free bytes after them.
+func parseZipmap(b []byte) ([]string, error) {
+	corrupted := errors.New("corrupted zipmap")
+	pos := 1
+	readLength := func() (int, error) {
+		if pos >= len(b) {
+			return 0, corrupted
+		}
+		if b[pos] < 254 {
+			pos++
+			return int(b[pos-1]), nil
+		}
+		if b[pos] == 255 || pos+5 > len(b) {
+			return 0, corrupted
+		}
+		pos += 5
+		return int(binary.LittleEndian.Uint32(b[pos-4:])), nil
+	}
+	var items []string
+	for {
+		if pos >= len(b) {
+			return nil, corrupted
+		}
+		if b[pos] == 0xFF {
+			if pos != len(b)-1 {
+				return nil, corrupted
+			}
+			return items, nil
+		}
+		for _, isValue := range []bool{false, true} {
+			length, err := readLength()
+			if err != nil {
+				return nil, err
+			}
+			free := 0
+			if isValue {
+				if pos >= len(b) {
+					return nil, corrupted
+				}
+				free = int(b[pos])
+				pos++
+			}
+			if length < 0 || pos+length+free > len(b) {
+				return nil, corrupted
+			}
+			items = append(items, string(b[pos:pos+length]))
+			pos += length + free
+		}
+	}
+}
+
+// littleEndianInt decodes a signed little endian integer of 1 to 8 bytes.
+func littleEndianInt(b []byte) int64 {
+	var n uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		n = n<<8 | uint64(b[i])
+	}
+	shift := 64 - 8*len(b)
+	return int64(n<<shift) >> shift
+}
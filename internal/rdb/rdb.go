@@ -0,0 +1,1053 @@
+// Package rdb reads and writes the RDB snapshot format of Redis.
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	// Version is the format version written, older ones are read too
+	Version = 11
+
+	opcodeAux          = 0xFA
+	opcodeResizeDB     = 0xFB
+	opcodeExpireTimeMs = 0xFC
+	opcodeExpireTime   = 0xFD
+	opcodeSelectDB     = 0xFE
+	opcodeEOF          = 0xFF
+
+	// opcodeFunction2 carries a function library, opcodeModuleAux
+	// data of a module
+	opcodeFunctionPreGA = 0xF6
+	opcodeFunction2     = 0xF5
+	opcodeModuleAux     = 0xF7
+	// opcodeIdle and opcodeFreq are the LRU and LFU info of the next
+	// key
+	opcodeIdle = 0xF8
+	opcodeFreq = 0xF9
+
+	typeString           = 0
+	typeList             = 1
+	typeSet              = 2
+	typeZSet             = 3
+	typeHash             = 4
+	typeZSet2            = 5
+	typeModulePreGA      = 6
+	typeModule2          = 7
+	typeHashZipmap       = 9
+	typeListZiplist      = 10
+	typeSetIntset        = 11
+	typeZSetZiplist      = 12
+	typeHashZiplist      = 13
+	typeListQuicklist    = 14
+	typeStreamListpacks  = 15
+	typeHashListpack     = 16
+	typeZSetListpack     = 17
+	typeListQuicklist2   = 18
+	typeStreamListpacks2 = 19
+	typeSetListpack      = 20
+	typeStreamListpacks3 = 21
+	quicklistNodePlain   = 1
+	quicklistNodePacked  = 2
+	streamNodeMaxEntries = 100
+	streamItemDeleted    = 1
+	streamItemSameFields = 2
+
+	len6Bit  = 0
+	len14Bit = 1
+	len32Bit = 0x80
+	len64Bit = 0x81
+	encVal   = 3
+
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+
+	maxPrealloc = 64 * 1024
+)
+
+// crc64Table is for the Jones polynomial used by Redis. Go's crc64 inverts
+// the checksum before and after each update, Redis doesn't.
+var crc64Table = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+func crc64Update(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crc64Table, p)
+}
+
+// crcWriter computes the checksum of everything written through it.
+type crcWriter struct {
+	w   io.Writer
+	crc uint64
+}
+
+func (cw *crcWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.crc = crc64Update(cw.crc, p[:n])
+	return n, err
+}
+
+// crcReader computes the checksum of everything read through it and counts
+// the bytes.
+type crcReader struct {
+	r   io.Reader
+	crc uint64
+	n   int64
+}
+
+func (cr *crcReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.crc = crc64Update(cr.crc, p[:n])
+	cr.n += int64(n)
+	return n, err
+}
+
+// AuxField is a field of metadata, like the version of the server which
+// wrote the file.
+type AuxField struct {
+	Key   string
+	Value string
+}
+
+// Write serializes the dataset in the RDB format with the aux fields in the
+// header.
+func Write(w io.Writer, data map[string]Value, aux ...AuxField) error {
+	bw := bufio.NewWriter(w)
+	cw := &crcWriter{w: bw}
+	enc := encoder{w: cw}
+
+	enc.writeRaw([]byte(fmt.Sprintf("REDIS%04d", Version)))
+	for _, field := range aux {
+		enc.writeAux(field.Key, field.Value)
+	}
+
+	expires := 0
+	for _, value := range data {
+		if !value.Expire.IsZero() {
+			expires++
+		}
+	}
+	enc.writeRaw([]byte{opcodeSelectDB})
+	enc.writeLength(0)
+	enc.writeRaw([]byte{opcodeResizeDB})
+	enc.writeLength(uint64(len(data)))
+	enc.writeLength(uint64(expires))
+	for key, value := range data {
+		if !value.Expire.IsZero() {
+			enc.writeRaw([]byte{opcodeExpireTimeMs})
+			enc.writeRaw(binary.LittleEndian.AppendUint64(nil, uint64(value.Expire.UnixMilli())))
+		}
+		enc.writeValue(key, value)
+	}
+	enc.writeRaw([]byte{opcodeEOF})
+	if enc.err != nil {
+		return fmt.Errorf("writing RDB: %w", enc.err)
+	}
+	if _, err := bw.Write(binary.LittleEndian.AppendUint64(nil, cw.crc)); err != nil {
+		return fmt.Errorf("writing RDB checksum: %w", err)
+	}
+	return bw.Flush()
+}
+
+// encoder remembers the first error, so a sequence of writes can be
+// checked once.
+type encoder struct {
+	w   io.Writer
+	err error
+}
+
+func (enc *encoder) writeRaw(p []byte) {
+	if enc.err != nil {
+		return
+	}
+	_, enc.err = enc.w.Write(p)
+}
+
+func (enc *encoder) writeLength(n uint64) {
+	switch {
+	case n < 1<<6:
+		enc.writeRaw([]byte{byte(n)})
+	case n < 1<<14:
+		enc.writeRaw([]byte{byte(n>>8) | len14Bit<<6, byte(n)})
+	case n <= 0xFFFFFFFF:
+		enc.writeRaw(binary.BigEndian.AppendUint32([]byte{len32Bit}, uint32(n)))
+	default:
+		enc.writeRaw(binary.BigEndian.AppendUint64([]byte{len64Bit}, n))
+	}
+}
+
+func (enc *encoder) writeString(s string) {
+	// strings holding small integers are stored as integers, as Redis does
+	if n, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(n, 10) == s {
+		switch {
+		case n >= -1<<7 && n < 1<<7:
+			enc.writeRaw([]byte{encVal<<6 | encInt8, byte(n)})
+		case n >= -1<<15 && n < 1<<15:
+			enc.writeRaw(binary.LittleEndian.AppendUint16([]byte{encVal<<6 | encInt16}, uint16(n)))
+		default:
+			enc.writeRaw(binary.LittleEndian.AppendUint32([]byte{encVal<<6 | encInt32}, uint32(n)))
+		}
+		return
+	}
+	enc.writeLength(uint64(len(s)))
+	enc.writeRaw([]byte(s))
+}
+
+func (enc *encoder) writeAux(key, value string) {
+	enc.writeRaw([]byte{opcodeAux})
+	enc.writeString(key)
+	enc.writeString(value)
+}
+
+// Info describes a decoded RDB file.
+type Info struct {
+	Version int
+	Aux     []AuxField
+	// Checksum is zero when the writer disabled it
+	Checksum uint64
+}
+
+// Key is a key decoded from an RDB file.
+type Key struct {
+	// Offset is where the record of the key starts
+	Offset int64
+	DB     uint64
+	Name   string
+	// Type is the type the value was stored with, see TypeName
+	Type  byte
+	Value Value
+}
+
+// Error reports the record of an RDB file which couldn't be decoded.
+type Error struct {
+	Offset int64
+	Record string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at offset %d: %v", e.Record, e.Offset, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Read parses an RDB payload and returns the dataset without the keys which
+// are already expired. There is a single database, keys of the others are
+// skipped.
+func Read(r io.Reader) (map[string]Value, error) {
+	now := time.Now()
+	data := make(map[string]Value)
+	skipped := 0
+	_, err := Decode(r, func(key Key) error {
+		switch {
+		case key.DB != 0:
+			skipped++
+		case !key.Value.IsExpired(now):
+			data[key.Name] = key.Value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if skipped > 0 {
+		slog.Warn("Skipped keys of databases other than 0 in RDB", "count", skipped)
+	}
+	return data, nil
+}
+
+// Decode parses an RDB payload and calls visit for every key, expired ones
+// included. Decoding errors are *Error, errors of visit are returned as is.
+func Decode(r io.Reader, visit func(Key) error) (Info, error) {
+	cr := &crcReader{r: r}
+	dec := decoder{r: cr}
+	info := Info{}
+	// start is the offset of the record being decoded
+	var start int64
+	fail := func(record string, err error) (Info, error) {
+		return info, &Error{Offset: start, Record: record, Err: err}
+	}
+
+	header, err := dec.readRaw(9)
+	if err != nil {
+		return fail("header", err)
+	}
+	if string(header[:5]) != "REDIS" {
+		return fail("header", fmt.Errorf("wrong signature %q", header[:5]))
+	}
+	info.Version, err = strconv.Atoi(string(header[5:]))
+	if err != nil || info.Version < 1 || info.Version > Version {
+		return fail("header", fmt.Errorf("can't handle format version %q", header[5:]))
+	}
+
+	var expire time.Time
+	var db uint64
+	for {
+		start = cr.n
+		opcode, err := dec.readByte()
+		if err != nil {
+			return fail("opcode", err)
+		}
+		switch opcode {
+		case opcodeEOF:
+			expected := cr.crc
+			checksum, err := dec.readRaw(8)
+			if err != nil {
+				return fail("checksum", err)
+			}
+			info.Checksum = binary.LittleEndian.Uint64(checksum)
+			// zero checksum means that it was disabled with rdbchecksum no
+			if info.Version >= 5 && info.Checksum != 0 && info.Checksum != expected {
+				return fail("checksum", fmt.Errorf("wrong checksum expected %x got %x", expected, info.Checksum))
+			}
+			return info, nil
+		case opcodeAux:
+			key, err := dec.readString()
+			if err != nil {
+				return fail("aux field key", err)
+			}
+			value, err := dec.readString()
+			if err != nil {
+				return fail("aux field value", err)
+			}
+			info.Aux = append(info.Aux, AuxField{key, value})
+		case opcodeSelectDB:
+			if db, err = dec.readLength(); err != nil {
+				return fail("db number", err)
+			}
+		case opcodeResizeDB:
+			if _, err := dec.readLength(); err != nil {
+				return fail("db size", err)
+			}
+			if _, err := dec.readLength(); err != nil {
+				return fail("expires size", err)
+			}
+		case opcodeExpireTimeMs:
+			ms, err := dec.readRaw(8)
+			if err != nil {
+				return fail("expire time", err)
+			}
+			expire = time.UnixMilli(int64(binary.LittleEndian.Uint64(ms)))
+		case opcodeExpireTime:
+			sec, err := dec.readRaw(4)
+			if err != nil {
+				return fail("expire time", err)
+			}
+			expire = time.Unix(int64(binary.LittleEndian.Uint32(sec)), 0)
+		case opcodeIdle:
+			if _, err := dec.readLength(); err != nil {
+				return fail("idle time", err)
+			}
+		case opcodeFreq:
+			if _, err := dec.readByte(); err != nil {
+				return fail("access frequency", err)
+			}
+		case opcodeFunction2:
+			// functions are not supported, their libraries are dropped
+			if _, err := dec.readString(); err != nil {
+				return fail("function library", err)
+			}
+			slog.Warn("Skipping function library of RDB")
+		case opcodeFunctionPreGA, opcodeModuleAux:
+			return fail("opcode", fmt.Errorf("unsupported opcode %x", opcode))
+		default:
+			name, err := dec.readString()
+			if err != nil {
+				return fail("key", err)
+			}
+			value, err := dec.readValue(opcode)
+			if err != nil {
+				return fail(fmt.Sprintf("value of %q (type %s)", name, TypeName(opcode)), err)
+			}
+			value.Expire = expire
+			expire = time.Time{}
+			if err := visit(Key{Offset: start, DB: db, Name: name, Type: opcode, Value: value}); err != nil {
+				return info, err
+			}
+		}
+	}
+}
+
+// TypeName names the types values are stored with.
+func TypeName(valueType byte) string {
+	names := map[byte]string{
+		typeString:           "string",
+		typeList:             "list",
+		typeSet:              "set",
+		typeZSet:             "zset",
+		typeHash:             "hash",
+		typeZSet2:            "zset-2",
+		typeModulePreGA:      "module-pre-ga",
+		typeModule2:          "module-2",
+		typeHashZipmap:       "hash-zipmap",
+		typeListZiplist:      "list-ziplist",
+		typeSetIntset:        "set-intset",
+		typeZSetZiplist:      "zset-ziplist",
+		typeHashZiplist:      "hash-ziplist",
+		typeListQuicklist:    "list-quicklist",
+		typeStreamListpacks:  "stream-listpacks",
+		typeHashListpack:     "hash-listpack",
+		typeZSetListpack:     "zset-listpack",
+		typeListQuicklist2:   "list-quicklist-2",
+		typeStreamListpacks2: "stream-listpacks-2",
+		typeSetListpack:      "set-listpack",
+		typeStreamListpacks3: "stream-listpacks-3",
+	}
+	if name, ok := names[valueType]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown-%d", valueType)
+}
+
+type decoder struct {
+	r io.Reader
+}
+
+func (dec *decoder) readRaw(n int) ([]byte, error) {
+	if n <= maxPrealloc {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(dec.r, buf)
+		return buf, err
+	}
+	// a corrupted length shouldn't allocate anything before the data arrives
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, dec.r, int64(n))
+	return buf.Bytes(), err
+}
+
+func (dec *decoder) readByte() (byte, error) {
+	buf, err := dec.readRaw(1)
+	if err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+// readLengthOrEncoding returns either a length or, for specially encoded
+// strings, the encoding type with isEncoded set.
+func (dec *decoder) readLengthOrEncoding() (n uint64, isEncoded bool, err error) {
+	first, err := dec.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch {
+	case first>>6 == len6Bit:
+		return uint64(first & 0x3F), false, nil
+	case first>>6 == len14Bit:
+		next, err := dec.readByte()
+		return uint64(first&0x3F)<<8 | uint64(next), false, err
+	case first == len32Bit:
+		buf, err := dec.readRaw(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case first == len64Bit:
+		buf, err := dec.readRaw(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	case first>>6 == encVal:
+		return uint64(first & 0x3F), true, nil
+	}
+	return 0, false, fmt.Errorf("unknown length encoding %x", first)
+}
+
+func (dec *decoder) readLength() (uint64, error) {
+	n, isEncoded, err := dec.readLengthOrEncoding()
+	if err == nil && isEncoded {
+		err = errors.New("expecting length but got encoded value")
+	}
+	return n, err
+}
+
+func (dec *decoder) readString() (string, error) {
+	n, isEncoded, err := dec.readLengthOrEncoding()
+	if err != nil {
+		return "", err
+	}
+	if !isEncoded {
+		if n > math.MaxInt32 {
+			return "", fmt.Errorf("string length %d is too big", n)
+		}
+		buf, err := dec.readRaw(int(n))
+		return string(buf), err
+	}
+	switch n {
+	case encInt8:
+		buf, err := dec.readRaw(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(buf[0]))), nil
+	case encInt16:
+		buf, err := dec.readRaw(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf)))), nil
+	case encInt32:
+		buf, err := dec.readRaw(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf)))), nil
+	case encLZF:
+		compressedLen, err := dec.readLength()
+		if err != nil {
+			return "", err
+		}
+		n, err := dec.readLength()
+		if err != nil {
+			return "", err
+		}
+		if compressedLen > math.MaxInt32 || n > math.MaxInt32 {
+			return "", fmt.Errorf("compressed string length %d is too big", n)
+		}
+		compressed, err := dec.readRaw(int(compressedLen))
+		if err != nil {
+			return "", err
+		}
+		return lzfDecompress(compressed, int(n))
+	}
+	return "", fmt.Errorf("unknown string encoding %d", n)
+}
+
+// readValue reads a value of the given type, strings end up in Value and
+// the other types in Object whatever encoding they are stored with.
+func (dec *decoder) readValue(valueType byte) (Value, error) {
+	object := &Object{}
+	var err error
+	switch valueType {
+	case typeString:
+		value, err := dec.readString()
+		return Value{Value: value}, err
+	case typeList, typeSet, typeHash:
+		object.Type = map[byte]ObjectType{typeList: ObjectList, typeSet: ObjectSet, typeHash: ObjectHash}[valueType]
+		var n uint64
+		if n, err = dec.readLength(); err != nil {
+			break
+		}
+		if valueType == typeHash {
+			n *= 2
+		}
+		object.Items, err = dec.readStrings(n)
+	case typeZSet, typeZSet2:
+		object.Type = ObjectZSet
+		var n uint64
+		if n, err = dec.readLength(); err != nil {
+			break
+		}
+		for i := uint64(0); i < n && err == nil; i++ {
+			var member string
+			var score float64
+			if member, err = dec.readString(); err != nil {
+				break
+			}
+			if valueType == typeZSet2 {
+				score, err = dec.readBinaryDouble()
+			} else {
+				score, err = dec.readStringDouble()
+			}
+			object.Items = append(object.Items, member)
+			object.Scores = append(object.Scores, score)
+		}
+	case typeHashZipmap, typeListZiplist, typeSetIntset, typeZSetZiplist, typeHashZiplist,
+		typeHashListpack, typeZSetListpack, typeSetListpack:
+		var blob string
+		if blob, err = dec.readString(); err != nil {
+			break
+		}
+		var items []string
+		switch valueType {
+		case typeHashZipmap:
+			object.Type = ObjectHash
+			items, err = parseZipmap([]byte(blob))
+		case typeListZiplist:
+			object.Type = ObjectList
+			items, err = parseZiplist([]byte(blob))
+		case typeSetIntset:
+			object.Type = ObjectSet
+			items, err = parseIntset([]byte(blob))
+		case typeZSetZiplist:
+			object.Type = ObjectZSet
+			items, err = parseZiplist([]byte(blob))
+		case typeHashZiplist:
+			object.Type = ObjectHash
+			items, err = parseZiplist([]byte(blob))
+		case typeHashListpack:
+			object.Type = ObjectHash
+			items, err = parseListpack([]byte(blob))
+		case typeZSetListpack:
+			object.Type = ObjectZSet
+			items, err = parseListpack([]byte(blob))
+		case typeSetListpack:
+			object.Type = ObjectSet
+			items, err = parseListpack([]byte(blob))
+		}
+		if err != nil {
+			break
+		}
+		if object.Type == ObjectHash && len(items)%2 != 0 {
+			err = errors.New("odd number of hash fields and values")
+			break
+		}
+		if object.Type != ObjectZSet {
+			object.Items = items
+			break
+		}
+		// sorted sets are stored as member and score pairs
+		if len(items)%2 != 0 {
+			err = errors.New("odd number of sorted set members and scores")
+			break
+		}
+		for i := 0; i < len(items); i += 2 {
+			score, parseErr := strconv.ParseFloat(items[i+1], 64)
+			if parseErr != nil {
+				err = fmt.Errorf("sorted set score %q is not a float", items[i+1])
+				break
+			}
+			object.Items = append(object.Items, items[i])
+			object.Scores = append(object.Scores, score)
+		}
+	case typeListQuicklist, typeListQuicklist2:
+		object.Type = ObjectList
+		object.Items, err = dec.readQuicklist(valueType)
+	case typeStreamListpacks, typeStreamListpacks2, typeStreamListpacks3:
+		object.Type = ObjectStream
+		object.Stream, err = dec.readStream(valueType)
+	case typeModulePreGA, typeModule2:
+		return Value{}, errors.New("module values are not supported")
+	default:
+		return Value{}, fmt.Errorf("unsupported RDB value type %d", valueType)
+	}
+	return Value{Object: object}, err
+}
+
+func (dec *decoder) readStrings(n uint64) ([]string, error) {
+	res := make([]string, 0, min(n, maxPrealloc))
+	for i := uint64(0); i < n; i++ {
+		s, err := dec.readString()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+func (dec *decoder) readBinaryDouble() (float64, error) {
+	buf, err := dec.readRaw(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// readStringDouble reads a score of the old sorted set type, written as a
+// length prefixed string with special lengths for NaN and infinities.
+func (dec *decoder) readStringDouble() (float64, error) {
+	n, err := dec.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf, err := dec.readRaw(int(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+// readQuicklist reads the nodes of a list, ziplists for the old type, and
+// listpacks or single plain elements for the new one.
+func (dec *decoder) readQuicklist(valueType byte) ([]string, error) {
+	nodes, err := dec.readLength()
+	if err != nil {
+		return nil, err
+	}
+	var items []string
+	for i := uint64(0); i < nodes; i++ {
+		container := uint64(quicklistNodePacked)
+		if valueType == typeListQuicklist2 {
+			if container, err = dec.readLength(); err != nil {
+				return nil, err
+			}
+		}
+		blob, err := dec.readString()
+		if err != nil {
+			return nil, err
+		}
+		var nodeItems []string
+		switch {
+		case container == quicklistNodePlain:
+			nodeItems = []string{blob}
+		case container != quicklistNodePacked:
+			return nil, fmt.Errorf("unknown quicklist node container %d", container)
+		case valueType == typeListQuicklist:
+			nodeItems, err = parseZiplist([]byte(blob))
+		default:
+			nodeItems, err = parseListpack([]byte(blob))
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, nodeItems...)
+	}
+	return items, nil
+}
+
+func (dec *decoder) readStreamID() (StreamID, error) {
+	ms, err := dec.readLength()
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, err := dec.readLength()
+	return StreamID{Ms: ms, Seq: seq}, err
+}
+
+// readStream reads the listpack nodes of a stream, then its metadata and
+// consumer groups. The pending entries of groups are skipped.
+func (dec *decoder) readStream(valueType byte) (*Stream, error) {
+	stream := &Stream{}
+	nodes, err := dec.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < nodes; i++ {
+		nodeKey, err := dec.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(nodeKey) != 16 {
+			return nil, fmt.Errorf("stream node key of %d bytes", len(nodeKey))
+		}
+		master := StreamID{
+			Ms:  binary.BigEndian.Uint64([]byte(nodeKey[:8])),
+			Seq: binary.BigEndian.Uint64([]byte(nodeKey[8:])),
+		}
+		blob, err := dec.readString()
+		if err != nil {
+			return nil, err
+		}
+		items, err := parseListpack([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		entries, err := parseStreamNode(master, items)
+		if err != nil {
+			return nil, err
+		}
+		stream.Entries = append(stream.Entries, entries...)
+	}
+	length, err := dec.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if length != uint64(len(stream.Entries)) {
+		return nil, fmt.Errorf("stream length %d with %d entries", length, len(stream.Entries))
+	}
+	if stream.LastID, err = dec.readStreamID(); err != nil {
+		return nil, err
+	}
+	if valueType >= typeStreamListpacks2 {
+		if stream.FirstID, err = dec.readStreamID(); err != nil {
+			return nil, err
+		}
+		if stream.MaxDeletedID, err = dec.readStreamID(); err != nil {
+			return nil, err
+		}
+		if stream.EntriesAdded, err = dec.readLength(); err != nil {
+			return nil, err
+		}
+	} else {
+		stream.EntriesAdded = length
+		if len(stream.Entries) > 0 {
+			stream.FirstID = stream.Entries[0].ID
+		}
+	}
+
+	groups, err := dec.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < groups; i++ {
+		group := StreamGroup{EntriesRead: -1}
+		if group.Name, err = dec.readString(); err != nil {
+			return nil, err
+		}
+		if group.LastID, err = dec.readStreamID(); err != nil {
+			return nil, err
+		}
+		if valueType >= typeStreamListpacks2 {
+			entriesRead, err := dec.readLength()
+			if err != nil {
+				return nil, err
+			}
+			group.EntriesRead = int64(entriesRead)
+		}
+		pending, err := dec.readLength()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < pending; j++ {
+			// entry id, delivery time and delivery count
+			if _, err := dec.readRaw(16 + 8); err != nil {
+				return nil, err
+			}
+			if _, err := dec.readLength(); err != nil {
+				return nil, err
+			}
+		}
+		consumers, err := dec.readLength()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < consumers; j++ {
+			if _, err := dec.readString(); err != nil {
+				return nil, err
+			}
+			// seen time, and active time since the third stream type
+			times := 8
+			if valueType == typeStreamListpacks3 {
+				times = 16
+			}
+			if _, err := dec.readRaw(times); err != nil {
+				return nil, err
+			}
+			owned, err := dec.readLength()
+			if err != nil {
+				return nil, err
+			}
+			for k := uint64(0); k < owned; k++ {
+				if _, err := dec.readRaw(16); err != nil {
+					return nil, err
+				}
+			}
+		}
+		stream.Groups = append(stream.Groups, group)
+	}
+	return stream, nil
+}
+
+// parseStreamNode returns the entries of a stream node. The node starts with
+// the fields of its first entry, entries with the same fields only store
+// values, and ids are relative to the master id of the node.
+func parseStreamNode(master StreamID, items []string) ([]StreamEntry, error) {
+	corrupted := errors.New("corrupted stream node")
+	pos := 0
+	next := func() (int64, error) {
+		if pos >= len(items) {
+			return 0, corrupted
+		}
+		n, err := strconv.ParseInt(items[pos], 10, 64)
+		pos++
+		if err != nil {
+			return 0, corrupted
+		}
+		return n, nil
+	}
+	var header [3]int64
+	for i := range header {
+		var err error
+		if header[i], err = next(); err != nil {
+			return nil, err
+		}
+	}
+	masterFieldsCount := int(header[2])
+	if masterFieldsCount < 0 || pos+masterFieldsCount >= len(items) {
+		return nil, corrupted
+	}
+	masterFields := items[pos : pos+masterFieldsCount]
+	pos += masterFieldsCount
+	if terminator, err := next(); err != nil || terminator != 0 {
+		return nil, corrupted
+	}
+
+	var entries []StreamEntry
+	for pos < len(items) {
+		flags, err := next()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := next()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := next()
+		if err != nil {
+			return nil, err
+		}
+		var fields []string
+		if flags&streamItemSameFields != 0 {
+			if pos+masterFieldsCount > len(items) {
+				return nil, corrupted
+			}
+			for i, field := range masterFields {
+				fields = append(fields, field, items[pos+i])
+			}
+			pos += masterFieldsCount
+		} else {
+			count, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if count < 0 || int64(len(items)-pos) < 2*count {
+				return nil, corrupted
+			}
+			fields = append(fields, items[pos:pos+int(2*count)]...)
+			pos += int(2 * count)
+		}
+		// the count of items of the entry, for iterating backwards
+		if _, err := next(); err != nil {
+			return nil, err
+		}
+		if flags&streamItemDeleted != 0 {
+			continue
+		}
+		entries = append(entries, StreamEntry{
+			ID:     StreamID{Ms: master.Ms + uint64(msDiff), Seq: master.Seq + uint64(seqDiff)},
+			Fields: fields,
+		})
+	}
+	if int64(len(entries)) != header[0] {
+		return nil, corrupted
+	}
+	return entries, nil
+}
+
+// writeValue writes the type, key and value of an entry. Lists, sets,
+// hashes and sorted sets use the plain types any Redis version loads.
+func (enc *encoder) writeValue(key string, value Value) {
+	object := value.Object
+	if object == nil {
+		enc.writeRaw([]byte{typeString})
+		enc.writeString(key)
+		enc.writeString(value.Value)
+		return
+	}
+	switch object.Type {
+	case ObjectList, ObjectSet, ObjectHash:
+		valueType := map[ObjectType]byte{ObjectList: typeList, ObjectSet: typeSet, ObjectHash: typeHash}[object.Type]
+		enc.writeRaw([]byte{valueType})
+		enc.writeString(key)
+		n := len(object.Items)
+		if object.Type == ObjectHash {
+			n /= 2
+		}
+		enc.writeLength(uint64(n))
+		for _, item := range object.Items {
+			enc.writeString(item)
+		}
+	case ObjectZSet:
+		enc.writeRaw([]byte{typeZSet2})
+		enc.writeString(key)
+		enc.writeLength(uint64(len(object.Items)))
+		for i, member := range object.Items {
+			enc.writeString(member)
+			enc.writeRaw(binary.LittleEndian.AppendUint64(nil, math.Float64bits(object.Scores[i])))
+		}
+	case ObjectStream:
+		enc.writeRaw([]byte{typeStreamListpacks3})
+		enc.writeString(key)
+		enc.writeStream(object.Stream)
+	}
+}
+
+func (enc *encoder) writeBlob(p []byte) {
+	enc.writeLength(uint64(len(p)))
+	enc.writeRaw(p)
+}
+
+func (enc *encoder) writeStreamID(id StreamID) {
+	enc.writeLength(id.Ms)
+	enc.writeLength(id.Seq)
+}
+
+// writeStream writes entries in listpack nodes of up to
+// streamNodeMaxEntries, consumer groups are written without pending
+// entries and consumers.
+func (enc *encoder) writeStream(stream *Stream) {
+	nodes := (len(stream.Entries) + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	enc.writeLength(uint64(nodes))
+	for entries := stream.Entries; len(entries) > 0; {
+		node := entries[:min(len(entries), streamNodeMaxEntries)]
+		entries = entries[len(node):]
+		master := node[0].ID
+		var masterFields []string
+		for i := 0; i < len(node[0].Fields); i += 2 {
+			masterFields = append(masterFields, node[0].Fields[i])
+		}
+		nodeKey := binary.BigEndian.AppendUint64(nil, master.Ms)
+		enc.writeBlob(binary.BigEndian.AppendUint64(nodeKey, master.Seq))
+
+		lp := listpackWriter{}
+		lp.appendInt(int64(len(node)))
+		lp.appendInt(0)
+		lp.appendInt(int64(len(masterFields)))
+		for _, field := range masterFields {
+			lp.appendString(field)
+		}
+		lp.appendInt(0)
+		for _, entry := range node {
+			sameFields := len(entry.Fields) == 2*len(masterFields)
+			for i := 0; sameFields && i < len(masterFields); i++ {
+				sameFields = entry.Fields[2*i] == masterFields[i]
+			}
+			flags := int64(0)
+			if sameFields {
+				flags = streamItemSameFields
+			}
+			lp.appendInt(flags)
+			lp.appendInt(int64(entry.ID.Ms - master.Ms))
+			lp.appendInt(int64(entry.ID.Seq - master.Seq))
+			if sameFields {
+				for i := 1; i < len(entry.Fields); i += 2 {
+					lp.appendString(entry.Fields[i])
+				}
+				lp.appendInt(int64(len(masterFields) + 3))
+				continue
+			}
+			lp.appendInt(int64(len(entry.Fields) / 2))
+			for _, item := range entry.Fields {
+				lp.appendString(item)
+			}
+			lp.appendInt(int64(len(entry.Fields) + 4))
+		}
+		enc.writeBlob(lp.bytes())
+	}
+	enc.writeLength(uint64(len(stream.Entries)))
+	enc.writeStreamID(stream.LastID)
+	enc.writeStreamID(stream.FirstID)
+	enc.writeStreamID(stream.MaxDeletedID)
+	enc.writeLength(stream.EntriesAdded)
+	enc.writeLength(uint64(len(stream.Groups)))
+	for _, group := range stream.Groups {
+		enc.writeString(group.Name)
+		enc.writeStreamID(group.LastID)
+		enc.writeLength(uint64(group.EntriesRead))
+		// no pending entries and no consumers
+		enc.writeLength(0)
+		enc.writeLength(0)
+	}
+}
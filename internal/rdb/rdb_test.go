@@ -0,0 +1,268 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"maps"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCRC64(t *testing.T) {
+	if crc := crc64Update(0, []byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("expected Redis crc64 0xe9c6d914c4b8d9ca, but got %x", crc)
+	}
+}
+
+func TestReadRDBFromRedis(t *testing.T) {
+	// empty dataset saved by Redis 7.2
+	emptySnapshot, err := base64.StdEncoding.DecodeString("UkVESVMwMDEx+glyZWRpcy12ZXIFNy4yLjD6CnJlZGlzLWJpdHPAQPoFY3RpbWXCbQi8ZfoIdXNlZC1tZW3CsMQQAPoIYW9mLWJhc2XAAP/wbjv+wP9aog==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Read(bytes.NewReader(emptySnapshot))
+	if err != nil || len(data) != 0 {
+		t.Errorf("expected empty dataset, but got %v, %v", data, err)
+	}
+
+	emptySnapshot[len(emptySnapshot)-1] ^= 0xFF
+	if _, err := Read(bytes.NewReader(emptySnapshot)); err == nil {
+		t.Errorf("expected checksum error")
+	}
+}
+
+func TestRDBRoundTrip(t *testing.T) {
+	expire := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+	data := map[string]Value{
+		"string":  {Value: "value"},
+		"int8":    {Value: "-12"},
+		"int16":   {Value: "1000"},
+		"int32":   {Value: "-100000"},
+		"int64":   {Value: "10000000000"},
+		"leading": {Value: "007"},
+		"long":    {Value: string(bytes.Repeat([]byte("x"), 20000))},
+		"expire":  {Value: "soon", Expire: expire},
+		"":        {Value: ""},
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(data, loaded) {
+		t.Errorf("expected %v, but got %v", data, loaded)
+	}
+}
+
+func TestLZFDecompress(t *testing.T) {
+	// a literal "a" then a back reference of 9 bytes at distance 1
+	s, err := lzfDecompress([]byte{0x00, 'a', 0xE0, 0x00, 0x00}, 10)
+	if err != nil || s != "aaaaaaaaaa" {
+		t.Errorf("expected 10 a, but got %q, %v", s, err)
+	}
+	if _, err := lzfDecompress([]byte{0x20, 0x05}, 3); err == nil {
+		t.Errorf("expected error for a reference before the start")
+	}
+}
+
+func TestParseZiplist(t *testing.T) {
+	ziplist := []byte{
+		0x14, 0, 0, 0, 0x0F, 0, 0, 0, 3, 0,
+		0x00, 0x01, 'a', // 6 bit string
+		0x03, 0xFD, // immediate 12
+		0x02, 0xC0, 0xD4, 0xFE, // int16
+		0xFF,
+	}
+	items, err := parseZiplist(ziplist)
+	if err != nil || !reflect.DeepEqual(items, []string{"a", "12", "-300"}) {
+		t.Errorf("expected [a 12 -300], but got %v, %v", items, err)
+	}
+}
+
+func TestParseIntset(t *testing.T) {
+	items, err := parseIntset([]byte{2, 0, 0, 0, 2, 0, 0, 0, 0xFE, 0xFF, 5, 0})
+	if err != nil || !reflect.DeepEqual(items, []string{"-2", "5"}) {
+		t.Errorf("expected [-2 5], but got %v, %v", items, err)
+	}
+}
+
+func TestListpackRoundTrip(t *testing.T) {
+	items := []string{
+		"", "a", strings.Repeat("b", 70), strings.Repeat("c", 5000),
+		"5", "-100", "1000", "100000", "-10000000", strconv.Itoa(1 << 40), "007",
+	}
+	lp := listpackWriter{}
+	for _, item := range items {
+		lp.appendString(item)
+	}
+	parsed, err := parseListpack(lp.bytes())
+	if err != nil || !reflect.DeepEqual(parsed, items) {
+		t.Errorf("expected %q, but got %q, %v", items, parsed, err)
+	}
+}
+
+func TestListpackBacklen(t *testing.T) {
+	// the listpack of Redis for a 200 and a 20000 bytes string: the sizes of
+	// the entries, 202 and 20005, are written high bits first and the high
+	// bit set on all but the first byte
+	long, longer := strings.Repeat("a", 200), strings.Repeat("b", 20000)
+	expected := []byte{0xFB, 0x4E, 0, 0, 2, 0, 0xE0, 0xC8}
+	expected = append(expected, long...)
+	expected = append(expected, 0x01, 0xCA, 0xF0, 0x20, 0x4E, 0, 0)
+	expected = append(expected, longer...)
+	expected = append(expected, 0x01, 0x9C, 0xA5, 0xFF)
+
+	lp := listpackWriter{}
+	lp.appendString(long)
+	lp.appendString(longer)
+	if got := lp.bytes(); !bytes.Equal(got, expected) {
+		t.Fatalf("expected the listpack of Redis, but got %x...%x", got[:8], got[len(got)-4:])
+	}
+
+	// walking back from the end like Redis does lands on every entry
+	pos := len(expected) - 1
+	for _, entryLen := range []int{20005, 202} {
+		size, shift := 0, 0
+		for {
+			pos--
+			size |= int(expected[pos]&0x7F) << shift
+			shift += 7
+			if expected[pos]&0x80 == 0 {
+				break
+			}
+		}
+		if size != entryLen {
+			t.Fatalf("expected backlen %d, but got %d", entryLen, size)
+		}
+		pos -= size
+	}
+	if pos != 6 {
+		t.Errorf("expected to walk back to the first entry at 6, but got %d", pos)
+	}
+}
+
+func TestReadRDBEncodings(t *testing.T) {
+	var buf bytes.Buffer
+	enc := encoder{w: &buf}
+	enc.writeRaw([]byte("REDIS0011"))
+
+	hash := listpackWriter{}
+	for _, item := range []string{"field", "value", "n", "1"} {
+		hash.appendString(item)
+	}
+	enc.writeRaw([]byte{typeHashListpack})
+	enc.writeString("hash")
+	enc.writeBlob(hash.bytes())
+
+	zset := listpackWriter{}
+	for _, item := range []string{"one", "1", "half", "0.5"} {
+		zset.appendString(item)
+	}
+	enc.writeRaw([]byte{typeZSetListpack})
+	enc.writeString("zset")
+	enc.writeBlob(zset.bytes())
+
+	node := listpackWriter{}
+	node.appendString("x")
+	node.appendString("y")
+	enc.writeRaw([]byte{typeListQuicklist2})
+	enc.writeString("list")
+	enc.writeLength(2)
+	enc.writeLength(quicklistNodePacked)
+	enc.writeBlob(node.bytes())
+	enc.writeLength(quicklistNodePlain)
+	enc.writeString("plain")
+
+	enc.writeRaw([]byte{typeSetIntset})
+	enc.writeString("set")
+	enc.writeBlob([]byte{2, 0, 0, 0, 2, 0, 0, 0, 0xFE, 0xFF, 5, 0})
+
+	// keys of other databases are skipped
+	enc.writeRaw([]byte{opcodeSelectDB})
+	enc.writeLength(1)
+	enc.writeRaw([]byte{typeString})
+	enc.writeString("other")
+	enc.writeString("db")
+
+	enc.writeRaw([]byte{opcodeEOF})
+	enc.writeRaw(make([]byte, 8))
+
+	data, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]Value{
+		"hash": {Object: &Object{Type: ObjectHash, Items: []string{"field", "value", "n", "1"}}},
+		"zset": {Object: &Object{Type: ObjectZSet, Items: []string{"one", "half"}, Scores: []float64{1, 0.5}}},
+		"list": {Object: &Object{Type: ObjectList, Items: []string{"x", "y", "plain"}}},
+		"set":  {Object: &Object{Type: ObjectSet, Items: []string{"-2", "5"}}},
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected %v, but got %v", expected, data)
+	}
+}
+
+func TestRDBObjectsRoundTrip(t *testing.T) {
+	stream := &Stream{
+		LastID:       StreamID{Ms: 300, Seq: 0},
+		FirstID:      StreamID{Ms: 1, Seq: 0},
+		EntriesAdded: 151,
+		Groups:       []StreamGroup{{Name: "group", LastID: StreamID{Ms: 2, Seq: 0}, EntriesRead: -1}},
+	}
+	for i := 1; i <= 150; i++ {
+		fields := []string{"n", strconv.Itoa(i)}
+		if i%7 == 0 {
+			fields = append(fields, "extra", "field")
+		}
+		stream.Entries = append(stream.Entries, StreamEntry{ID: StreamID{Ms: uint64(i), Seq: uint64(i % 3)}, Fields: fields})
+	}
+	data := map[string]Value{
+		"list":   {Object: &Object{Type: ObjectList, Items: []string{"a", "1", "a"}}},
+		"set":    {Object: &Object{Type: ObjectSet, Items: []string{"a", "b"}}},
+		"hash":   {Object: &Object{Type: ObjectHash, Items: []string{"f", "v"}}},
+		"zset":   {Object: &Object{Type: ObjectZSet, Items: []string{"a", "b"}, Scores: []float64{-1.5, math.Inf(1)}}},
+		"stream": {Object: &Object{Type: ObjectStream, Stream: stream}},
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data, loaded) {
+		t.Errorf("expected %v, but got %v", data, loaded)
+	}
+}
+
+func TestDecodeErrorOffset(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, map[string]Value{"a": {Value: "1"}, "b": {Value: "2", Expire: time.UnixMilli(1)}}); err != nil {
+		t.Fatal(err)
+	}
+	var keys []Key
+	info, err := Decode(bytes.NewReader(buf.Bytes()), func(key Key) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil || info.Version != Version || len(keys) != 2 {
+		t.Fatalf("expected both keys, expired included, but got %v, %v", keys, err)
+	}
+
+	// cut the file in the middle of the second key
+	last := max(keys[0].Offset, keys[1].Offset)
+	_, err = Decode(bytes.NewReader(buf.Bytes()[:last+3]), func(Key) error { return nil })
+	var rdbErr *Error
+	if !errors.As(err, &rdbErr) || rdbErr.Offset != last {
+		t.Errorf("expected error at offset %d, but got %v", last, err)
+	}
+}
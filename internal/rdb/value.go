@@ -0,0 +1,79 @@
+package rdb
+
+import (
+	"fmt"
+	"time"
+)
+
+// Value is the value of a key with its expiration.
+type Value struct {
+	Value string
+	// Object is set for values of other types, Value is empty then
+	Object *Object
+	// Expire is zero for keys without expiration
+	Expire time.Time
+}
+
+func (v Value) IsExpired(now time.Time) bool {
+	return !v.Expire.IsZero() && !now.Before(v.Expire)
+}
+
+// ObjectType is the type of a value other than a string.
+type ObjectType int
+
+const (
+	ObjectList ObjectType = iota
+	ObjectSet
+	ObjectZSet
+	ObjectHash
+	ObjectStream
+)
+
+func (t ObjectType) String() string {
+	return [...]string{"list", "set", "zset", "hash", "stream"}[t]
+}
+
+// Object is a value of a type other than string.
+type Object struct {
+	Type ObjectType
+	// Items are list elements, set or sorted set members, or hash fields
+	// and values one after another
+	Items []string
+	// Scores are the scores of sorted set members in Items
+	Scores []float64
+	Stream *Stream
+}
+
+// StreamID is the id of a stream entry.
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+// StreamEntry is an entry of a stream, Fields has field names and values
+// one after another.
+type StreamEntry struct {
+	ID     StreamID
+	Fields []string
+}
+
+// StreamGroup is a consumer group of a stream. Pending entries and consumers
+// aren't kept, so consumers start over from LastID.
+type StreamGroup struct {
+	Name        string
+	LastID      StreamID
+	EntriesRead int64
+}
+
+type Stream struct {
+	Entries      []StreamEntry
+	LastID       StreamID
+	FirstID      StreamID
+	MaxDeletedID StreamID
+	EntriesAdded uint64
+	Groups       []StreamGroup
+}